@@ -1,11 +1,25 @@
 package objectdb
 
 import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/boonsuen/objectdb/fts"
 	"github.com/cockroachdb/pebble"
@@ -16,18 +30,51 @@ var (
 	ErrDuplicateKey      = errors.New("duplicate key")           // A document with the same key already exists
 	ErrNoDocuments       = errors.New("no documents found")      // No documents are found for a filter/query
 	ErrDocumentNotExists = errors.New("document does not exist") // A document does not exist given an ID
+	ErrNilQuery          = errors.New("query is nil")            // A nil query is passed to an operation that requires one
+	ErrTxnDone           = errors.New("transaction is done")     // A transaction is used after it is committed or rolled back
+	ErrInvalidDocument   = errors.New("invalid document")        // A document doesn't match the schema of its collection, has a _deleted field, or isn't a JSON object
+	ErrInvalidWeight     = errors.New("invalid weight")          // A text field weight is not a positive number
+	ErrInvalidBackup     = errors.New("invalid backup")          // A backup is not in the format written by Backup, or is truncated
+	ErrInvalidUpdate     = errors.New("invalid update")          // An update can't be applied to a document, e.g. an increment of a string
+	ErrReadOnly          = errors.New("database is read-only")   // A write is attempted on a database opened with OpenReadOnly
+	ErrInvalidQuery      = errors.New("invalid query")           // A query has an unknown operator, or a condition with an empty path or a value of the wrong type
+	ErrInvalidId         = errors.New("invalid id")              // An ID given for a new document contains the separator of the lists of IDs in the indexes, or an imported _id isn't a string
+	ErrInvalidPageToken  = errors.New("invalid page token")      // A page token passed to FindAfter is not one it returned
+	ErrIndexOutdated     = errors.New("index is outdated")       // The index was written by an earlier version and can't be upgraded, as the database is read-only
+	ErrIndexVersion      = errors.New("unknown index version")   // The index was written by a later version
+	ErrIndexingRequired  = errors.New("indexing is required")    // Indexing is disabled on a collection with a unique index, or a unique index is created on a collection without indexing
 )
 
+// DB is safe for concurrent use by multiple goroutines. Writes are serialized,
+// so that the read-modify-write of the index entries by concurrent writes
+// can't overwrite each other. Reads may run concurrently with each other, and
+// see each write either completely or not at all.
 type DB struct {
-	store *pebble.DB
-	index *pebble.DB
-	fts   *fts.FTS
+	store        *pebble.DB
+	index        *pebble.DB
+	fts          *fts.FTS
+	mu           *sync.RWMutex        // Guards the store and the indexes against concurrent writes, shared by the namespaces
+	writeOptions *pebble.WriteOptions // Options of all the writes, derived from the durability
+	namespace    string               // Key prefix of the namespace of the DB, empty outside of any namespace
+	readOnly     bool                 // Whether the DB is opened with OpenReadOnly
+	metrics      Metrics              // Observes the latency of the operations, if not nil
+	logger       Logger               // Receives the debug logs, if not nil
 }
 
 type Document map[string]interface{}
 
 type Options struct {
-	Limit int
+	Limit   int
+	Offset  int         // Number of matching documents to skip
+	Sort    []SortField // Sort fields, applied in order as tie-breakers
+	Project []string    // Paths to include in the returned documents, in addition to _id
+
+	IncludeDeleted bool // Whether to include the soft-deleted documents, which requires a full collection scan
+}
+
+type SortField struct {
+	Path       string
+	Descending bool
 }
 
 // Example of a query:
@@ -68,7 +115,7 @@ type Options struct {
 // The above query is equivalent to the following SQL where clause:
 // (top-level implicitly ANDs all the conditions)
 // (name = "Shaun Persad" AND age >= 27) AND (address.city = "New York" OR address.postcode = "10000")
-// - nested conditions are currently not supported
+// - a condition can itself be a nested group of conditions (see Condition)
 // - nested field is denoted by a dot (.) (e.g. address.city) in the path
 
 // The query of a single condition is equivalent to the following query:
@@ -86,10 +133,35 @@ type Options struct {
 // The query of a single condition is equivalent to the following SQL where clause:
 // name = "Shaun Persad"
 
+// A Condition with the AND or OR operator is a nested group of conditions:
+// its Operands are combined with the operator, and its Path and Value are
+// ignored. For example, name = "John" AND (age < 20 OR age > 60):
+//
+//	Query{
+//		{AND, []Condition{
+//			{Path: "name", Operator: EQ, Value: "John"},
+//			{Operator: OR, Operands: []Condition{
+//				{Path: "age", Operator: LT, Value: 20},
+//				{Path: "age", Operator: GT, Value: 60},
+//			}},
+//		}},
+//	}
 type Condition struct {
 	Path     string
 	Operator string
 	Value    interface{}
+	Operands []Condition // Conditions of a nested group
+
+	// CaseInsensitive compares strings ignoring case for EQ, NE, IN, STARTS,
+	// ENDS and CONTAINS
+	CaseInsensitive bool
+
+	// Negate inverts the result of the condition, e.g. to match the values
+	// not in a list or not greater than a bound. Negated conditions are
+	// never looked up in the index.
+	Negate bool
+
+	pattern *regexp.Regexp // Compiled Value of a MATCH condition, set by compilePatterns
 }
 
 type Query []struct {
@@ -99,36 +171,244 @@ type Query []struct {
 
 // Comparison operators
 const (
-	EQ  = "="
-	NE  = "!="
-	GT  = ">"
-	GTE = ">="
-	LT  = "<"
-	LTE = "<="
+	EQ      = "="
+	NE      = "!=" // Compares an array as a whole, unlike a negated EQ, which matches if no element equals Value
+	GT      = ">"
+	GTE     = ">="
+	LT      = "<"
+	LTE     = "<="
+	IN      = "in"      // Value is a []interface{} of candidate values
+	MATCH   = "match"   // Value is a regular expression string
+	BETWEEN = "between" // Value is a []interface{}{low, high} of inclusive bounds
+	EXISTS  = "exists"  // Value is true to match present paths, even if null, or false to match missing paths
+
+	// Substring operators, which compare the string representations of the
+	// values and are served by a full collection scan
+	STARTS   = "starts"
+	ENDS     = "ends"
+	CONTAINS = "contains"
+)
+
+// Logical operators, combining the conditions of a query group or a nested
+// group condition
+const (
+	AND = "AND"
+	OR  = "OR"
+)
+
+// FTSConfig configures the text analysis of the full-text search, i.e. the
+// stopwords and the language of the stemmer.
+type FTSConfig = fts.Config
+
+// Durability controls whether the writes wait for the data to be synced to disk.
+type Durability int
+
+const (
+	// Sync syncs every write to disk before returning. This is the default.
+	Sync Durability = iota
+	// NoSync leaves the syncing to the OS, which is much faster, but the
+	// latest writes can be lost if the machine crashes. Suited to bulk
+	// imports and ephemeral data.
+	NoSync
 )
 
-// Open opens the underlying storage engine
-func Open(path string) (*DB, error) {
-	db := DB{store: nil, index: nil, fts: nil}
+// Metrics observes the latency of the operations of a DB, e.g. to export it
+// to Prometheus. The queries are the methods reading documents, like FindMany,
+// FindPage, FindRange, Count, Distinct, Aggregate, Explain and the searches;
+// a FindIter query is observed once its Cursor is closed, with the documents
+// returned until then. The writes are the methods inserting, replacing,
+// upserting, updating, deleting and purging documents, as well as Import and
+// Restore. The transactions, Backup, Export and the methods managing the
+// settings, indexes and storage of the collections are not observed. Each
+// operation is observed once it is done, whether it failed or not, so the
+// methods must be safe for concurrent use.
+type Metrics interface {
+	// ObserveQuery observes a query with the number of documents it returned
+	ObserveQuery(op string, d time.Duration, matched int)
+	// ObserveWrite observes a write with the error it returned, if any
+	ObserveWrite(op string, d time.Duration, err error)
+}
+
+// OpenOptions configures the database when opening it.
+type OpenOptions struct {
+	Durability Durability // Applies to the store, the index and the full-text search writes
+	FTS        FTSConfig  // Text analysis of the full-text search
+	Metrics    Metrics    // Observes the latency of the operations, if not nil
+	Logger     Logger     // Receives the debug logs, if not nil
+}
+
+// Config configures the database like OpenOptions, and the Pebble engines of
+// its stores, e.g. their cache or memtable size to avoid write stalls on
+// large datasets. A nil *pebble.Options opens the store with the Pebble
+// defaults. If any store is opened read-only, the writes return ErrReadOnly.
+type Config struct {
+	OpenOptions
+
+	StoreOptions     *pebble.Options // Options of the store of the documents
+	IndexOptions     *pebble.Options // Options of the index
+	TextIndexOptions *pebble.Options // Options of the full-text search index
+}
+
+// Open opens the underlying storage engine. OpenOptions can be passed
+// optionally, e.g. to configure the durability or the full-text search.
+func Open(path string, options ...OpenOptions) (*DB, error) {
+	config := &Config{}
+	if len(options) > 0 {
+		config.OpenOptions = options[0]
+	}
+
+	return OpenWithOptions(path, config)
+}
+
+// OpenReadOnly opens the underlying storage engine without allowing writes,
+// e.g. to query a replica. The writes return ErrReadOnly. OpenOptions can be
+// passed optionally, e.g. to configure the full-text search like the DB was
+// written with, so that search terms are analyzed the same way.
+func OpenReadOnly(path string, options ...OpenOptions) (*DB, error) {
+	config := &Config{
+		StoreOptions:     &pebble.Options{ReadOnly: true},
+		IndexOptions:     &pebble.Options{ReadOnly: true},
+		TextIndexOptions: &pebble.Options{ReadOnly: true},
+	}
+	if len(options) > 0 {
+		config.OpenOptions = options[0]
+	}
+
+	return OpenWithOptions(path, config)
+}
+
+// OpenWithOptions is like Open, but also passes the Pebble options of the
+// config to the stores. A nil config is the same as an empty one.
+func OpenWithOptions(path string, config *Config) (*DB, error) {
+	if config == nil {
+		config = &Config{}
+	}
+
+	storeOptions := orDefaultOptions(config.StoreOptions)
+	indexOptions := orDefaultOptions(config.IndexOptions)
+	textIndexOptions := orDefaultOptions(config.TextIndexOptions)
+
+	db := DB{store: nil, index: nil, fts: nil, mu: &sync.RWMutex{}, writeOptions: pebble.Sync, metrics: config.Metrics, logger: config.Logger}
+	if config.Durability == NoSync {
+		db.writeOptions = pebble.NoSync
+	}
+	db.readOnly = storeOptions.ReadOnly || indexOptions.ReadOnly || textIndexOptions.ReadOnly
 	var err error
 
-	db.store, err = pebble.Open(path, &pebble.Options{})
+	// Close the stores opened so far if opening fails, so that they don't
+	// keep the locks of their directories
+	defer func() {
+		if err != nil {
+			db.closeOpened()
+		}
+	}()
+
+	db.store, err = pebble.Open(path, storeOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	db.index, err = pebble.Open(path+".index", indexOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	db.index, err = pebble.Open(path+".index", &pebble.Options{})
+	db.fts, err = fts.NewFTSWithOptions(path+".text_index", textIndexOptions, config.FTS)
 	if err != nil {
 		return nil, err
 	}
+	db.fts.SetWriteOptions(db.writeOptions)
+	db.fts.SetLogger(config.Logger)
+
+	if err = db.upgradeIndex(); err != nil {
+		return nil, err
+	}
+
+	if err = db.warnStaleTextIndexes(); err != nil {
+		return nil, err
+	}
+
+	return &db, nil
+}
+
+// closeOpened closes the stores of a DB that failed to open, ignoring their
+// errors, as the error of the failure is returned instead.
+func (db *DB) closeOpened() {
+	if db.fts != nil {
+		db.fts.Close()
+	}
+	if db.index != nil {
+		db.index.Close()
+	}
+	if db.store != nil {
+		db.store.Close()
+	}
+}
+
+// warnStaleTextIndexes looks for the collections of all the namespaces whose
+// full-text search entries are stale, as searching them would silently miss
+// documents until they are rebuilt, and logs a warning for each if a logger
+// is set. StaleTextIndexes returns them as well.
+func (db *DB) warnStaleTextIndexes() error {
+	collectionNames, err := getCollectionNames(db.store, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, collectionName := range collectionNames {
+		stale, err := db.fts.IsStale(collectionName)
+		if err != nil {
+			return err
+		}
+
+		if stale && db.logger != nil {
+			db.logger.Warn("full-text search index is stale, rebuild it with RebuildIndexes", logAttrs(collectionName)...)
+		}
+	}
+
+	return nil
+}
+
+// orDefaultOptions returns the Pebble options, or the default options if nil.
+func orDefaultOptions(options *pebble.Options) *pebble.Options {
+	if options == nil {
+		return &pebble.Options{}
+	}
 
-	db.fts, err = fts.NewFTS(path + ".text_index")
+	return options
+}
 
-	return &db, err
+// Namespace returns a DB for a logical database within the same stores,
+// whose collections never collide with the collections of other namespaces
+// or of the DB outside of any namespace. Namespaces can be nested. Clear and
+// DropCollection are scoped to the namespace, but Clear leaves its nested
+// namespaces untouched.
+//
+// The returned DB shares the stores and the write lock of db, so writes
+// through different namespaces are serialized too, and only db needs to be
+// closed.
+// Collection names starting with a zero byte are reserved for namespaces.
+func (db *DB) Namespace(name string) *DB {
+	return &DB{
+		store:        db.store,
+		index:        db.index,
+		fts:          db.fts,
+		mu:           db.mu,
+		writeOptions: db.writeOptions,
+		readOnly:     db.readOnly,
+		metrics:      db.metrics,
+		logger:       db.logger,
+		namespace:    db.namespace + namespacePrefix + namespaceEscaper.Replace(name) + string(keySeparator),
+	}
 }
 
-// Close closes the underlying storage engine
+// Close closes the underlying storage engine. Closing a namespace does
+// nothing, as its stores are closed with the DB it was created from.
 func (db *DB) Close() error {
+	if db.namespace != "" {
+		return nil
+	}
+
 	err := db.store.Close()
 	if err != nil {
 		return err
@@ -145,675 +425,7332 @@ func (db *DB) Close() error {
 	return nil
 }
 
+// lock acquires the write lock, or returns ErrReadOnly if the DB is opened
+// with OpenReadOnly.
+func (db *DB) lock() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.mu.Lock()
+	return nil
+}
+
+// observeQuery reports a query that started at start to the metrics, if any.
+func (db *DB) observeQuery(op string, start time.Time, matched int) {
+	if db.metrics != nil {
+		db.metrics.ObserveQuery(op, time.Since(start), matched)
+	}
+}
+
+// observeWrite reports a write that started at start to the metrics, if any.
+func (db *DB) observeWrite(op string, start time.Time, err error) {
+	if db.metrics != nil {
+		db.metrics.ObserveWrite(op, time.Since(start), err)
+	}
+}
+
 /****************
  * Insert
 ****************/
 
 func (db *DB) InsertOne(collectionName string, document interface{}) (string, error) {
-	id := uuid.New().String()
+	collectionName = db.collection(collectionName)
 
-	// Convert the document to a map
-	documentMap := map[string]interface{}{}
-	b, err := json.Marshal(document)
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return "", err
+	}
+	defer db.mu.Unlock()
+
+	id, err := db.insertOne(collectionName, "", document, false)
+	db.observeWrite("InsertOne", start, err)
+
+	return id, err
+}
+
+// InsertRaw inserts a document given as raw JSON, e.g. the body of an HTTP
+// request, without a Go type. It returns ErrInvalidDocument if the JSON is
+// not an object. Like with InsertOne, the document is stored under a new ID,
+// and the text fields added with AddTextFields are indexed.
+func (db *DB) InsertRaw(collectionName string, raw json.RawMessage) (string, error) {
+	var document Document
+	if err := json.Unmarshal(raw, &document); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+
+	if document == nil {
+		return "", fmt.Errorf("%w: not a JSON object", ErrInvalidDocument)
+	}
+
+	return db.InsertOne(collectionName, document)
+}
+
+// insertOne inserts the document under the given ID, or under a new ID if the
+// ID is empty. An imported document keeps its _createdAt. The caller must hold
+// the write lock.
+func (db *DB) insertOne(collectionName, id string, document interface{}, imported bool) (string, error) {
+	indexBatch := db.index.NewIndexedBatch()
+	defer indexBatch.Close()
+
+	ftsBatch := db.fts.NewBatch()
+	defer ftsBatch.Close()
+
+	if id == "" {
+		var err error
+		if id, err = db.newId(indexBatch, collectionName); err != nil {
+			return "", err
+		}
+	} else {
+		if err := validateId(id); err != nil {
+			return "", err
+		}
+
+		if err := raiseIdCounter(indexBatch, collectionName, id); err != nil {
+			return "", err
+		}
+	}
+
+	key, bs, err := db.prepareInsert(db.store, indexBatch, ftsBatch, collectionName, id, document, imported)
 	if err != nil {
 		return "", err
 	}
 
-	if err := json.Unmarshal(b, &documentMap); err != nil {
+	// Commit the index changes before writing the document to the store, so
+	// that a crash in between leaves at most dangling IDs in the indexes, which
+	// are skipped by queries, rather than a document missing from the indexes.
+	if err := db.commitIndexBatches(indexBatch, ftsBatch); err != nil {
+		return "", err
+	}
+
+	// Write the document to the store
+	if err := db.store.Set(key, bs, db.writeOptions); err != nil {
 		return "", err
 	}
 
+	return id, nil
+}
+
+// idSeparator separates the IDs of the legacy lists of IDs, stored by earlier
+// versions under the index keys and the tokens of the full-text search index.
+// The current layouts store a key per document instead, so the separator only
+// matters for the legacy lists that the index upgrade and
+// UpgradePostingLists convert, which split them like the full-text search
+// index does with its own idSeparator.
+const idSeparator = ","
+
+// validateId checks that an ID given for a new document, e.g. to Upsert or
+// Import, doesn't contain idSeparator, so that the legacy lists of IDs still
+// to be converted can't be split wrongly.
+func validateId(id string) error {
+	if strings.Contains(id, idSeparator) {
+		return fmt.Errorf("%w: %q contains %q", ErrInvalidId, id, idSeparator)
+	}
+
+	return nil
+}
+
+// prepareInsert writes the index and full-text search entries of a document
+// to the batches, and returns the key and the value of the document to write
+// to the store. The store is read through the given reader, so that the
+// documents pending in a batch of InsertMany are seen. An imported document
+// keeps its _createdAt, if it has one.
+func (db *DB) prepareInsert(store pebble.Reader, indexBatch, ftsBatch *pebble.Batch, collectionName, id string, document interface{}, imported bool) ([]byte, []byte, error) {
+	// Convert the document to a map
+	documentMap, err := toDocumentMap(document)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := db.validateDocument(collectionName, documentMap); err != nil {
+		return nil, nil, err
+	}
+
+	createdAt, _ := documentMap["_createdAt"].(string)
+	if err := db.stampDocument(collectionName, documentMap, nil); err != nil {
+		return nil, nil, err
+	}
+	if _, stamped := documentMap["_createdAt"]; stamped && imported && createdAt != "" {
+		documentMap["_createdAt"] = createdAt
+	}
+
 	// Add _id to document
 	documentMap["_id"] = id
 
 	// Marshal the document into a byte slice
 	bs, err := json.Marshal(documentMap)
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
 
 	// Build the key
 	key := getDocumentKey(collectionName, id)
 
-	// Check if the key already exists
-	value, closer, err := db.store.Get(key)
-	if err != nil && err != pebble.ErrNotFound {
-		return "", err
+	// Check if the key already exists. A soft-deleted document is replaced,
+	// as it is left out of the queries and the indexes.
+	exists, err := liveDocumentExists(store, collectionName, id)
+	if err != nil {
+		return nil, nil, err
 	}
-	if value != nil {
-		return "", fmt.Errorf("%w: %s", ErrDuplicateKey, id)
+	if exists {
+		return nil, nil, fmt.Errorf("%w: %s", ErrDuplicateKey, id)
 	}
-	if closer != nil {
-		defer closer.Close()
+
+	// Add the document to the index
+	if err := db.checkUniqueIndexes(store, indexBatch, collectionName, id, documentMap); err != nil {
+		return nil, nil, err
 	}
 
-	// Write the document to the store
-	if err := db.store.Set(key, bs, pebble.Sync); err != nil {
-		return "", err
+	if err := recordSplitTags(indexBatch, collectionName, reflect.ValueOf(document)); err != nil {
+		return nil, nil, err
 	}
 
-	// Add the document to the index
-	if err := db.indexDocument(collectionName, id, documentMap); err != nil {
-		return "", err
+	if err := db.indexDocument(indexBatch, collectionName, id, documentMap); err != nil {
+		return nil, nil, err
 	}
 
 	// Add the document to the full-text search index
-	if err := db.fts.AddToIndex(collectionName, id, document); err != nil {
-		return "", err
+	if err := db.fts.AddToIndexBatch(ftsBatch, collectionName, id, document); err != nil {
+		return nil, nil, err
 	}
 
-	return id, nil
+	return key, bs, nil
 }
 
+// insertManyBatchSize is the number of documents written per batch by InsertMany.
+const insertManyBatchSize = 1000
+
+// InsertMany inserts the documents into a collection. The documents are
+// written in batches, which is much faster than inserting them one by one.
+// If an error occurs, the documents of the batches written before are kept,
+// and their IDs are returned along with the error.
 func (db *DB) InsertMany(collectionName string, documents []interface{}) ([]string, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return nil, err
+	}
+	defer db.mu.Unlock()
+
+	ids, err := db.insertMany(collectionName, documents)
+	db.observeWrite("InsertMany", start, err)
+
+	return ids, err
+}
+
+func (db *DB) insertMany(collectionName string, documents []interface{}) ([]string, error) {
 	var ids []string
 
-	for _, document := range documents {
-		id, err := db.InsertOne(collectionName, document)
+	for start := 0; start < len(documents); start += insertManyBatchSize {
+		end := min(start+insertManyBatchSize, len(documents))
+
+		batchIds, err := db.insertBatch(collectionName, documents[start:end])
 		if err != nil {
-			return nil, err
+			return ids, err
 		}
-		ids = append(ids, id)
+
+		ids = append(ids, batchIds...)
 	}
 
 	return ids, nil
 }
 
-/****************
- * Find
-****************/
+// insertBatch inserts the documents with a single batch for each of the
+// store, the index and the full-text search index.
+func (db *DB) insertBatch(collectionName string, documents []interface{}) ([]string, error) {
+	storeBatch := db.store.NewIndexedBatch()
+	defer storeBatch.Close()
 
-func (db *DB) FindOneById(collectionName, id string) (Document, error) {
-	// Build the key
-	key := getDocumentKey(collectionName, id)
+	indexBatch := db.index.NewIndexedBatch()
+	defer indexBatch.Close()
 
-	// Get the document from the store
-	value, closer, err := db.store.Get(key)
-	if err != nil {
-		// If the document does not exist, return an error
-		if err == pebble.ErrNotFound {
-			return nil, ErrDocumentNotExists
+	ftsBatch := db.fts.NewBatch()
+	defer ftsBatch.Close()
+
+	ids := make([]string, 0, len(documents))
+	for _, document := range documents {
+		id, err := db.newId(indexBatch, collectionName)
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, err
+		key, bs, err := db.prepareInsert(storeBatch, indexBatch, ftsBatch, collectionName, id, document, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := storeBatch.Set(key, bs, nil); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
 	}
-	if value == nil {
-		return nil, nil
+
+	// Like InsertOne, commit the index changes before the documents
+	if err := db.commitIndexBatches(indexBatch, ftsBatch); err != nil {
+		return nil, err
 	}
-	defer closer.Close()
 
-	// Unmarshal the document
-	var document Document
-	if err := json.Unmarshal(value, &document); err != nil {
+	if err := storeBatch.Commit(db.writeOptions); err != nil {
 		return nil, err
 	}
 
-	return document, nil
+	return ids, nil
 }
 
-func (db *DB) FindOne(collectionName string, query Query) (Document, error) {
-	documents, err := db.FindMany(collectionName, query, Options{Limit: 1})
+// SetAutoIncrement sets whether the new documents of a collection get
+// increasing integer IDs instead of UUIDs. The IDs are zero-padded to 20
+// digits, e.g. "00000000000000000001", so that the order of the keys matches
+// the order of insertion. A document inserted under a numeric ID, e.g. by
+// Upsert or Import, raises the counter to its ID. The counter is kept when
+// disabling, so the IDs keep increasing if it is enabled again.
+func (db *DB) SetAutoIncrement(collectionName string, enabled bool) error {
+	collectionName = db.collection(collectionName)
 
-	if len(documents) == 0 {
-		return nil, ErrNoDocuments
+	if err := db.lock(); err != nil {
+		return err
 	}
+	defer db.mu.Unlock()
 
-	return documents[0], err
-}
-
-func (db *DB) FindMany(collectionName string, query Query, options Options) ([]Document, error) {
-	var documents []Document
+	key := getMetadataKey(collectionName, autoIncrementMetadata)
 
-	// For AND condition, if it contains at least one EQ condition, we can use the index
-	// to check. If it contains only non-EQ conditions, fallback to scanning the entire collection.
+	if !enabled {
+		return db.index.Delete(key, db.writeOptions)
+	}
 
-	// For OR condition, if it contains all EQ conditions, we can use the index to check.
-	// If it contains at least one non-EQ condition, fallback to scanning the entire collection.
+	return db.index.Set(key, nil, db.writeOptions)
+}
 
-	// Note that the query is not nested, and the top-level implicitly ANDs all the conditions.
+// newId returns the ID of a new document of a collection: the next value of
+// its counter if auto-increment is enabled, or a UUID otherwise. The counter
+// is read and updated through the batch, so that it is committed with the
+// index changes of the document.
+func (db *DB) newId(batch *pebble.Batch, collectionName string) (string, error) {
+	autoIncrement, err := hasMetadata(batch, collectionName, autoIncrementMetadata)
+	if err != nil {
+		return "", err
+	}
 
-	fallbackToFullScan := false
+	if !autoIncrement {
+		return uuid.New().String(), nil
+	}
 
-	// Check if query is not empty and not nil
-	// Empty or nil query means full scan
-	if len(query) > 0 && query != nil {
-		// Top-level implicitly ANDs all the conditions
-		for _, topOperand := range query {
-			// If the top-level condition is OR, fallback to full scan if it contains at least one non-EQ condition
-			if topOperand.Operator == "OR" {
-				for _, operand := range topOperand.Operands {
-					if operand.Operator != EQ {
-						fallbackToFullScan = true
-						break
-					}
-				}
-			}
+	counter, err := getIdCounter(batch, collectionName)
+	if err != nil {
+		return "", err
+	}
 
-			// If the top-level condition is AND, check if it contains only non-EQ conditions
-			foundEQ := false
-			for _, operand := range topOperand.Operands {
-				if operand.Operator == EQ {
-					foundEQ = true
-					break
-				}
-			}
+	counter++
 
-			if !foundEQ {
-				fallbackToFullScan = true
-				break
-			}
-		}
-	} else {
-		fallbackToFullScan = true
+	if err := setIdCounter(batch, collectionName, counter); err != nil {
+		return "", err
 	}
 
-	// (... AND ...) AND (... OR ...)
-	// Since top-level are ANDed, we can use the technique of counting how many
-	// conditions are EQ. For example, there are 3 AND conditions above.
-	// ((... OR ...) is one AND condition) and there are 2 out of 3 EQ conditions.
-	// If the id appears in the index for all 3 AND conditions, then it is a match.
+	return fmt.Sprintf("%020d", counter), nil
+}
 
-	if !fallbackToFullScan {
-		// Use the index to check
+// raiseIdCounter raises the counter of a collection with auto-increment to the
+// ID of a document inserted under an explicit ID, e.g. by Upsert or Import, if
+// the ID is a number, so that the IDs generated next don't collide with it.
+// The counter is read and updated through the batch, like in newId.
+func raiseIdCounter(batch *pebble.Batch, collectionName, id string) error {
+	autoIncrement, err := hasMetadata(batch, collectionName, autoIncrementMetadata)
+	if err != nil || !autoIncrement {
+		return err
+	}
 
-		allMatchedIdsFromIndex := []string{}
+	number, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil
+	}
 
-		idsConditionCount := map[string]int{}
-		nonRangeConditionCount := 0
+	counter, err := getIdCounter(batch, collectionName)
+	if err != nil || number <= counter {
+		return err
+	}
 
-		for _, topOperand := range query {
-			if topOperand.Operator == "OR" {
-				// Here, all the OR-ed conditions are EQ conditions, and because
-				// it is considered as "one of the AND conditions" in the top-level perspective,
-				// we add 1 to the nonRangeConditionCount regardless of the number of conditions in the OR.
+	return setIdCounter(batch, collectionName, number)
+}
 
-				nonRangeConditionCount++
+// getIdCounter returns the counter of the auto-increment IDs of a collection,
+// which is 0 if no ID was generated yet.
+func getIdCounter(batch *pebble.Batch, collectionName string) (uint64, error) {
+	value, closer, err := batch.Get(getMetadataKey(collectionName, idCounterMetadata))
+	if err == pebble.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
 
-				matchedIdsInOr := map[string]bool{}
+	counter := binary.BigEndian.Uint64(value)
+	if err := closer.Close(); err != nil {
+		return 0, err
+	}
 
-				for _, operand := range topOperand.Operands {
-					// Build the index key
-					indexKey := getIndexKey(collectionName, buildPathValue(operand.Path, fmt.Sprintf("%v", operand.Value)))
+	return counter, nil
+}
 
-					idsString, closer, err := db.index.Get([]byte(indexKey))
-					if err != nil && err != pebble.ErrNotFound {
-						return nil, err
-					}
+// setIdCounter sets the counter of the auto-increment IDs of a collection.
+func setIdCounter(batch *pebble.Batch, collectionName string, counter uint64) error {
+	return batch.Set(getMetadataKey(collectionName, idCounterMetadata), binary.BigEndian.AppendUint64(nil, counter), nil)
+}
 
-					if closer != nil {
-						defer closer.Close()
-					}
+// SetTimestamps sets whether the documents of a collection are stamped with
+// the time of their insertion in _createdAt, and of their last replacement in
+// _updatedAt, as RFC3339 UTC times. The timestamps are indexed like the other
+// fields, but not added to the full-text search index.
+func (db *DB) SetTimestamps(collectionName string, enabled bool) error {
+	collectionName = db.collection(collectionName)
 
-					ids := strings.Split(string(idsString), ",")
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
 
-					for _, id := range ids {
-						matchedIdsInOr[id] = true
-					}
-				}
+	key := getMetadataKey(collectionName, timestampsMetadata)
 
-				// Put the matched IDs in the OR condition into the idsConditionCount
-				for id := range matchedIdsInOr {
-					_, ok := idsConditionCount[id]
-					if !ok {
-						idsConditionCount[id] = 0
-					}
-					idsConditionCount[id]++
-				}
-			} else {
-				// Here, at least one of the ANDs is an EQ condition
-				for _, operand := range topOperand.Operands {
-					if operand.Operator == EQ {
-						nonRangeConditionCount++
+	if !enabled {
+		return db.index.Delete(key, db.writeOptions)
+	}
 
-						// Build the index key
-						indexKey := getIndexKey(collectionName, buildPathValue(operand.Path, fmt.Sprintf("%v", operand.Value)))
+	return db.index.Set(key, nil, db.writeOptions)
+}
 
-						idsString, closer, err := db.index.Get([]byte(indexKey))
+// stampDocument sets the timestamps of a document if they are enabled for its
+// collection. The old document is nil for an insertion, otherwise its
+// _createdAt is kept.
+func (db *DB) stampDocument(collectionName string, document, oldDocument Document) error {
+	timestamps, err := hasMetadata(db.index, collectionName, timestampsMetadata)
+	if err != nil || !timestamps {
+		return err
+	}
 
-						if err != nil && err != pebble.ErrNotFound {
-							return nil, err
-						}
+	now := time.Now().UTC().Format(time.RFC3339)
 
-						if closer != nil {
-							defer closer.Close()
-						}
+	if oldDocument == nil {
+		document["_createdAt"] = now
+		return nil
+	}
 
-						ids := strings.Split(string(idsString), ",")
+	if createdAt, ok := oldDocument["_createdAt"]; ok {
+		document["_createdAt"] = createdAt
+	}
+	document["_updatedAt"] = now
 
-						for _, id := range ids {
-							_, ok := idsConditionCount[id]
-							if !ok {
-								idsConditionCount[id] = 0
-							}
-							idsConditionCount[id]++
-						}
-					}
-				}
-			}
-		}
+	return nil
+}
+
+// toDocumentMap converts a document into a map through its JSON representation
+func toDocumentMap(document interface{}) (Document, error) {
+	documentMap := Document{}
+	b, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &documentMap); err != nil {
+		return nil, err
+	}
+
+	return documentMap, nil
+}
+
+/****************
+ * Find
+****************/
+
+// FindOneById returns the document stored under the given ID, or
+// ErrDocumentNotExists if there is none.
+func (db *DB) FindOneById(collectionName, id string) (Document, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	document, err := db.findOneById(collectionName, id)
+	if err != nil {
+		db.observeQuery("FindOneById", start, 0)
+		return nil, err
+	}
+	db.observeQuery("FindOneById", start, 1)
+
+	return document, nil
+}
+
+func (db *DB) findOneById(collectionName, id string) (Document, error) {
+	return getLiveDocument(db.store, collectionName, id)
+}
+
+// getLiveDocument is like getDocument, but returns ErrDocumentNotExists for a
+// soft-deleted document.
+func getLiveDocument(store pebble.Reader, collectionName, id string) (Document, error) {
+	document, err := getDocument(store, collectionName, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if isDeleted(document) {
+		return nil, ErrDocumentNotExists
+	}
+
+	return document, nil
+}
+
+// FindRawById returns the stored JSON of the document under the given ID,
+// without unmarshalling it into a Document, e.g. to write it straight to an
+// HTTP response. It returns ErrDocumentNotExists if there is none.
+func (db *DB) FindRawById(collectionName, id string) (json.RawMessage, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	raw, err := getRawDocument(db.store, collectionName, id)
+	if err != nil {
+		db.observeQuery("FindRawById", start, 0)
+		return nil, err
+	}
+	db.observeQuery("FindRawById", start, 1)
+
+	return raw, nil
+}
+
+// getRawDocument returns a copy of the stored JSON of a live document.
+func getRawDocument(store pebble.Reader, collectionName, id string) (json.RawMessage, error) {
+	value, closer, err := store.Get(getDocumentKey(collectionName, id))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, ErrDocumentNotExists
+		}
+
+		return nil, err
+	}
+
+	// The value is only valid until the closer is closed
+	raw := make(json.RawMessage, len(value))
+	copy(raw, value)
+	if err := closer.Close(); err != nil {
+		return nil, err
+	}
+
+	// Only the soft-delete flag is decoded, not the whole document
+	var flags struct {
+		Deleted bool `json:"_deleted"`
+	}
+	if err := json.Unmarshal(raw, &flags); err != nil {
+		return nil, err
+	}
+	if flags.Deleted {
+		return nil, ErrDocumentNotExists
+	}
+
+	return raw, nil
+}
+
+// FindManyByIds returns the documents stored under the given IDs, in the order
+// of the IDs. IDs without a document are skipped, and each document is
+// returned at most once, even if its ID is repeated.
+func (db *DB) FindManyByIds(collectionName string, ids []string) ([]Document, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	documents, err := db.findManyByIds(collectionName, ids)
+	db.observeQuery("FindManyByIds", start, len(documents))
+
+	return documents, err
+}
+
+func (db *DB) findManyByIds(collectionName string, ids []string) ([]Document, error) {
+	documents := make([]Document, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		document, err := db.findOneById(collectionName, id)
+		if err == ErrDocumentNotExists {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		documents = append(documents, document)
+	}
+
+	return documents, nil
+}
+
+// getDocument reads a document from the store through the given reader.
+func getDocument(store pebble.Reader, collectionName, id string) (Document, error) {
+	// Build the key
+	key := getDocumentKey(collectionName, id)
+
+	// Get the document from the store
+	value, closer, err := store.Get(key)
+	if err != nil {
+		// If the document does not exist, return an error
+		if err == pebble.ErrNotFound {
+			return nil, ErrDocumentNotExists
+		}
+
+		return nil, err
+	}
+	defer closer.Close()
+
+	// Unmarshal the document
+	var document Document
+	if err := json.Unmarshal(value, &document); err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+// documentExists checks if a document exists in the store without
+// unmarshalling it.
+func documentExists(store pebble.Reader, collectionName, id string) (bool, error) {
+	_, closer, err := store.Get(getDocumentKey(collectionName, id))
+	if err == pebble.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, closer.Close()
+}
+
+// liveDocumentExists is like documentExists, but reports false for a
+// soft-deleted document.
+func liveDocumentExists(store pebble.Reader, collectionName, id string) (bool, error) {
+	_, err := getRawDocument(store, collectionName, id)
+	if err == ErrDocumentNotExists {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// FindOne returns the first document matching the query, or ErrNoDocuments if
+// no document matches. Options can be passed optionally, e.g. to sort or
+// project the result; the limit is always 1.
+func (db *DB) FindOne(collectionName string, query Query, options ...Options) (Document, error) {
+	findOptions := Options{}
+	if len(options) > 0 {
+		findOptions = options[0]
+	}
+	findOptions.Limit = 1
+
+	documents, err := db.FindMany(collectionName, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(documents) == 0 {
+		return nil, ErrNoDocuments
+	}
+
+	return documents[0], nil
+}
+
+// FindMany returns the documents matching the query. If no document matches,
+// it returns an empty, non-nil slice rather than an error.
+func (db *DB) FindMany(collectionName string, query Query, options Options) ([]Document, error) {
+	return db.FindManyContext(context.Background(), collectionName, query, options)
+}
+
+// FindManyContext is like FindMany, but stops scanning and returns the error
+// of the context as soon as the context is cancelled or its deadline passes.
+func (db *DB) FindManyContext(ctx context.Context, collectionName string, query Query, options Options) ([]Document, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	documents, err := db.findMany(ctx, collectionName, query, options)
+	db.observeQuery("FindMany", start, len(documents))
+
+	return documents, err
+}
+
+// FindPage is like FindMany, but also reports whether more documents match
+// the query beyond the limit, e.g. to show a link to the next page. Without a
+// limit, all the matching documents are returned and there are no more.
+func (db *DB) FindPage(collectionName string, query Query, options Options) ([]Document, bool, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	documents, more, err := db.findPage(collectionName, query, options)
+	db.observeQuery("FindPage", start, len(documents))
+
+	return documents, more, err
+}
+
+// findPage returns a page of the documents matching the query, and whether
+// more documents match beyond it. The caller must hold the read lock.
+func (db *DB) findPage(collectionName string, query Query, options Options) ([]Document, bool, error) {
+	if options.Limit <= 0 {
+		documents, err := db.findMany(context.Background(), collectionName, query, options)
+		return documents, false, err
+	}
+
+	// Look for one more document than the limit
+	limit := options.Limit
+	options.Limit++
+
+	documents, err := db.findMany(context.Background(), collectionName, query, options)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(documents) > limit {
+		return documents[:limit], true, nil
+	}
+
+	return documents, false, nil
+}
+
+// FindAfter returns a page of the documents matching the query that come
+// after the position of the page token, and the token of the position of the
+// last document, to pass back to get the next page. The token is empty on the
+// last page, and an empty token starts from the first document. Unlike with an
+// offset, the documents of the previous pages don't have to be skipped, and
+// the pages don't shift when documents are inserted or deleted in between.
+//
+// The documents are sorted by the sort fields of the options, then by _id, so
+// that each document has a distinct position; the sort fields must be the same
+// for all the pages. Without sort fields, the documents are read in _id order
+// from the position of the token, and the reading stops at the end of the
+// page. With sort fields, all the matching documents are still read, but only
+// the first ones after the token, up to the limit, are kept and sorted. The
+// offset of the options is ignored.
+func (db *DB) FindAfter(collectionName string, query Query, options Options, pageToken string) ([]Document, string, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	documents, nextPageToken, err := db.findAfter(collectionName, query, options, pageToken)
+	db.observeQuery("FindAfter", start, len(documents))
+
+	return documents, nextPageToken, err
+}
+
+func (db *DB) findAfter(collectionName string, query Query, options Options, pageToken string) ([]Document, string, error) {
+	var position pagePosition
+	if pageToken != "" {
+		var err error
+		if position, err = decodePageToken(pageToken, len(options.Sort)); err != nil {
+			return nil, "", err
+		}
+	}
+
+	cursor, err := db.newCursor(context.Background(), collectionName, query, Options{IncludeDeleted: options.IncludeDeleted})
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close()
+
+	if pageToken != "" && len(options.Sort) == 0 {
+		cursor.seekAfter(position.Id)
+	}
+
+	// Every document has a distinct position with _id as the last sort field
+	sortFields := append(slices.Clip(options.Sort), SortField{Path: "_id"})
+
+	// With sort fields and a limit, only the first documents of the sort
+	// order are kept, up to the one after the limit
+	var page *pageHeap
+	if len(options.Sort) > 0 && options.Limit > 0 {
+		page = &pageHeap{sortFields: sortFields, size: options.Limit + 1}
+	}
+
+	documents := []Document{}
+	for cursor.Next() {
+		document := cursor.Document()
+		if pageToken != "" && compareSortValues(getSortValues(document, sortFields), position.values(), sortFields) <= 0 {
+			continue
+		}
+
+		if page != nil {
+			page.add(document)
+			continue
+		}
+
+		documents = append(documents, document)
+
+		// Without sort fields, the documents come in _id order, so the page
+		// ends with the document after the limit
+		if len(options.Sort) == 0 && options.Limit > 0 && len(documents) > options.Limit {
+			break
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if page != nil {
+		documents = page.documents()
+	}
+	if len(options.Sort) > 0 {
+		sortDocuments(documents, sortFields)
+	}
+
+	nextPageToken := ""
+	if options.Limit > 0 && len(documents) > options.Limit {
+		documents = documents[:options.Limit]
+
+		last := getSortValues(documents[len(documents)-1], sortFields)
+		if nextPageToken, err = encodePageToken(last); err != nil {
+			return nil, "", err
+		}
+	}
+
+	for i, document := range documents {
+		documents[i] = projectDocument(document, options.Project)
+	}
+
+	return documents, nextPageToken, nil
+}
+
+// pageHeap keeps the first documents of a sort order while scanning, so that
+// a page of FindAfter doesn't hold every matching document. It is a max-heap:
+// the last of the kept documents is at its root, and is replaced by a document
+// sorting before it once the heap is full.
+type pageHeap struct {
+	entries    []pageEntry
+	sortFields []SortField
+	size       int
+}
+
+type pageEntry struct {
+	document Document
+	values   []interface{}
+}
+
+func (h *pageHeap) Len() int { return len(h.entries) }
+func (h *pageHeap) Less(i, j int) bool {
+	return compareSortValues(h.entries[i].values, h.entries[j].values, h.sortFields) > 0
+}
+func (h *pageHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *pageHeap) Push(x interface{}) { h.entries = append(h.entries, x.(pageEntry)) }
+func (h *pageHeap) Pop() interface{} {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
+
+// add keeps the document if the heap isn't full or if it sorts before the
+// last of the kept documents.
+func (h *pageHeap) add(document Document) {
+	entry := pageEntry{document, getSortValues(document, h.sortFields)}
+	if len(h.entries) < h.size {
+		heap.Push(h, entry)
+		return
+	}
+
+	if compareSortValues(entry.values, h.entries[0].values, h.sortFields) < 0 {
+		h.entries[0] = entry
+		heap.Fix(h, 0)
+	}
+}
+
+// documents returns the kept documents, in no particular order.
+func (h *pageHeap) documents() []Document {
+	documents := make([]Document, len(h.entries))
+	for i, entry := range h.entries {
+		documents[i] = entry.document
+	}
+	return documents
+}
+
+// pagePosition is the position of a document in the pages of FindAfter: its
+// values at the sort paths, and its ID.
+type pagePosition struct {
+	Values []interface{} `json:"v,omitempty"`
+	Id     string        `json:"id"`
+}
+
+// values returns the values of the position at the sort paths, followed by
+// the ID.
+func (p pagePosition) values() []interface{} {
+	return append(slices.Clip(p.Values), p.Id)
+}
+
+// encodePageToken encodes the sort values of a document, ending with its ID,
+// into a page token.
+func encodePageToken(values []interface{}) (string, error) {
+	id, _ := values[len(values)-1].(string)
+
+	bs, err := json.Marshal(pagePosition{Values: values[:len(values)-1], Id: id})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+// decodePageToken decodes a page token into a position with the given number
+// of sort values.
+func decodePageToken(pageToken string, sortValues int) (pagePosition, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil {
+		return pagePosition{}, fmt.Errorf("%w: %v", ErrInvalidPageToken, err)
+	}
+
+	var position pagePosition
+	if err := json.Unmarshal(bs, &position); err != nil {
+		return pagePosition{}, fmt.Errorf("%w: %v", ErrInvalidPageToken, err)
+	}
+
+	if len(position.Values) != sortValues {
+		return pagePosition{}, fmt.Errorf("%w: %d sort values, expected %d", ErrInvalidPageToken, len(position.Values), sortValues)
+	}
+
+	return position, nil
+}
+
+// FindRange returns the documents whose IDs are in the range from startId,
+// inclusive, to endId, exclusive, in ID order. An empty startId or endId
+// leaves the range unbounded on that side. Only the keys of the range are
+// read, which is much cheaper than filtering a full scan when the IDs sort
+// meaningfully, e.g. auto-incremented IDs. Options apply like in FindMany.
+// A range whose endId doesn't sort after startId is empty.
+func (db *DB) FindRange(collectionName, startId, endId string, options Options) ([]Document, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	documents, err := db.findRange(collectionName, startId, endId, options)
+	db.observeQuery("FindRange", start, len(documents))
+
+	return documents, err
+}
+
+// findRange returns the documents whose IDs are in the range from startId to
+// endId. The caller must hold the read lock.
+func (db *DB) findRange(collectionName, startId, endId string, options Options) ([]Document, error) {
+	// Pebble requires the lower bound of an iterator to be below its upper bound
+	if endId != "" && endId <= startId {
+		return []Document{}, nil
+	}
+
+	prefix := getCollectionPrefix(collectionName)
+	iterOptions := &pebble.IterOptions{
+		LowerBound: getDocumentKey(collectionName, startId),
+		UpperBound: prefixUpperBound(prefix),
+	}
+	if endId != "" {
+		iterOptions.UpperBound = getDocumentKey(collectionName, endId)
+	}
+
+	iter := db.store.NewIter(iterOptions)
+	defer iter.Close()
+
+	// When sorting, all the documents of the range have to be collected before
+	// the offset and limit can be applied
+	sorted := len(options.Sort) > 0
+
+	documents := []Document{}
+	skipped := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if !sorted && options.Limit > 0 && len(documents) == options.Limit {
+			break
+		}
+
+		var document Document
+		if err := json.Unmarshal(iter.Value(), &document); err != nil {
+			return nil, err
+		}
+
+		if isDeleted(document) && !options.IncludeDeleted {
+			continue
+		}
+
+		if !sorted && skipped < options.Offset {
+			skipped++
+			continue
+		}
+
+		documents = append(documents, document)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	if sorted {
+		return applyOptions(documents, options), nil
+	}
+
+	for i, document := range documents {
+		documents[i] = projectDocument(document, options.Project)
+	}
+
+	return documents, nil
+}
+
+func (db *DB) findMany(ctx context.Context, collectionName string, query Query, options Options) ([]Document, error) {
+	documents := []Document{}
+
+	// When sorting, all the matching documents have to be collected before
+	// the offset, limit and projection can be applied.
+	cursorOptions := options
+	if len(options.Sort) > 0 {
+		cursorOptions = Options{IncludeDeleted: options.IncludeDeleted}
+	}
+
+	cursor, err := db.newCursor(ctx, collectionName, query, cursorOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	for cursor.Next() {
+		documents = append(documents, cursor.Document())
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(options.Sort) > 0 {
+		documents = applyOptions(documents, options)
+	}
+
+	return documents, nil
+}
+
+// applyOptions sorts the matching documents, applies the offset and the limit,
+// and projects the remaining documents. Without sort fields, the documents
+// keep their order.
+func applyOptions(documents []Document, options Options) []Document {
+	if len(options.Sort) > 0 {
+		sortDocuments(documents, options.Sort)
+	}
+
+	if options.Offset > 0 {
+		if options.Offset >= len(documents) {
+			documents = []Document{}
+		} else {
+			documents = documents[options.Offset:]
+		}
+	}
+
+	if options.Limit > 0 && len(documents) > options.Limit {
+		documents = documents[:options.Limit]
+	}
+
+	for i, document := range documents {
+		documents[i] = projectDocument(document, options.Project)
+	}
+
+	return documents
+}
+
+// Cursor iterates over the documents matching a query one at a time, so that
+// large result sets don't have to be held in memory. It reads from a snapshot
+// of the store taken when it is created, so it doesn't see later writes.
+// A Cursor must be closed after use.
+//
+//	cursor, err := db.FindIter("restaurants", query, objectdb.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	defer cursor.Close()
+//
+//	for cursor.Next() {
+//		document := cursor.Document()
+//		...
+//	}
+//	if err := cursor.Err(); err != nil {
+//		return err
+//	}
+type Cursor struct {
+	ctx            context.Context
+	collectionName string
+	query          Query
+	options        Options
+	delimiters     map[string]string // Delimiters of the paths whose strings are matched part by part
+	logger         Logger            // Receives the debug logs, if not nil
+
+	snapshot *pebble.Snapshot
+	iter     *pebble.Iterator // Iterator of a full collection scan
+	ids      []string         // Remaining IDs found in the index
+	useIndex bool
+	started  bool
+	startKey []byte // Key to start the full scan at, instead of the first key
+
+	// Documents collected beforehand, e.g. to sort them
+	documents []Document
+	buffered  bool
+
+	skip     int // Matching documents left to skip for the offset
+	count    int // Documents returned so far
+	document Document
+	err      error
+	closed   bool
+
+	onClose func(returned int) // Called once the cursor is closed, if not nil
+}
+
+// FindIter is like FindMany, but returns a Cursor that reads the matching
+// documents lazily. Sorting requires all the matching documents, so with
+// Sort options the documents are collected and sorted before the Cursor is
+// returned.
+func (db *DB) FindIter(collectionName string, query Query, options Options) (*Cursor, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var cursor *Cursor
+	if len(options.Sort) > 0 {
+		documents, err := db.findMany(context.Background(), collectionName, query, options)
+		if err != nil {
+			db.observeQuery("FindIter", start, 0)
+			return nil, err
+		}
+
+		cursor = &Cursor{documents: documents, buffered: true}
+	} else {
+		var err error
+		cursor, err = db.newCursor(context.Background(), collectionName, query, options)
+		if err != nil {
+			db.observeQuery("FindIter", start, 0)
+			return nil, err
+		}
+	}
+
+	// The documents are read lazily, so the query is observed once the cursor
+	// is closed, with the documents returned until then
+	cursor.onClose = func(returned int) {
+		db.observeQuery("FindIter", start, returned)
+	}
+
+	return cursor, nil
+}
+
+// newCursor returns a Cursor over the documents matching the query, applying
+// the offset, limit and projection but not the sorting of the options. The
+// caller must hold the read lock. The cursor stops with the error of the
+// context once the context is done.
+func (db *DB) newCursor(ctx context.Context, collectionName string, query Query, options Options) (*Cursor, error) {
+	if err := ValidateQuery(query); err != nil {
+		return nil, err
+	}
+	query = compilePatterns(query)
+
+	partialIndexes, err := getPartialIndexes(db.index, collectionName)
+	if err != nil {
+		return nil, err
+	}
+	query = hidePartialConditions(query, partialIndexes)
+
+	numericPaths, err := db.getNumericIndexPaths(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	delimiters, err := getDelimiters(db.index, collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	indexed, err := isIndexed(db.index, collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := &Cursor{
+		ctx:            ctx,
+		collectionName: collectionName,
+		query:          query,
+		options:        options,
+		delimiters:     delimiters,
+		logger:         db.logger,
+		skip:           options.Offset,
+		snapshot:       db.store.NewSnapshot(),
+	}
+
+	// The soft-deleted documents are not in the index
+	if indexed && !options.IncludeDeleted && canUseIndex(query, numericPaths) {
+		// Use the index to check
+		cursor.ids, err = db.findIdsFromIndex(collectionName, query, numericPaths)
+		if err != nil {
+			cursor.Close()
+			return nil, err
+		}
+		cursor.useIndex = true
+
+		if db.logger != nil {
+			db.logger.Debug("query uses the index", logAttrs(collectionName, "candidates", len(cursor.ids))...)
+		}
+	} else {
+		// Fallback to scanning the entire collection, bounded to its keys
+		prefix := getCollectionPrefix(collectionName)
+		cursor.iter = cursor.snapshot.NewIter(&pebble.IterOptions{
+			LowerBound: prefix,
+			UpperBound: prefixUpperBound(prefix),
+		})
+
+		if db.logger != nil {
+			db.logger.Debug("query falls back to a full scan", logAttrs(collectionName, "reason", fullScanReason(query, options, indexed, numericPaths))...)
+		}
+	}
+
+	return cursor, nil
+}
+
+// Next advances the cursor to the next matching document, which is then
+// available through Document. It returns false when there are no more
+// documents or an error occurred.
+func (c *Cursor) Next() bool {
+	c.document = nil
+
+	if c.closed || c.err != nil {
+		return false
+	}
+
+	if c.buffered {
+		if len(c.documents) == 0 {
+			return false
+		}
+
+		c.document, c.documents = c.documents[0], c.documents[1:]
+		c.count++
+		return true
+	}
+
+	// Limit = 0 means no limit
+	if c.options.Limit > 0 && c.count >= c.options.Limit {
+		return false
+	}
+
+	for {
+		// Stop a long scan once the context is done
+		if err := c.ctx.Err(); err != nil {
+			c.err = err
+			return false
+		}
+
+		document, ok, err := c.nextCandidate()
+		if err != nil {
+			c.err = err
+			return false
+		}
+		if !ok {
+			return false
+		}
+
+		if !c.options.IncludeDeleted && isDeleted(document) {
+			continue
+		}
+
+		// The IDs found in the index match the indexed conditions only, so the
+		// document is checked against the other conditions as well.
+		if !matchQuery(document, c.query, c.delimiters) {
+			continue
+		}
+
+		// Skip the first matching documents up to the offset
+		if c.skip > 0 {
+			c.skip--
+			continue
+		}
+
+		c.document = projectDocument(document, c.options.Project)
+		c.count++
+
+		return true
+	}
+}
+
+// nextCandidate returns the next document that may match the query, either
+// from the IDs found in the index or from the collection scan.
+func (c *Cursor) nextCandidate() (Document, bool, error) {
+	if c.useIndex {
+		for len(c.ids) > 0 {
+			id := c.ids[0]
+			c.ids = c.ids[1:]
+
+			value, closer, err := c.snapshot.Get(getDocumentKey(c.collectionName, id))
+			if err == pebble.ErrNotFound {
+				// The index refers to a document that no longer exists
+				if c.logger != nil {
+					c.logger.Warn("index refers to a missing document", logAttrs(c.collectionName, "id", id)...)
+				}
+				continue
+			}
+			if err != nil {
+				return nil, false, err
+			}
+
+			var document Document
+			err = json.Unmarshal(value, &document)
+			closer.Close()
+			if err != nil {
+				return nil, false, err
+			}
+
+			return document, true, nil
+		}
+
+		return nil, false, nil
+	}
+
+	for c.advance() {
+		var document Document
+		if err := json.Unmarshal(c.iter.Value(), &document); err != nil {
+			return nil, false, err
+		}
+
+		return document, true, nil
+	}
+
+	return nil, false, c.iter.Error()
+}
+
+// advance moves the iterator of the collection scan to the next key.
+func (c *Cursor) advance() bool {
+	if !c.started {
+		c.started = true
+		if c.startKey != nil {
+			return c.iter.SeekGE(c.startKey)
+		}
+		return c.iter.First()
+	}
+
+	return c.iter.Next()
+}
+
+// seekAfter moves the cursor past the documents whose IDs sort before or at
+// the ID, without reading them, e.g. to resume after the last document of a
+// page. It must be called before the first call to Next.
+func (c *Cursor) seekAfter(id string) {
+	if c.useIndex {
+		// The IDs found in the index are sorted
+		i, found := slices.BinarySearch(c.ids, id)
+		if found {
+			i++
+		}
+		c.ids = c.ids[i:]
+		return
+	}
+
+	// The key of the ID followed by a zero byte is the first key after it
+	c.startKey = append(getDocumentKey(c.collectionName, id), 0)
+}
+
+// Document returns the current document of the cursor.
+func (c *Cursor) Document() Document {
+	return c.document
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close releases the resources of the cursor.
+func (c *Cursor) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.document = nil
+	c.documents = nil
+
+	if c.onClose != nil {
+		c.onClose(c.count)
+	}
+
+	var err error
+	if c.iter != nil {
+		err = c.iter.Close()
+	}
+	if c.snapshot != nil {
+		if closeErr := c.snapshot.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// projectDocument returns a document containing only the given paths and the
+// _id. Nested paths are rebuilt as nested maps, and paths crossing an array of
+// objects are projected in each object. Paths missing from the document are
+// left out. The document is returned as is if there are no paths.
+func projectDocument(document Document, paths []string) Document {
+	if len(paths) == 0 || document == nil {
+		return document
+	}
+
+	projected := Document{}
+	if id, ok := document["_id"]; ok {
+		projected["_id"] = id
+	}
+
+	for _, path := range paths {
+		projectPath(projected, document, strings.Split(path, "."))
+	}
+
+	return projected
+}
+
+// projectPath copies the value at the path of the source into the target,
+// merging with the paths projected before. It reports whether the path was
+// found.
+func projectPath(target, source map[string]interface{}, parts []string) bool {
+	value, ok := source[parts[0]]
+	if !ok {
+		return false
+	}
+
+	if len(parts) == 1 {
+		target[parts[0]] = value
+		return true
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		next, ok := target[parts[0]].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+		}
+
+		if !projectPath(next, v, parts[1:]) {
+			return false
+		}
+
+		target[parts[0]] = next
+		return true
+	case []interface{}:
+		// Project the rest of the path in each object of the array
+		var objects []map[string]interface{}
+		for _, element := range v {
+			if object, isMap := element.(map[string]interface{}); isMap {
+				objects = append(objects, object)
+			}
+		}
+
+		elements, ok := target[parts[0]].([]interface{})
+		if !ok || len(elements) != len(objects) {
+			elements = make([]interface{}, len(objects))
+		}
+
+		found := false
+		for i, object := range objects {
+			next, ok := elements[i].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+			}
+
+			if projectPath(next, object, parts[1:]) {
+				found = true
+			}
+			elements[i] = next
+		}
+
+		if !found {
+			return false
+		}
+
+		target[parts[0]] = elements
+		return true
+	}
+
+	return false
+}
+
+// Count returns the number of documents matching the query without
+// collecting them. A nil or empty query counts all documents in the collection.
+func (db *DB) Count(collectionName string, query Query) (int, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	count, err := db.count(collectionName, query)
+	db.observeQuery("Count", start, count)
+
+	return count, err
+}
+
+func (db *DB) count(collectionName string, query Query) (int, error) {
+	count := 0
+
+	if err := ValidateQuery(query); err != nil {
+		return 0, err
+	}
+	query = compilePatterns(query)
+
+	partialIndexes, err := getPartialIndexes(db.index, collectionName)
+	if err != nil {
+		return 0, err
+	}
+	query = hidePartialConditions(query, partialIndexes)
+
+	numericPaths, err := db.getNumericIndexPaths(collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	delimiters, err := getDelimiters(db.index, collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	indexed, err := isIndexed(db.index, collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	if indexed && canUseIndex(query, numericPaths) {
+		ids, err := db.findIdsFromIndex(collectionName, query, numericPaths)
+		if err != nil {
+			return 0, err
+		}
+
+		if db.logger != nil {
+			db.logger.Debug("query uses the index", logAttrs(collectionName, "candidates", len(ids))...)
+		}
+
+		// The IDs from the index are exact matches when there are only EQ
+		// conditions, as long as their documents still exist
+		if hasOnlyEQConditions(query) {
+			for _, id := range ids {
+				exists, err := documentExists(db.store, collectionName, id)
+				if err != nil {
+					return 0, err
+				}
+
+				if exists {
+					count++
+				}
+			}
+
+			return count, nil
+		}
+
+		for _, id := range ids {
+			document, err := db.findOneById(collectionName, id)
+			if err == ErrDocumentNotExists {
+				// The index refers to a document that no longer exists
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+
+			if matchQuery(document, query, delimiters) {
+				count++
+			}
+		}
+
+		return count, nil
+	}
+
+	if db.logger != nil {
+		db.logger.Debug("query falls back to a full scan", logAttrs(collectionName, "reason", fullScanReason(query, Options{}, indexed, numericPaths))...)
+	}
+
+	// Fallback to scanning the entire collection, bounded to its keys
+	prefix := getCollectionPrefix(collectionName)
+	iter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		// Every document matches an empty query, unless it is soft-deleted,
+		// which only the documents with a _deleted key can be. Soft-deleted
+		// documents are left out even after soft delete is disabled.
+		if len(query) == 0 && !bytes.Contains(iter.Value(), deletedKey) {
+			count++
+			continue
+		}
+
+		var document Document
+		if err := json.Unmarshal(iter.Value(), &document); err != nil {
+			return 0, err
+		}
+
+		if !isDeleted(document) && matchQuery(document, query, delimiters) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// ValidateQuery checks that every group of a query is combined with AND or OR,
+// and that every condition has a path, a known operator and a value of the
+// type its operator expects, e.g. a list for IN, a valid regular expression
+// for MATCH or a number or time for the range operators. It returns an
+// ErrInvalidQuery error describing the first invalid group or condition. The
+// queries are validated before they are run, so calling it is only needed to
+// check a query ahead of time.
+func ValidateQuery(query Query) error {
+	for _, topOperand := range query {
+		if topOperand.Operator != AND && topOperand.Operator != OR {
+			return fmt.Errorf("%w: unknown group operator %q, expected AND or OR", ErrInvalidQuery, topOperand.Operator)
+		}
+
+		if err := validateOperands(topOperand.Operands); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateOperands(operands []Condition) error {
+	for _, operand := range operands {
+		if isGroupCondition(operand) {
+			if err := validateOperands(operand.Operands); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if operand.Path == "" {
+			return fmt.Errorf("%w: condition with operator %q has an empty path", ErrInvalidQuery, operand.Operator)
+		}
+
+		switch operand.Operator {
+		case EQ, NE, STARTS, ENDS, CONTAINS:
+		case GT, GTE, LT, LTE:
+			if !isComparable(operand.Value) {
+				return fmt.Errorf("%w: value of %s %s %v is not a number or a time", ErrInvalidQuery, operand.Path, operand.Operator, operand.Value)
+			}
+		case IN:
+			if _, ok := operand.Value.([]interface{}); !ok {
+				return fmt.Errorf("%w: value of %s in %v is not a list", ErrInvalidQuery, operand.Path, operand.Value)
+			}
+		case BETWEEN:
+			bounds, ok := operand.Value.([]interface{})
+			if !ok || len(bounds) != 2 {
+				return fmt.Errorf("%w: bounds of %s are not a list of two values: %v", ErrInvalidQuery, operand.Path, operand.Value)
+			}
+			if !isComparable(bounds[0]) || !isComparable(bounds[1]) {
+				return fmt.Errorf("%w: bounds of %s are not numbers or times: %v", ErrInvalidQuery, operand.Path, operand.Value)
+			}
+		case EXISTS:
+			if _, ok := operand.Value.(bool); !ok {
+				return fmt.Errorf("%w: value of %s exists %v is not a bool", ErrInvalidQuery, operand.Path, operand.Value)
+			}
+		case MATCH:
+			pattern, ok := operand.Value.(string)
+			if !ok {
+				return fmt.Errorf("%w: regular expression for %s is not a string: %v", ErrInvalidQuery, operand.Path, operand.Value)
+			}
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("%w: invalid regular expression for %s: %v", ErrInvalidQuery, operand.Path, err)
+			}
+		default:
+			return fmt.Errorf("%w: unknown operator %q for %s", ErrInvalidQuery, operand.Operator, operand.Path)
+		}
+	}
+
+	return nil
+}
+
+// compilePatterns returns a copy of a valid query with the regular
+// expressions of its MATCH conditions compiled, so that each is compiled once
+// per query rather than for every document it is matched against.
+func compilePatterns(query Query) Query {
+	compiled := make(Query, len(query))
+	for i, topOperand := range query {
+		compiled[i].Operator = topOperand.Operator
+		compiled[i].Operands = compileOperands(topOperand.Operands)
+	}
+
+	return compiled
+}
+
+func compileOperands(operands []Condition) []Condition {
+	compiled := make([]Condition, len(operands))
+	for i, operand := range operands {
+		if isGroupCondition(operand) {
+			operand.Operands = compileOperands(operand.Operands)
+		} else if pattern, ok := operand.Value.(string); ok && operand.Operator == MATCH {
+			operand.pattern, _ = regexp.Compile(pattern)
+		}
+
+		compiled[i] = operand
+	}
+
+	return compiled
+}
+
+// isComparable checks if a value can be compared by a range operator, i.e. it
+// is a number, a numeric string or a time.
+func isComparable(value interface{}) bool {
+	if _, ok := toTime(value); ok {
+		return true
+	}
+
+	_, ok := toNumber(value)
+	return ok
+}
+
+// canUseIndex checks if the query can be served by the index.
+//
+// A condition can be looked up in the index if it is an EQ or IN condition,
+// or a range condition on a path with a numeric index, and it is not negated,
+// its path has no array position and its value is not an object. Nested groups
+// of conditions are never looked up; they are only checked against the
+// documents found for the other conditions.
+//
+// The top-level groups are ANDed, and the index is used only if each of them
+// can narrow down the candidates: an AND group needs at least one condition
+// that can be looked up, and an OR group needs all of its conditions to be
+// looked up, as each of them may match on its own. Otherwise, e.g. for a
+// single negated condition or an OR group with a nested group, the query falls
+// back to scanning the entire collection.
+func canUseIndex(query Query, numericPaths map[string]bool) bool {
+	// Empty or nil query means full scan
+	if len(query) == 0 {
+		return false
+	}
+
+	// Top-level implicitly ANDs all the conditions
+	for _, topOperand := range query {
+		// An OR group falls back to full scan if any of its conditions can't
+		// be looked up
+		if topOperand.Operator == OR {
+			for _, operand := range topOperand.Operands {
+				if !isIndexableCondition(operand, numericPaths) {
+					return false
+				}
+			}
+		}
+
+		// Any group falls back to full scan if none of its conditions can be
+		// looked up
+		foundIndexable := false
+		for _, operand := range topOperand.Operands {
+			if isIndexableCondition(operand, numericPaths) {
+				foundIndexable = true
+				break
+			}
+		}
+
+		if !foundIndexable {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fullScanReason returns why a query falls back to a full collection scan,
+// for the debug logs.
+func fullScanReason(query Query, options Options, indexed bool, numericPaths map[string]bool) string {
+	if len(query) == 0 {
+		return "no conditions"
+	} else if !indexed {
+		return "indexing is disabled"
+	} else if options.IncludeDeleted {
+		return "soft-deleted documents are included"
+	} else if !canUseIndex(query, numericPaths) {
+		return "no condition can be looked up in the index"
+	}
+
+	return ""
+}
+
+// hasOnlyEQConditions checks if every condition in the query is an EQ or IN
+// condition looked up in the index.
+func hasOnlyEQConditions(query Query) bool {
+	for _, topOperand := range query {
+		for _, operand := range topOperand.Operands {
+			if !isIndexableOperator(operand.Operator) || operand.Negate || hasPosition(operand.Path) || hasObjectValue(operand) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// findIdsFromIndex returns the sorted IDs of the documents matching the EQ and IN
+// conditions of the query, as looked up in the index. The documents still have
+// to be checked against the other conditions.
+//
+// (... AND ...) AND (... OR ...)
+// Since top-level are ANDed, we can use the technique of counting how many
+// conditions are EQ. For example, there are 3 AND conditions above.
+// ((... OR ...) is one AND condition) and there are 2 out of 3 EQ conditions.
+// If the id appears in the index for all 3 AND conditions, then it is a match.
+//
+// Each ID is returned once, even if it is in several branches of an OR or
+// repeated in a corrupted posting list, as the IDs are collected in sets.
+//
+// Only the conditions looked up in the index are counted, each at most once
+// per ID. Other conditions in an AND group (e.g. NE, or a range without a
+// numeric index) are left to the check of the documents against the query.
+func (db *DB) findIdsFromIndex(collectionName string, query Query, numericPaths map[string]bool) ([]string, error) {
+	allMatchedIdsFromIndex := []string{}
+
+	idsConditionCount := map[string]int{}
+	indexedConditionCount := 0
+
+	// EQ conditions covering the paths of a compound index are looked up
+	// together in the compound index, and count as a single condition.
+	compoundIndexes, err := db.getCompoundIndexes(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	compoundPaths, compoundConditions := findCompoundIndex(query, compoundIndexes)
+	if compoundPaths != nil {
+		conditions := make([]Condition, len(compoundPaths))
+		for position := range compoundConditions {
+			operand := query[position[0]].Operands[position[1]]
+			conditions[slices.Index(compoundPaths, operand.Path)] = operand
+		}
+
+		ids, err := db.getIdsFromCompoundIndex(collectionName, conditions)
+		if err != nil {
+			return nil, err
+		}
+
+		indexedConditionCount++
+		for id := range ids {
+			idsConditionCount[id]++
+		}
+	}
+
+	for i, topOperand := range query {
+		if topOperand.Operator == OR {
+			// Here, all the OR-ed conditions are looked up in the index, and because
+			// it is considered as "one of the AND conditions" in the top-level perspective,
+			// we add 1 to the indexedConditionCount regardless of the number of conditions in the OR.
+
+			indexedConditionCount++
+
+			matchedIdsInOr := map[string]bool{}
+
+			for _, operand := range topOperand.Operands {
+				ids, err := db.getIdsFromIndex(collectionName, operand)
+				if err != nil {
+					return nil, err
+				}
+
+				for id := range ids {
+					matchedIdsInOr[id] = true
+				}
+			}
+
+			// Put the matched IDs in the OR condition into the idsConditionCount
+			for id := range matchedIdsInOr {
+				idsConditionCount[id]++
+			}
+		} else {
+			// Here, at least one of the ANDs is looked up in the index. The
+			// others are not counted, as the index can't tell if they match.
+			for j, operand := range topOperand.Operands {
+				if compoundConditions[[2]int{i, j}] {
+					continue
+				}
+
+				if isIndexableCondition(operand, numericPaths) {
+					indexedConditionCount++
+
+					ids, err := db.getIdsFromIndex(collectionName, operand)
+					if err != nil {
+						return nil, err
+					}
+
+					for id := range ids {
+						idsConditionCount[id]++
+					}
+				}
+			}
+		}
+	}
+
+	for id, count := range idsConditionCount {
+		// An empty ID comes from an index key that does not exist
+		if id == "" {
+			continue
+		}
+
+		if count == indexedConditionCount {
+			allMatchedIdsFromIndex = append(allMatchedIdsFromIndex, id)
+		}
+	}
+
+	// Return the IDs in key order, the same order as the full scan, so that
+	// paginating with offset and limit is consistent between the two paths.
+	sort.Strings(allMatchedIdsFromIndex)
+
+	return allMatchedIdsFromIndex, nil
+}
+
+// getIdsFromIndex returns the IDs of the documents matching an EQ or IN
+// condition, as looked up in the index. For IN, the IDs of each candidate
+// value are unioned. Range conditions are looked up in the numeric index.
+func (db *DB) getIdsFromIndex(collectionName string, condition Condition) (map[string]bool, error) {
+	if isRangeOperator(condition.Operator) {
+		return db.getIdsFromNumericIndex(collectionName, condition)
+	}
+
+	values := []interface{}{condition.Value}
+	if condition.Operator == IN {
+		values, _ = condition.Value.([]interface{})
+	}
+
+	matchedIds := map[string]bool{}
+
+	for _, value := range values {
+		pathValues := []string{buildPathValue(condition.Path, value)}
+
+		// Strings that are lowercase are indexed as is, the others are also
+		// indexed in lowercase under a folded key
+		if s, ok := value.(string); ok && condition.CaseInsensitive {
+			lower := strings.ToLower(s)
+			pathValues = []string{buildPathValue(condition.Path, lower), buildFoldedPathValue(condition.Path, lower)}
+		}
+
+		for _, pathValue := range pathValues {
+			ids, err := getIndexedIds(db.index, collectionName, pathValue)
+			if err != nil {
+				return nil, err
+			}
+
+			if db.logger != nil {
+				db.logger.Debug("index probe", logAttrs(collectionName, "key", pathValue, "ids", len(ids))...)
+			}
+
+			for _, id := range ids {
+				matchedIds[id] = true
+			}
+		}
+	}
+
+	return matchedIds, nil
+}
+
+// isGroupCondition checks if a condition is a nested group of conditions.
+func isGroupCondition(condition Condition) bool {
+	return condition.Operator == AND || condition.Operator == OR
+}
+
+// isIndexableOperator checks if a condition with the operator can be looked up in the index.
+func isIndexableOperator(operator string) bool {
+	return operator == EQ || operator == IN
+}
+
+// isIndexableCondition checks if a condition can be looked up in the index,
+// either as an EQ or IN condition, or as a range condition on a path with a
+// numeric index. Negated conditions match the documents missing from the
+// index lookup, so they are checked against the documents instead, and so are
+// the EQ and IN conditions on a path with a position, e.g. "items.0.price",
+// and those with an object value, as objects are not indexed as a whole.
+func isIndexableCondition(condition Condition, numericPaths map[string]bool) bool {
+	if condition.Negate {
+		return false
+	}
+
+	if isIndexableOperator(condition.Operator) {
+		return !hasPosition(condition.Path) && !hasObjectValue(condition)
+	}
+
+	if isRangeOperator(condition.Operator) && numericPaths[condition.Path] {
+		_, _, err := getNumericBounds(condition)
+		return err == nil
+	}
+
+	return false
+}
+
+// getNumericBounds returns the inclusive bounds of a range condition as
+// numbers. An unbounded side is infinite.
+func getNumericBounds(condition Condition) (float64, float64, error) {
+	if condition.Operator == BETWEEN {
+		bounds, ok := condition.Value.([]interface{})
+		if !ok || len(bounds) != 2 {
+			return 0, 0, fmt.Errorf("invalid bounds for %s: %v is not a list of two values", condition.Path, condition.Value)
+		}
+
+		low, err := strconv.ParseFloat(fmt.Sprintf("%v", bounds[0]), 64)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		high, err := strconv.ParseFloat(fmt.Sprintf("%v", bounds[1]), 64)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		return low, high, nil
+	}
+
+	number, err := strconv.ParseFloat(fmt.Sprintf("%v", condition.Value), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch condition.Operator {
+	case GT, GTE:
+		return number, math.Inf(1), nil
+	default:
+		return math.Inf(-1), number, nil
+	}
+}
+
+func isRangeOperator(operator string) bool {
+	return operator == GT || operator == GTE || operator == LT || operator == LTE || operator == BETWEEN
+}
+
+// sortDocuments sorts the documents by the sort fields. Documents missing a
+// sort path are always placed last.
+func sortDocuments(documents []Document, sortFields []SortField) {
+	// The sort values of each document are looked up once
+	type sortedDocument struct {
+		document Document
+		values   []interface{}
+	}
+
+	sorted := make([]sortedDocument, len(documents))
+	for i, document := range documents {
+		sorted[i] = sortedDocument{document, getSortValues(document, sortFields)}
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return compareSortValues(sorted[i].values, sorted[j].values, sortFields) < 0
+	})
+
+	for i := range sorted {
+		documents[i] = sorted[i].document
+	}
+}
+
+// getSortValues returns the values of a document at the sort paths, with nil
+// for a missing path.
+func getSortValues(document Document, sortFields []SortField) []interface{} {
+	values := make([]interface{}, len(sortFields))
+	for i, sortField := range sortFields {
+		values[i], _ = getValueFromPath(document, sortField.Path)
+	}
+
+	return values
+}
+
+// compareSortValues compares the sort values of two documents, returning -1
+// if the first document sorts before the second one, +1 if after, and 0 if
+// they are tied. A missing or null value sorts last, whatever the direction.
+func compareSortValues(a, b []interface{}, sortFields []SortField) int {
+	for i, sortField := range sortFields {
+		aOk, bOk := a[i] != nil, b[i] != nil
+		if !aOk || !bOk {
+			if aOk != bOk {
+				if aOk {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+
+		c := compareValues(a[i], b[i])
+		if c == 0 {
+			continue
+		}
+
+		if sortField.Descending {
+			return -c
+		}
+		return c
+	}
+
+	return 0
+}
+
+// compareValues compares two values, numerically if both are numbers and
+// lexically otherwise. Numbers are ordered before non-numbers.
+func compareValues(a, b interface{}) int {
+	aNum, aIsNum := toFloat64(a)
+	bNum, bIsNum := toFloat64(b)
+
+	switch {
+	case aIsNum && bIsNum:
+		if aNum < bNum {
+			return -1
+		} else if aNum > bNum {
+			return 1
+		}
+		return 0
+	case aIsNum:
+		return -1
+	case bIsNum:
+		return 1
+	}
+
+	return strings.Compare(stringValue(a), stringValue(b))
+}
+
+// Keys are made of the collection name and the document ID (or the path-value
+// pair for the index), joined by a colon. Backslashes and colons in the
+// collection name are escaped with a backslash, so the first unescaped colon
+// always ends the collection name, and the key prefix of a collection never
+// matches keys of another collection.
+
+const keySeparator = ':'
+
+var collectionNameEscaper = strings.NewReplacer(`\`, `\\`, ":", `\:`)
+
+func getDocumentKey(collectionName, id string) []byte {
+	return append(getCollectionPrefix(collectionName), id...)
+}
+
+// Index keys are made of the collection prefix, a 0x03 byte, the length of
+// the path-value pair as a uvarint, the path-value pair and the document ID,
+// with an empty value. Each document has its own key under the prefix of the
+// pair, so that indexing a document doesn't rewrite the IDs of the other
+// documents with the same value, and the IDs of a value are found by
+// iterating over the prefix. The length keeps the IDs apart from the pairs.
+//
+// The version of the layout of the index is stored under a backslash followed
+// by "version", which never clashes with the keys of a collection, a
+// namespace or the metadata. Indexes written by earlier versions are upgraded
+// when the DB is opened:
+//
+//	1: a key per path-value pair, holding the comma-separated list of its IDs
+//	2: a key per document for each path-value pair
+//	3: a key per document for each token of the full-text search index
+//	4: the tokens of the full-text search index folded of their accents
+
+const indexVersion = 4
+
+var indexVersionKey = []byte(`\version`)
+
+func getIndexPrefix(collectionName, pathValue string) []byte {
+	prefix := append(getCollectionPrefix(collectionName), 3)
+	prefix = binary.AppendUvarint(prefix, uint64(len(pathValue)))
+	return append(prefix, pathValue...)
+}
+
+func getIndexKey(collectionName, pathValue, id string) []byte {
+	return append(getIndexPrefix(collectionName, pathValue), id...)
+}
+
+// parseIndexKey splits the rest of an index key after the collection prefix
+// into the path-value pair and the document ID.
+func parseIndexKey(rest []byte) (pathValue, id string, ok bool) {
+	if len(rest) == 0 || rest[0] != 3 {
+		return "", "", false
+	}
+
+	length, n := binary.Uvarint(rest[1:])
+	if n <= 0 || length > uint64(len(rest)-1-n) {
+		return "", "", false
+	}
+
+	start := 1 + n
+	end := start + int(length)
+
+	return string(rest[start:end]), string(rest[end:]), true
+}
+
+// getIndexedIds returns the IDs of the documents indexed under a path-value
+// pair.
+func getIndexedIds(reader pebble.Reader, collectionName, pathValue string) ([]string, error) {
+	prefix := getIndexPrefix(collectionName, pathValue)
+	iter := reader.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	var ids []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		ids = append(ids, string(iter.Key()[len(prefix):]))
+	}
+
+	return ids, iter.Error()
+}
+
+// getCollectionPrefix returns the prefix shared by all the keys of a collection.
+func getCollectionPrefix(collectionName string) []byte {
+	namespace, name := splitCollectionName(collectionName)
+	return []byte(namespace + collectionNameEscaper.Replace(name) + string(keySeparator))
+}
+
+// The keys of a namespace are prefixed with a backslash followed by "ns:",
+// the escaped name of the namespace and a colon, and those of a nested
+// namespace with the prefix of each namespace in turn. Zero bytes in the name
+// of a namespace are escaped as well. A backslash in an escaped collection
+// name is always followed by a backslash or a colon, so the keys of a
+// namespace never clash with the keys outside of it.
+//
+// Within a namespaced DB, collection names are qualified with the key prefix
+// of the namespace, between zero bytes, before they are passed down, so that
+// the key functions can prepend it to the keys.
+
+const namespacePrefix = `\ns:`
+
+var namespaceEscaper = strings.NewReplacer(`\`, `\\`, ":", `\:`, "\x00", `\0`)
+
+// collection qualifies a collection name with the namespace of the DB.
+func (db *DB) collection(collectionName string) string {
+	if db.namespace == "" {
+		return collectionName
+	}
+
+	return "\x00" + db.namespace + "\x00" + collectionName
+}
+
+// splitCollectionName splits a qualified collection name into the key prefix
+// of its namespace and the name of the collection.
+func splitCollectionName(collectionName string) (namespace, name string) {
+	if !strings.HasPrefix(collectionName, "\x00") {
+		return "", collectionName
+	}
+
+	namespace, name, _ = strings.Cut(collectionName[1:], "\x00")
+	return namespace, name
+}
+
+// Numeric index keys are made of the collection prefix, a zero byte, the path,
+// another zero byte, the number encoded in 8 bytes, and the document ID. The
+// zero bytes keep them apart from the path-value keys of the index, and the
+// encoding of the number sorts the keys of a path in numeric order.
+
+func getNumericIndexPrefix(collectionName, path string) []byte {
+	prefix := append(getCollectionPrefix(collectionName), 0)
+	prefix = append(prefix, path...)
+	return append(prefix, 0)
+}
+
+func getNumericIndexKey(collectionName, path string, number float64, id string) []byte {
+	key := append(getNumericIndexPrefix(collectionName, path), encodeNumber(number)...)
+	return append(key, id...)
+}
+
+// Compound index keys are made of the collection prefix, a 0x02 byte, the
+// number of paths of the index, the path-value pairs of the document for each
+// path followed by a zero byte, and the document ID. The number of paths keeps
+// the keys of an index apart from those of a longer index with the same paths.
+
+func getCompoundIndexPrefix(collectionName string, pathValues []string) []byte {
+	prefix := append(getCollectionPrefix(collectionName), 2, byte(len(pathValues)))
+	for _, pathValue := range pathValues {
+		prefix = append(prefix, pathValue...)
+		prefix = append(prefix, 0)
+	}
+	return prefix
+}
+
+func getCompoundIndexKey(collectionName string, pathValues []string, id string) []byte {
+	return append(getCompoundIndexPrefix(collectionName, pathValues), id...)
+}
+
+// encodeNumber encodes a number in 8 big-endian bytes that sort in the same
+// order as the numbers. -0 is encoded like 0, which it equals.
+func encodeNumber(number float64) []byte {
+	if number == 0 {
+		number = 0
+	}
+
+	bits := math.Float64bits(number)
+	if bits&(1<<63) == 0 {
+		// Positive numbers sort after the negative ones
+		bits ^= 1 << 63
+	} else {
+		// Negative numbers sort in reverse order of their magnitude
+		bits = ^bits
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, bits)
+	return b
+}
+
+// Metadata keys (e.g. the numeric indexes of a collection) are stored in the
+// index under a backslash followed by "meta:". Since a backslash in an escaped
+// collection name is always followed by a backslash or a colon, they never
+// clash with the keys of a collection.
+
+const metadataPrefix = `\meta:`
+
+// Names of the metadata of a collection
+const (
+	numericIndexesMetadata  = "numericIndexes"
+	uniqueIndexesMetadata   = "uniqueIndexes"
+	compoundIndexesMetadata = "compoundIndexes"
+	schemaMetadata          = "schema"
+	autoIncrementMetadata   = "autoIncrement"
+	idCounterMetadata       = "idCounter"
+	timestampsMetadata      = "timestamps"
+	softDeleteMetadata      = "softDelete"
+	delimitersMetadata      = "delimiters"
+	noIndexMetadata         = "noIndex"
+	partialIndexesMetadata  = "partialIndexes"
+)
+
+// hasMetadata checks if a collection has the metadata with the given name,
+// e.g. a flag of an option.
+func hasMetadata(reader pebble.Reader, collectionName, name string) (bool, error) {
+	_, closer, err := reader.Get(getMetadataKey(collectionName, name))
+	if err == pebble.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, closer.Close()
+}
+
+func getMetadataKey(collectionName, name string) []byte {
+	return append(getMetadataPrefix(collectionName), name...)
+}
+
+// getMetadataPrefix returns the prefix shared by all the metadata keys of a
+// collection. The metadata of a namespace is stored within the namespace.
+func getMetadataPrefix(collectionName string) []byte {
+	namespace, name := splitCollectionName(collectionName)
+	return append([]byte(namespace+metadataPrefix), getCollectionPrefix(name)...)
+}
+
+// parseKey splits a key into the collection name, qualified with the
+// namespace of the key if any, and the rest of the key (the document ID or
+// the path-value pair).
+func parseKey(key []byte) (collectionName, rest string, ok bool) {
+	// Skip the prefixes of the namespaces
+	namespaceEnd := 0
+	for bytes.HasPrefix(key[namespaceEnd:], []byte(namespacePrefix)) {
+		_, end, ok := cutEscaped(key[namespaceEnd+len(namespacePrefix):])
+		if !ok {
+			return "", "", false
+		}
+		namespaceEnd += len(namespacePrefix) + end + 1
+	}
+
+	name, end, ok := cutEscaped(key[namespaceEnd:])
+	if !ok {
+		return "", "", false
+	}
+
+	if namespaceEnd > 0 {
+		name = "\x00" + string(key[:namespaceEnd]) + "\x00" + name
+	}
+
+	return name, string(key[namespaceEnd+end+1:]), true
+}
+
+// cutEscaped unescapes the bytes of an escaped name up to the first unescaped
+// separator, and returns the index of the separator.
+func cutEscaped(b []byte) (name string, end int, ok bool) {
+	var builder strings.Builder
+
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			// The next byte is escaped
+			i++
+			if i == len(b) {
+				return "", 0, false
+			}
+			builder.WriteByte(b[i])
+		case keySeparator:
+			return builder.String(), i, true
+		default:
+			builder.WriteByte(b[i])
+		}
+	}
+
+	return "", 0, false
+}
+
+// matchQuery checks if a document matches a query.
+func matchQuery(document Document, query Query, delimiters map[string]string) bool {
+	// Top-level implicitly ANDs all the conditions
+	for _, topOperand := range query {
+		if !matchGroup(document, topOperand.Operator, topOperand.Operands, delimiters) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchGroup checks if a document matches a group of conditions combined with
+// the AND or OR operator.
+func matchGroup(document Document, operator string, operands []Condition, delimiters map[string]string) bool {
+	// OR condition
+	if operator == OR {
+		for _, operand := range operands {
+			if matchCondition(document, operand, delimiters) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	// AND condition
+	for _, operand := range operands {
+		if !matchCondition(document, operand, delimiters) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchCondition checks if a document matches a condition. A string at a
+// path with a delimiter matches if the whole string or any of its parts
+// matches, except for NE, which compares the whole string.
+func matchCondition(document Document, condition Condition, delimiters map[string]string) bool {
+	if condition.Negate {
+		condition.Negate = false
+		return !matchCondition(document, condition, delimiters)
+	}
+
+	// Nested group of conditions
+	if isGroupCondition(condition) {
+		return matchGroup(document, condition.Operator, condition.Operands, delimiters)
+	}
+
+	value, ok := getValueFromPath(document, condition.Path)
+
+	if condition.Operator == EXISTS {
+		exists, _ := condition.Value.(bool)
+		return ok == exists
+	}
+
+	// A missing path only matches NE, while a null value is matched like any
+	// other value
+	if !ok {
+		return condition.Operator == NE
+	}
+
+	// An array matches if any of its elements matches, e.g. the values of
+	// "reviews.rating" in the objects of the reviews array. NE compares the
+	// array as a whole.
+	if elements, isArray := value.([]interface{}); isArray && condition.Operator != NE {
+		for _, element := range elements {
+			if matchParts(element, condition, delimiters[condition.Path]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return matchParts(value, condition, delimiters[condition.Path])
+}
+
+// matchParts checks if a value, or one of its parts when it is a string split
+// on the delimiter, matches a condition.
+func matchParts(value interface{}, condition Condition, delimiter string) bool {
+	if matchValue(value, condition) {
+		return true
+	}
+
+	s, ok := value.(string)
+	if !ok || condition.Operator == NE {
+		return false
+	}
+
+	for _, part := range splitValue(s, delimiter) {
+		if matchValue(part, condition) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchValue checks if a value matches a condition. A null value only equals
+// null, and never matches the range, substring and regular expression
+// operators.
+func matchValue(value interface{}, condition Condition) bool {
+	if condition.Operator == EQ {
+		return equalValues(value, condition.Value, condition.CaseInsensitive)
+	} else if condition.Operator == NE {
+		return !equalValues(value, condition.Value, condition.CaseInsensitive)
+	} else if condition.Operator == IN {
+		candidates, ok := condition.Value.([]interface{})
+		if !ok {
+			return false
+		}
+
+		for _, candidate := range candidates {
+			if equalValues(value, candidate, condition.CaseInsensitive) {
+				return true
+			}
+		}
+
+		return false
+	} else if value == nil {
+		return false
+	} else if condition.Operator == STARTS || condition.Operator == ENDS || condition.Operator == CONTAINS {
+		return matchSubstring(value, condition)
+	} else if condition.Operator == MATCH {
+		if condition.pattern != nil {
+			return condition.pattern.MatchString(stringValue(value))
+		}
+
+		pattern, ok := condition.Value.(string)
+		if !ok {
+			return false
+		}
+
+		matched, err := regexp.MatchString(pattern, stringValue(value))
+		return err == nil && matched
+	}
+
+	// Handle BETWEEN as >= low and <= high
+	if condition.Operator == BETWEEN {
+		bounds, ok := condition.Value.([]interface{})
+		if !ok || len(bounds) != 2 {
+			return false
+		}
+
+		return matchValue(value, Condition{Path: condition.Path, Operator: GTE, Value: bounds[0]}) &&
+			matchValue(value, Condition{Path: condition.Path, Operator: LTE, Value: bounds[1]})
+	}
+
+	// Handle >, >=, <, <=
+	// Compare as times when both sides are RFC3339 timestamps
+	if left, ok := toTime(value); ok {
+		if right, ok := toTime(condition.Value); ok {
+			return matchComparison(left.Compare(right), condition.Operator)
+		}
+	}
+
+	right, err := strconv.ParseFloat(fmt.Sprintf("%v", condition.Value), 64)
+	if err != nil {
+		return false
+	}
+
+	left, ok := toNumber(value)
+	if !ok {
+		return false
+	}
+
+	switch condition.Operator {
+	case GT:
+		return left > right
+	case GTE:
+		return left >= right
+	case LT:
+		return left < right
+	case LTE:
+		return left <= right
+	}
+
+	return false
+}
+
+// matchSubstring checks if the string representation of a value starts with,
+// ends with or contains the string representation of the condition value.
+func matchSubstring(value interface{}, condition Condition) bool {
+	s, substring := stringValue(value), stringValue(condition.Value)
+	if condition.CaseInsensitive {
+		s, substring = strings.ToLower(s), strings.ToLower(substring)
+	}
+
+	switch condition.Operator {
+	case STARTS:
+		return strings.HasPrefix(s, substring)
+	case ENDS:
+		return strings.HasSuffix(s, substring)
+	case CONTAINS:
+		return strings.Contains(s, substring)
+	}
+
+	return false
+}
+
+// equalValues compares two values. Numbers are compared numerically, whether
+// they are ints, floats or json.Numbers, since the numbers of the stored
+// documents are decoded as float64. Null only equals null, and booleans only
+// equal booleans. Objects only equal objects with the same canonical JSON,
+// whatever the order of their keys. Other values are compared by their string
+// representations, ignoring case if caseInsensitive is true.
+func equalValues(a, b interface{}, caseInsensitive bool) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	leftObject, leftIsObject := toObject(a)
+	rightObject, rightIsObject := toObject(b)
+	if leftIsObject || rightIsObject {
+		return leftIsObject && rightIsObject && canonicalJSON(leftObject) == canonicalJSON(rightObject)
+	}
+
+	// Booleans only equal booleans, e.g. true doesn't equal "true"
+	leftBool, leftIsBool := a.(bool)
+	rightBool, rightIsBool := b.(bool)
+	if leftIsBool || rightIsBool {
+		return leftIsBool && rightIsBool && leftBool == rightBool
+	}
+
+	if left, ok := toFloat64(a); ok {
+		if right, ok := toFloat64(b); ok {
+			return left == right
+		}
+	}
+
+	left, right := stringValue(a), stringValue(b)
+	if caseInsensitive {
+		return strings.ToLower(left) == strings.ToLower(right)
+	}
+
+	return left == right
+}
+
+// toObject converts an object value, i.e. a map or a struct, to a map of JSON
+// values like those of the stored documents, e.g. to compare the value of a
+// condition with the objects of the documents.
+func toObject(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case Document:
+		return v, true
+	case time.Time:
+		return nil, false
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(value))
+	if v.Kind() != reflect.Struct && v.Kind() != reflect.Map {
+		return nil, false
+	}
+
+	object, err := toDocumentMap(value)
+	if err != nil {
+		return nil, false
+	}
+
+	return object, true
+}
+
+// hasObjectValue checks if the value of a condition, or one of the values of
+// an IN condition, is an object.
+func hasObjectValue(condition Condition) bool {
+	values := []interface{}{condition.Value}
+	if condition.Operator == IN {
+		values, _ = condition.Value.([]interface{})
+	}
+
+	return slices.ContainsFunc(values, func(value interface{}) bool {
+		_, ok := toObject(value)
+		return ok
+	})
+}
+
+// canonicalJSON returns the JSON of a value, with the keys of its objects
+// sorted, and the numbers formatted alike whatever their Go type.
+func canonicalJSON(value interface{}) string {
+	bs, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+
+	// Decode and encode again, so that e.g. the json.Number 1.0 is written as
+	// 1 like the int 1 and the float 1.0
+	var decoded interface{}
+	if err := json.Unmarshal(bs, &decoded); err != nil {
+		return ""
+	}
+
+	bs, _ = json.Marshal(decoded)
+	return string(bs)
+}
+
+// stringValue returns the string representation of a value, which the string
+// comparisons and the index keys are based on. Objects and arrays are written
+// as their canonical JSON, so that their representation doesn't depend on
+// their Go types, e.g. a struct and the map of its fields. Numbers are written
+// like in the index keys, see formatNumber, so that the string comparisons of
+// a full scan match the lookups of the index. The stored index keys only hold
+// the scalar values of the documents, which are written as before, so they
+// don't need to be rebuilt.
+func stringValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	if number, ok := toFloat64(value); ok {
+		return formatNumber(number)
+	}
+
+	if _, isTime := value.(time.Time); !isTime {
+		switch reflect.Indirect(reflect.ValueOf(value)).Kind() {
+		case reflect.Map, reflect.Struct, reflect.Slice, reflect.Array:
+			return canonicalJSON(value)
+		}
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// toNumber converts a value to a number for range conditions, aggregations
+// and the numeric index. Numeric strings are parsed as numbers.
+func toNumber(value interface{}) (float64, bool) {
+	if number, ok := toFloat64(value); ok {
+		return number, true
+	}
+
+	s, isString := value.(string)
+	if !isString {
+		return 0, false
+	}
+
+	number, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return number, true
+}
+
+// matchComparison checks if the result of comparing two values (-1, 0 or +1)
+// satisfies a range operator.
+func matchComparison(c int, operator string) bool {
+	switch operator {
+	case GT:
+		return c > 0
+	case GTE:
+		return c >= 0
+	case LT:
+		return c < 0
+	case LTE:
+		return c <= 0
+	}
+
+	return false
+}
+
+// toTime converts a time.Time or a string containing an RFC3339 timestamp to a time.Time.
+func toTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		return t, err == nil
+	}
+
+	return time.Time{}, false
+}
+
+// toFloat64 converts a numeric value to float64.
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	case float32:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+
+	return 0, false
+}
+
+// getValueFromPath returns the value at a dot-separated path of a document, and
+// whether the path exists; a path to a null value exists. When the path
+// crosses an array of objects, the values at the rest of the path in each
+// object are collected into an array, e.g. "reviews.rating" of
+// {"reviews": [{"rating": 5}, {"rating": 3}]} is [5, 3]. A numeric part of
+// the path selects the element of an array at that position instead, e.g.
+// "reviews.0.rating" is 5; a position out of range doesn't exist.
+func getValueFromPath(document map[string]interface{}, path string) (interface{}, bool) {
+	return getValueFromParts(document, strings.Split(path, "."))
+}
+
+func getValueFromParts(docSegment interface{}, parts []string) (interface{}, bool) {
+	for i, part := range parts {
+		switch v := docSegment.(type) {
+		case map[string]interface{}:
+			value, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			docSegment = value
+		case []interface{}:
+			if position, ok := parsePosition(part); ok {
+				if position >= len(v) {
+					return nil, false
+				}
+				docSegment = v[position]
+				continue
+			}
+
+			values := []interface{}{}
+			for _, element := range v {
+				if _, isMap := element.(map[string]interface{}); !isMap {
+					continue
+				}
+
+				value, ok := getValueFromParts(element, parts[i:])
+				if !ok {
+					continue
+				}
+
+				// Flatten the arrays, so that each value can be matched
+				if elements, isArray := value.([]interface{}); isArray {
+					values = append(values, elements...)
+				} else {
+					values = append(values, value)
+				}
+			}
+
+			return values, len(values) > 0
+		default:
+			return nil, false
+		}
+	}
+
+	return docSegment, true
+}
+
+// parsePosition parses a part of a path made of digits only as a position in
+// an array.
+func parsePosition(part string) (int, bool) {
+	if part == "" || strings.Trim(part, "0123456789") != "" {
+		return 0, false
+	}
+
+	position, err := strconv.Atoi(part)
+	return position, err == nil
+}
+
+// hasPosition reports whether a path selects an element of an array by its
+// position, which the path-value pairs of the index don't record.
+func hasPosition(path string) bool {
+	for _, part := range strings.Split(path, ".") {
+		if _, ok := parsePosition(part); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Unmarshal a document into a struct
+func Unmarshal(doc Document, v interface{}) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// FindOneAs is like FindOne, but unmarshals the document into a value of type
+// T. It returns ErrNoDocuments if no document matches.
+func FindOneAs[T any](db *DB, collectionName string, query Query, options ...Options) (T, error) {
+	var result T
+
+	document, err := db.FindOne(collectionName, query, options...)
+	if err != nil {
+		return result, err
+	}
+
+	err = Unmarshal(document, &result)
+	return result, err
+}
+
+// FindManyAs is like FindMany, but unmarshals the documents into values of
+// type T.
+func FindManyAs[T any](db *DB, collectionName string, query Query, options Options) ([]T, error) {
+	documents, err := db.FindMany(collectionName, query, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal all the documents at once, which is cheaper than one by one
+	b, err := json.Marshal(documents)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []T
+	if err := json.Unmarshal(b, &results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Strategies of a QueryPlan
+const (
+	StrategyIndex    = "index"    // The candidate documents are looked up in the index
+	StrategyFullScan = "fullScan" // All the documents of the collection are scanned
+)
+
+// QueryPlan describes how a query is executed, as returned by Explain.
+type QueryPlan struct {
+	Strategy      string   // StrategyIndex or StrategyFullScan
+	IndexProbes   []string // Lookups in the index, e.g. "cuisine=Chinese"
+	CompoundIndex []string // Paths of the compound index used, if any
+	Candidates    int      // Number of documents checked against the query
+	InMemorySort  bool     // Whether all the matching documents are collected and sorted
+}
+
+// Explain returns the plan of a query without fetching the documents: whether
+// the index is used or the collection is fully scanned, the lookups in the
+// index, and the number of candidate documents to check against the query.
+// The candidates of the index are the IDs found in the index, which may
+// include IDs of documents that no longer exist.
+func (db *DB) Explain(collectionName string, query Query, options Options) (QueryPlan, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	plan, err := db.explain(collectionName, query, options)
+	db.observeQuery("Explain", start, plan.Candidates)
+
+	return plan, err
+}
+
+// explain returns the plan of a query. The caller must hold the read lock.
+func (db *DB) explain(collectionName string, query Query, options Options) (QueryPlan, error) {
+	plan := QueryPlan{InMemorySort: len(options.Sort) > 0}
+
+	if err := ValidateQuery(query); err != nil {
+		return plan, err
+	}
+
+	partialIndexes, err := getPartialIndexes(db.index, collectionName)
+	if err != nil {
+		return plan, err
+	}
+	query = hidePartialConditions(query, partialIndexes)
+
+	numericPaths, err := db.getNumericIndexPaths(collectionName)
+	if err != nil {
+		return plan, err
+	}
+
+	indexed, err := isIndexed(db.index, collectionName)
+	if err != nil {
+		return plan, err
+	}
+
+	if options.IncludeDeleted || !indexed || !canUseIndex(query, numericPaths) {
+		plan.Strategy = StrategyFullScan
+
+		prefix := getCollectionPrefix(collectionName)
+		iter := db.store.NewIter(&pebble.IterOptions{
+			LowerBound: prefix,
+			UpperBound: prefixUpperBound(prefix),
+		})
+		defer iter.Close()
+
+		for iter.First(); iter.Valid(); iter.Next() {
+			plan.Candidates++
+		}
+
+		return plan, iter.Error()
+	}
+
+	plan.Strategy = StrategyIndex
+
+	compoundIndexes, err := db.getCompoundIndexes(collectionName)
+	if err != nil {
+		return plan, err
+	}
+
+	// Describe the lookups in the same order as findIdsFromIndex
+	compoundPaths, compoundConditions := findCompoundIndex(query, compoundIndexes)
+	if compoundPaths != nil {
+		plan.CompoundIndex = compoundPaths
+
+		pathValues := make([]string, len(compoundPaths))
+		for position := range compoundConditions {
+			operand := query[position[0]].Operands[position[1]]
+			pathValues[slices.Index(compoundPaths, operand.Path)] = buildPathValue(operand.Path, operand.Value)
+		}
+		plan.IndexProbes = append(plan.IndexProbes, strings.Join(pathValues, ", "))
+	}
+
+	for i, topOperand := range query {
+		for j, operand := range topOperand.Operands {
+			if compoundConditions[[2]int{i, j}] {
+				continue
+			}
+
+			// All the conditions of a top-level OR are looked up in the index
+			if topOperand.Operator == OR || isIndexableCondition(operand, numericPaths) {
+				plan.IndexProbes = append(plan.IndexProbes, describeIndexProbes(operand)...)
+			}
+		}
+	}
+
+	ids, err := db.findIdsFromIndex(collectionName, query, numericPaths)
+	if err != nil {
+		return plan, err
+	}
+	plan.Candidates = len(ids)
+
+	return plan, nil
+}
+
+// describeIndexProbes returns the descriptions of the lookups of a condition
+// in the index.
+func describeIndexProbes(condition Condition) []string {
+	if isRangeOperator(condition.Operator) {
+		low, high, err := getNumericBounds(condition)
+		if err != nil {
+			return nil
+		}
+
+		return []string{fmt.Sprintf("%s in [%v, %v] (numeric index)", condition.Path, low, high)}
+	}
+
+	values := []interface{}{condition.Value}
+	if condition.Operator == IN {
+		values, _ = condition.Value.([]interface{})
+	}
+
+	var probes []string
+	for _, value := range values {
+		if s, ok := value.(string); ok && condition.CaseInsensitive {
+			probes = append(probes, buildPathValue(condition.Path, strings.ToLower(s))+" (case-insensitive)")
+			continue
+		}
+
+		probes = append(probes, buildPathValue(condition.Path, value))
+	}
+
+	return probes
+}
+
+/****************
+ * Aggregation
+****************/
+
+// Distinct returns the unique values at a path across the documents matching
+// the query, sorted like the values of a sort field, with null last. The
+// elements of arrays are collected one by one, and documents without the path
+// are skipped, while an explicit null is a value. A nil or empty query matches
+// all documents in the collection.
+func (db *DB) Distinct(collectionName, path string, query Query) ([]interface{}, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	values, err := db.distinct(collectionName, path, query)
+	db.observeQuery("Distinct", start, len(values))
+
+	return values, err
+}
+
+// distinct returns the unique values at a path across the documents matching
+// the query. The caller must hold the read lock.
+func (db *DB) distinct(collectionName, path string, query Query) ([]interface{}, error) {
+	cursor, err := db.newCursor(context.Background(), collectionName, query, Options{Project: []string{path}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	seen := map[string]bool{}
+	values := []interface{}{}
+
+	for cursor.Next() {
+		value, ok := getValueFromPath(cursor.Document(), path)
+		if !ok {
+			continue
+		}
+
+		elements, isArray := value.([]interface{})
+		if !isArray {
+			elements = []interface{}{value}
+		}
+
+		for _, element := range elements {
+			// Compare the values by their JSON representations, as maps and
+			// arrays can't be map keys
+			key, err := json.Marshal(element)
+			if err != nil {
+				return nil, err
+			}
+
+			if !seen[string(key)] {
+				seen[string(key)] = true
+				values = append(values, element)
+			}
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	sortFields := []SortField{{Path: path}}
+	sort.SliceStable(values, func(i, j int) bool {
+		return compareSortValues(values[i:i+1], values[j:j+1], sortFields) < 0
+	})
+
+	return values, nil
+}
+
+// AggResult holds the aggregates of the numeric values at a path.
+type AggResult struct {
+	Count int // Number of numeric values
+	Sum   float64
+	Avg   float64
+	Min   float64
+	Max   float64
+}
+
+// Aggregate computes the count, sum, average, minimum and maximum of the
+// numeric values at a path across the documents matching the query. The
+// elements of arrays are aggregated one by one. Numeric strings are parsed
+// like in range conditions, and other values are skipped.
+// All the aggregates are 0 if there are no numeric values.
+func (db *DB) Aggregate(collectionName, path string, query Query) (AggResult, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	result, err := db.aggregate(collectionName, path, query)
+	db.observeQuery("Aggregate", start, result.Count)
+
+	return result, err
+}
+
+// aggregate computes the aggregates of the numeric values at a path across the
+// documents matching the query. The caller must hold the read lock.
+func (db *DB) aggregate(collectionName, path string, query Query) (AggResult, error) {
+	var result AggResult
+
+	cursor, err := db.newCursor(context.Background(), collectionName, query, Options{Project: []string{path}})
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close()
+
+	for cursor.Next() {
+		value, _ := getValueFromPath(cursor.Document(), path)
+
+		// Aggregate each element of an array
+		values, isArray := value.([]interface{})
+		if !isArray {
+			values = []interface{}{value}
+		}
+
+		for _, value := range values {
+			number, ok := toNumber(value)
+			if !ok {
+				continue
+			}
+
+			if result.Count == 0 || number < result.Min {
+				result.Min = number
+			}
+			if result.Count == 0 || number > result.Max {
+				result.Max = number
+			}
+
+			result.Count++
+			result.Sum += number
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return AggResult{}, err
+	}
+
+	if result.Count > 0 {
+		result.Avg = result.Sum / float64(result.Count)
+	}
+
+	return result, nil
+}
+
+/****************
+ * Replace
+****************/
+
+// ReplaceOneById replaces the entire document stored under the given ID,
+// keeping the same _id. The secondary index and full-text search entries of
+// the old document are removed before the new document is indexed. It returns
+// ErrDocumentNotExists if there is no document, or if it is soft-deleted.
+func (db *DB) ReplaceOneById(collectionName, id string, document interface{}) error {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	err := db.replaceOneById(collectionName, id, document)
+	db.observeWrite("ReplaceOneById", start, err)
+
+	return err
+}
+
+// replaceOneById replaces the document stored under the given ID. The caller
+// must hold the write lock.
+func (db *DB) replaceOneById(collectionName, id string, document interface{}) error {
+	indexBatch := db.index.NewIndexedBatch()
+	defer indexBatch.Close()
+
+	ftsBatch := db.fts.NewBatch()
+	defer ftsBatch.Close()
+
+	key, bs, err := db.prepareReplace(db.store, indexBatch, ftsBatch, collectionName, id, document)
+	if err != nil {
+		return err
+	}
+
+	if err := db.commitIndexBatches(indexBatch, ftsBatch); err != nil {
+		return err
+	}
+
+	// Write the new document to the store
+	if err := db.store.Set(key, bs, db.writeOptions); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// prepareReplace swaps the index and full-text search entries of the document
+// stored under the given ID for the ones of the new document in the batches,
+// and returns the key and the value of the new document to write to the
+// store. The store is read through the given reader.
+func (db *DB) prepareReplace(store pebble.Reader, indexBatch, ftsBatch *pebble.Batch, collectionName, id string, document interface{}) ([]byte, []byte, error) {
+	// Build the key
+	key := getDocumentKey(collectionName, id)
+
+	// Get the existing document, which can't be soft-deleted
+	oldDocument, err := getLiveDocument(store, collectionName, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Convert the new document to a map
+	documentMap, err := toDocumentMap(document)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := db.validateDocument(collectionName, documentMap); err != nil {
+		return nil, nil, err
+	}
+
+	if err := db.stampDocument(collectionName, documentMap, oldDocument); err != nil {
+		return nil, nil, err
+	}
+
+	// Keep the same _id
+	documentMap["_id"] = id
+
+	// Marshal the document into a byte slice
+	bs, err := json.Marshal(documentMap)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Swap the old document for the new one in the index
+	if err := db.deleteDocumentFromIndex(indexBatch, collectionName, id, oldDocument); err != nil {
+		return nil, nil, err
+	}
+
+	if err := db.checkUniqueIndexes(store, indexBatch, collectionName, id, documentMap); err != nil {
+		return nil, nil, err
+	}
+
+	if err := recordSplitTags(indexBatch, collectionName, reflect.ValueOf(document)); err != nil {
+		return nil, nil, err
+	}
+
+	if err := db.indexDocument(indexBatch, collectionName, id, documentMap); err != nil {
+		return nil, nil, err
+	}
+
+	// Swap the old document for the new one in the full-text search index
+	if err := db.fts.DeleteFromIndexBatch(ftsBatch, collectionName, id, oldDocument); err != nil {
+		return nil, nil, err
+	}
+
+	if err := db.fts.AddToIndexBatch(ftsBatch, collectionName, id, document); err != nil {
+		return nil, nil, err
+	}
+
+	return key, bs, nil
+}
+
+/****************
+ * Upsert
+****************/
+
+// Upsert replaces the document stored under the given ID if it exists, or
+// inserts the document under that ID otherwise. A soft-deleted document under
+// the ID counts as absent, so it is replaced by a new document, without the
+// _createdAt timestamp of the deleted one. A new ID is generated when the
+// given ID is empty. It returns the ID of the document.
+func (db *DB) Upsert(collectionName, id string, document interface{}) (string, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return "", err
+	}
+	defer db.mu.Unlock()
+
+	id, err := db.upsert(collectionName, id, document)
+	db.observeWrite("Upsert", start, err)
+
+	return id, err
+}
+
+func (db *DB) upsert(collectionName, id string, document interface{}) (string, error) {
+	if id == "" {
+		return db.insertOne(collectionName, "", document, false)
+	}
+
+	exists, err := liveDocumentExists(db.store, collectionName, id)
+	if err != nil {
+		return "", err
+	}
+
+	if !exists {
+		return db.insertOne(collectionName, id, document, false)
+	}
+
+	if err := db.replaceOneById(collectionName, id, document); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+/****************
+ * Update
+****************/
+
+// UpdateOptions configures FindOneAndUpdate.
+type UpdateOptions struct {
+	Sort      []SortField // Sort fields of the matching documents, the first of which is updated
+	Project   []string    // Paths to include in the returned document, in addition to _id
+	ReturnNew bool        // Whether to return the document after the update rather than before
+}
+
+// FindOneAndUpdate merges the update into the first document matching the
+// query and returns the document as it was before the update, or after it if
+// ReturnNew is set. It returns ErrNoDocuments if no document matches.
+//
+// Each key of the update is a dot-separated path whose value is set in the
+// document, replacing the existing value, e.g. {"address.city": "NY"} only
+// changes the city of the address, and {"items.0.price": 5} the price of the
+// first item. It returns ErrInvalidUpdate if a path crosses a value that is
+// neither an object nor an array. The _id can't be updated. The document is
+// found and updated under the write lock, so concurrent updates can't be
+// lost, e.g. to move a document from one state to the next.
+func (db *DB) FindOneAndUpdate(collectionName string, query Query, update Document, options ...UpdateOptions) (Document, error) {
+	collectionName = db.collection(collectionName)
+
+	updateOptions := UpdateOptions{}
+	if len(options) > 0 {
+		updateOptions = options[0]
+	}
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return nil, err
+	}
+	defer db.mu.Unlock()
+
+	document, err := db.findOneAndUpdate(collectionName, query, update, updateOptions)
+	db.observeWrite("FindOneAndUpdate", start, err)
+
+	return document, err
+}
+
+func (db *DB) findOneAndUpdate(collectionName string, query Query, update Document, updateOptions UpdateOptions) (Document, error) {
+	documents, err := db.findMany(context.Background(), collectionName, query, Options{Limit: 1, Sort: updateOptions.Sort})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(documents) == 0 {
+		return nil, ErrNoDocuments
+	}
+
+	document := documents[0]
+	id, ok := document["_id"].(string)
+	if !ok {
+		return nil, ErrNoDocuments
+	}
+
+	// Merge the update into a copy of the document
+	updated, err := toDocumentMap(document)
+	if err != nil {
+		return nil, err
+	}
+
+	for path, value := range update {
+		if path != "_id" {
+			if err := setValueAtPath(updated, path, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := db.replaceOneById(collectionName, id, updated); err != nil {
+		return nil, err
+	}
+
+	if updateOptions.ReturnNew {
+		// Read the stored document, e.g. with its timestamps
+		if document, err = getDocument(db.store, collectionName, id); err != nil {
+			return nil, err
+		}
+	}
+
+	if updateOptions.Project != nil {
+		document = projectDocument(document, updateOptions.Project)
+	}
+
+	return document, nil
+}
+
+// setValueAtPath sets the value at a dot-separated path of a document. The
+// missing objects along the path are created, and a numeric part of the path
+// selects the element of an array at that position, like in getValueFromPath.
+// It returns ErrInvalidUpdate if the path crosses a value that is neither an
+// object nor an array, or an array at a part that is not a position in range.
+func setValueAtPath(document Document, path string, value interface{}) error {
+	keys := strings.Split(path, ".")
+
+	var segment interface{} = map[string]interface{}(document)
+	for i, key := range keys {
+		last := i == len(keys)-1
+
+		if object, ok := segment.(Document); ok {
+			segment = map[string]interface{}(object)
+		}
+
+		switch v := segment.(type) {
+		case map[string]interface{}:
+			if last {
+				v[key] = value
+				return nil
+			}
+
+			next, ok := v[key]
+			if !ok {
+				next = map[string]interface{}{}
+				v[key] = next
+			}
+			segment = next
+		case []interface{}:
+			position, ok := parsePosition(key)
+			if !ok || position >= len(v) {
+				return fmt.Errorf("%w: %s is not a position of the array %s", ErrInvalidUpdate, key, strings.Join(keys[:i], "."))
+			}
+
+			if last {
+				v[position] = value
+				return nil
+			}
+			segment = v[position]
+		default:
+			return fmt.Errorf("%w: %s is neither an object nor an array", ErrInvalidUpdate, strings.Join(keys[:i], "."))
+		}
+	}
+
+	return nil
+}
+
+// UpdateOps are field operations applied to a document by UpdateOneById and
+// UpdateMany, without rewriting the rest of the document. The keys are
+// dot-separated paths. The operations are applied in the order of the fields.
+type UpdateOps struct {
+	Set   map[string]interface{} // Values to assign, replacing the existing ones
+	Inc   map[string]float64     // Amounts to add to numbers; a missing field counts as 0
+	Push  map[string]interface{} // Elements to append to arrays; a missing field counts as empty
+	Pull  map[string]interface{} // Elements to remove from arrays, all the equal ones
+	Unset []string               // Paths of the fields to remove
+}
+
+// UpdateOneById applies the update operations to the document stored under
+// the given ID. The index and full-text search entries of the document are
+// updated accordingly. It returns ErrDocumentNotExists if there is no such
+// document, and ErrInvalidUpdate if an operation is on _id, a field to
+// increment is not a number, or a path crosses a value that is neither an
+// object nor an array. The arrays along a path are crossed at a position, e.g.
+// "items.0.price".
+func (db *DB) UpdateOneById(collectionName, id string, update UpdateOps) error {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	err := db.updateOneById(collectionName, id, update)
+	db.observeWrite("UpdateOneById", start, err)
+
+	return err
+}
+
+func (db *DB) updateOneById(collectionName, id string, update UpdateOps) error {
+	indexBatch := db.index.NewIndexedBatch()
+	defer indexBatch.Close()
+
+	ftsBatch := db.fts.NewBatch()
+	defer ftsBatch.Close()
+
+	key, bs, err := db.prepareUpdate(db.store, indexBatch, ftsBatch, collectionName, id, update)
+	if err != nil {
+		return err
+	}
+
+	if err := db.commitIndexBatches(indexBatch, ftsBatch); err != nil {
+		return err
+	}
+
+	return db.store.Set(key, bs, db.writeOptions)
+}
+
+// prepareUpdate applies the update operations to the document stored under the
+// given ID, and prepares its replacement with the updated document in the
+// batches like prepareReplace. The store is read through the given reader.
+func (db *DB) prepareUpdate(store pebble.Reader, indexBatch, ftsBatch *pebble.Batch, collectionName, id string, update UpdateOps) ([]byte, []byte, error) {
+	document, err := getLiveDocument(store, collectionName, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	updated, err := applyUpdate(document, update)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return db.prepareReplace(store, indexBatch, ftsBatch, collectionName, id, updated)
+}
+
+// UpdateMany applies the update operations to all the documents matching the
+// query and returns the number of updated documents. A nil query is rejected
+// with ErrNilQuery, like in DeleteMany. If an error occurs, the documents
+// updated before are kept.
+func (db *DB) UpdateMany(collectionName string, query Query, update UpdateOps) (int, error) {
+	collectionName = db.collection(collectionName)
+
+	if query == nil {
+		return 0, ErrNilQuery
+	}
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return 0, err
+	}
+	defer db.mu.Unlock()
+
+	updated, err := db.updateMany(collectionName, query, update)
+	db.observeWrite("UpdateMany", start, err)
+
+	return updated, err
+}
+
+func (db *DB) updateMany(collectionName string, query Query, update UpdateOps) (int, error) {
+	documents, err := db.findMany(context.Background(), collectionName, query, Options{})
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, document := range documents {
+		id, ok := document["_id"].(string)
+		if !ok {
+			continue
+		}
+
+		if err := db.updateDocument(collectionName, id, document, update); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+
+	return updated, nil
+}
+
+// updateDocument applies the update operations to a copy of the document and
+// replaces the document with it, which updates the index entries of the array
+// elements pushed or pulled too. The caller must hold the write lock.
+func (db *DB) updateDocument(collectionName, id string, document Document, update UpdateOps) error {
+	updated, err := applyUpdate(document, update)
+	if err != nil {
+		return err
+	}
+
+	return db.replaceOneById(collectionName, id, updated)
+}
+
+// applyUpdate returns a copy of the document with the update operations
+// applied. It returns ErrInvalidUpdate if an operation is on _id, a field to
+// increment is not a number, a field to push to or pull from is not an array,
+// or a path crosses a value that is neither an object nor an array.
+func applyUpdate(document Document, update UpdateOps) (Document, error) {
+	if updatesId(update) {
+		return nil, fmt.Errorf("%w: _id can't be updated", ErrInvalidUpdate)
+	}
+
+	updated, err := toDocumentMap(document)
+	if err != nil {
+		return nil, err
+	}
+
+	for path, value := range update.Set {
+		if err := setValueAtPath(updated, path, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for path, amount := range update.Inc {
+		value, ok, err := getValueAtExactPath(updated, path)
+		if err != nil {
+			return nil, err
+		}
+
+		number := 0.0
+		if ok {
+			if number, ok = toFloat64(value); !ok {
+				return nil, fmt.Errorf("%w: %s is not a number", ErrInvalidUpdate, path)
+			}
+		}
+
+		if err := setValueAtPath(updated, path, number+amount); err != nil {
+			return nil, err
+		}
+	}
+
+	for path, element := range update.Push {
+		elements, err := getArrayAtPath(updated, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := setValueAtPath(updated, path, append(elements, element)); err != nil {
+			return nil, err
+		}
+	}
+
+	for path, element := range update.Pull {
+		elements, err := getArrayAtPath(updated, path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Compare the element as stored, e.g. a struct as an object
+		storedElement, err := toJSONValue(element)
+		if err != nil {
+			return nil, err
+		}
+
+		kept := []interface{}{}
+		for _, existing := range elements {
+			if !equalValues(existing, storedElement, false) {
+				kept = append(kept, existing)
+			}
+		}
+
+		if err := setValueAtPath(updated, path, kept); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range update.Unset {
+		deleteValueAtPath(updated, path)
+	}
+
+	return updated, nil
+}
+
+// updatesId checks if any operation of an update is on _id.
+func updatesId(update UpdateOps) bool {
+	_, set := update.Set["_id"]
+	_, inc := update.Inc["_id"]
+	_, push := update.Push["_id"]
+	_, pull := update.Pull["_id"]
+
+	return set || inc || push || pull || slices.Contains(update.Unset, "_id")
+}
+
+// getArrayAtPath returns the array at a dot-separated path of a document,
+// which is empty if the path is missing. The arrays along the path are crossed
+// at a position, like in getValueAtExactPath, so that e.g. "reviews.0.tags" is
+// the tags of the first review. It returns ErrInvalidUpdate if the value is not
+// an array, or the path crosses an array at a part that is not a position.
+func getArrayAtPath(document Document, path string) ([]interface{}, error) {
+	value, ok, err := getValueAtExactPath(document, path)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []interface{}{}, nil
+	}
+
+	elements, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not an array", ErrInvalidUpdate, path)
+	}
+
+	return elements, nil
+}
+
+// toJSONValue converts a value to the value decoded from its JSON
+// representation, i.e. as it is stored in a document.
+func toJSONValue(value interface{}) (interface{}, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var jsonValue interface{}
+	if err := json.Unmarshal(b, &jsonValue); err != nil {
+		return nil, err
+	}
+
+	return jsonValue, nil
+}
+
+// getValueAtExactPath returns the value at a dot-separated path of a
+// document, and whether the path exists, following the path like
+// setValueAtPath does: unlike getValueFromPath, the arrays along the path are
+// only crossed at a position, so that the value read is the one written back.
+// It returns ErrInvalidUpdate if the path crosses a value that is neither an
+// object nor an array, or an array at a part that is not a position.
+func getValueAtExactPath(document Document, path string) (interface{}, bool, error) {
+	keys := strings.Split(path, ".")
+
+	var segment interface{} = map[string]interface{}(document)
+	for i, key := range keys {
+		switch v := segment.(type) {
+		case map[string]interface{}:
+			value, ok := v[key]
+			if !ok {
+				return nil, false, nil
+			}
+			segment = value
+		case []interface{}:
+			position, ok := parsePosition(key)
+			if !ok {
+				return nil, false, fmt.Errorf("%w: %s is not a position of the array %s", ErrInvalidUpdate, key, strings.Join(keys[:i], "."))
+			}
+			if position >= len(v) {
+				return nil, false, nil
+			}
+			segment = v[position]
+		default:
+			return nil, false, fmt.Errorf("%w: %s is neither an object nor an array", ErrInvalidUpdate, strings.Join(keys[:i], "."))
+		}
+	}
+
+	return segment, true, nil
+}
+
+// deleteValueAtPath removes the value at a dot-separated path of a document,
+// if any. A numeric part of the path selects the element of an array at that
+// position, like in setValueAtPath.
+func deleteValueAtPath(document Document, path string) {
+	keys := strings.Split(path, ".")
+
+	var segment interface{} = map[string]interface{}(document)
+	for _, key := range keys[:len(keys)-1] {
+		switch v := segment.(type) {
+		case map[string]interface{}:
+			segment = v[key]
+		case []interface{}:
+			position, ok := parsePosition(key)
+			if !ok || position >= len(v) {
+				return
+			}
+			segment = v[position]
+		default:
+			return
+		}
+	}
+
+	if object, ok := segment.(map[string]interface{}); ok {
+		delete(object, keys[len(keys)-1])
+	}
+}
+
+/****************
+ * Delete
+****************/
+
+func (db *DB) DeleteOneById(collectionName, id string) error {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	err := db.deleteOneById(collectionName, id)
+	db.observeWrite("DeleteOneById", start, err)
+
+	return err
+}
+
+func (db *DB) deleteOneById(collectionName, id string) error {
+	// Get document by ID
+	document, err := db.findOneById(collectionName, id)
+	if err != nil {
+		return err
+	}
+
+	return db.deleteDocument(collectionName, id, document)
+}
+
+// DeleteOne deletes the first document matching the query. It returns
+// ErrNoDocuments if no document matches.
+func (db *DB) DeleteOne(collectionName string, query Query) error {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	_, err := db.findOneAndDelete(collectionName, query, Options{})
+	db.observeWrite("DeleteOne", start, err)
+
+	return err
+}
+
+// FindOneAndDelete deletes the first document matching the query and returns
+// it, or ErrNoDocuments if no document matches. The document is found and
+// deleted under the write lock, so no other caller can get it too, e.g. to
+// pop the next job of a work queue. Options can be passed optionally, e.g. to
+// sort the matching documents or to project the returned document; the limit
+// is always 1.
+func (db *DB) FindOneAndDelete(collectionName string, query Query, options ...Options) (Document, error) {
+	collectionName = db.collection(collectionName)
+
+	findOptions := Options{}
+	if len(options) > 0 {
+		findOptions = options[0]
+	}
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return nil, err
+	}
+	defer db.mu.Unlock()
+
+	document, err := db.findOneAndDelete(collectionName, query, findOptions)
+	db.observeWrite("FindOneAndDelete", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if findOptions.Project != nil {
+		document = projectDocument(document, findOptions.Project)
+	}
+
+	return document, nil
+}
+
+// findOneAndDelete deletes the first document matching the query and returns
+// it. The projection of the options is ignored, as the whole document is
+// needed to remove it from the indexes. The caller must hold the write lock.
+func (db *DB) findOneAndDelete(collectionName string, query Query, options Options) (Document, error) {
+	options.Limit = 1
+	options.Project = nil
+
+	documents, err := db.findMany(context.Background(), collectionName, query, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(documents) == 0 {
+		return nil, ErrNoDocuments
+	}
+
+	document := documents[0]
+	id, ok := document["_id"].(string)
+	if !ok {
+		return nil, ErrNoDocuments
+	}
+
+	if err := db.deleteDocument(collectionName, id, document); err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+// DeleteMany deletes all the documents matching the query and returns the
+// number of deleted documents. A nil query is rejected with ErrNilQuery to
+// avoid accidentally deleting the whole collection; pass an empty non-nil
+// Query{} to delete every document in the collection.
+func (db *DB) DeleteMany(collectionName string, query Query) (int, error) {
+	collectionName = db.collection(collectionName)
+
+	if query == nil {
+		return 0, ErrNilQuery
+	}
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return 0, err
+	}
+	defer db.mu.Unlock()
+
+	deleted, err := db.deleteMany(collectionName, query)
+	db.observeWrite("DeleteMany", start, err)
+
+	return deleted, err
+}
+
+func (db *DB) deleteMany(collectionName string, query Query) (int, error) {
+	documents, err := db.findMany(context.Background(), collectionName, query, Options{})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, document := range documents {
+		id, ok := document["_id"].(string)
+		if !ok {
+			continue
+		}
+
+		if err := db.deleteDocument(collectionName, id, document); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// DeleteByIndexValue deletes the documents of a collection with the value at
+// a path and returns the number of deleted documents, e.g. to purge all the
+// documents with status = "expired". The IDs are read straight from the
+// index entry of the path-value pair, so only the matching documents are
+// read, and each is deleted from the store and the indexes like with
+// DeleteOneById. Like with EQ conditions, numbers are matched whether they
+// are given as ints, floats or json.Numbers, and a value matches the arrays
+// holding it. If indexing is disabled for the collection, the path has a
+// partial index, or the pair isn't indexed, e.g. an object value or a path
+// with an array position, the documents are found by a query instead.
+func (db *DB) DeleteByIndexValue(collectionName, path string, value interface{}) (int, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return 0, err
+	}
+	defer db.mu.Unlock()
+
+	deleted, err := db.deleteByIndexValue(collectionName, path, value)
+	db.observeWrite("DeleteByIndexValue", start, err)
+
+	return deleted, err
+}
+
+func (db *DB) deleteByIndexValue(collectionName, path string, value interface{}) (int, error) {
+	indexed, err := isIndexed(db.index, collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	partials, err := getPartialIndexes(db.index, collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	condition := Condition{Path: path, Operator: EQ, Value: value}
+	if _, isPartial := partials[path]; !indexed || isPartial || !isIndexableCondition(condition, nil) {
+		return db.deleteMany(collectionName, Query{{Operator: AND, Operands: []Condition{condition}}})
+	}
+
+	ids, err := getIndexedIds(db.index, collectionName, buildPathValue(path, value))
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		// Skip the IDs left in the index by documents that no longer exist
+		document, err := db.findOneById(collectionName, id)
+		if err == ErrDocumentNotExists {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+
+		if err := db.deleteDocument(collectionName, id, document); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// deleteDocument deletes a document from the store, the index and the
+// full-text search index. If soft delete is enabled for the collection, the
+// document is kept in the store, marked as deleted.
+func (db *DB) deleteDocument(collectionName, id string, document Document) error {
+	softDelete, err := hasMetadata(db.index, collectionName, softDeleteMetadata)
+	if err != nil {
+		return err
+	}
+
+	// Build the key
+	key := getDocumentKey(collectionName, id)
+
+	// Update the store first, so that a crash before the indexes are updated
+	// leaves at most dangling or soft-deleted IDs in the indexes, which are
+	// skipped by queries.
+	if softDelete {
+		bs, err := markDeleted(document)
+		if err != nil {
+			return err
+		}
+
+		err = db.store.Set(key, bs, db.writeOptions)
+	} else {
+		err = db.store.Delete(key, db.writeOptions)
+	}
+	if err != nil {
+		return err
+	}
+
+	indexBatch := db.index.NewIndexedBatch()
+	defer indexBatch.Close()
+
+	ftsBatch := db.fts.NewBatch()
+	defer ftsBatch.Close()
+
+	if err := db.prepareDelete(indexBatch, ftsBatch, collectionName, id, document); err != nil {
+		return err
+	}
+
+	return db.commitIndexBatches(indexBatch, ftsBatch)
+}
+
+// SetSoftDelete sets whether the deleted documents of a collection are only
+// marked as deleted with _deleted: true, instead of being removed from the
+// store. Soft-deleted documents are removed from the indexes, and left out of
+// the queries unless Options.IncludeDeleted is set. Use Purge to remove them
+// for good. Disabling soft delete doesn't restore the soft-deleted documents,
+// which stay left out of the queries and counts until they are purged.
+func (db *DB) SetSoftDelete(collectionName string, enabled bool) error {
+	collectionName = db.collection(collectionName)
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	key := getMetadataKey(collectionName, softDeleteMetadata)
+
+	if !enabled {
+		return db.index.Delete(key, db.writeOptions)
+	}
+
+	return db.index.Set(key, nil, db.writeOptions)
+}
+
+// Purge removes the soft-deleted documents of a collection from the store and
+// returns the number of removed documents.
+func (db *DB) Purge(collectionName string) (int, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
+		return 0, err
+	}
+	defer db.mu.Unlock()
+
+	purged, err := db.purge(collectionName)
+	db.observeWrite("Purge", start, err)
+
+	return purged, err
+}
+
+// purge removes the soft-deleted documents of a collection from the store.
+// The caller must hold the write lock.
+func (db *DB) purge(collectionName string) (int, error) {
+	prefix := getCollectionPrefix(collectionName)
+	iter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	storeBatch := db.store.NewBatch()
+	defer storeBatch.Close()
+
+	purged := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document Document
+		if err := json.Unmarshal(iter.Value(), &document); err != nil {
+			return 0, err
+		}
+
+		if !isDeleted(document) {
+			continue
+		}
+
+		if err := storeBatch.Delete(iter.Key(), nil); err != nil {
+			return 0, err
+		}
+		purged++
+	}
+
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	return purged, storeBatch.Commit(db.writeOptions)
+}
+
+// deletedKey is the JSON key marking the soft-deleted documents, which the
+// other documents can only have in their nested objects.
+var deletedKey = []byte(`"_deleted":`)
+
+// isDeleted checks if a document is soft-deleted.
+func isDeleted(document Document) bool {
+	deleted, _ := document["_deleted"].(bool)
+	return deleted
+}
+
+// markDeleted returns a copy of a document marked as soft-deleted, marshalled
+// for the store.
+func markDeleted(document Document) ([]byte, error) {
+	deleted := make(Document, len(document)+1)
+	for key, value := range document {
+		deleted[key] = value
+	}
+	deleted["_deleted"] = true
+
+	return json.Marshal(deleted)
+}
+
+// prepareDelete removes the index and full-text search entries of a document
+// in the batches.
+func (db *DB) prepareDelete(indexBatch, ftsBatch *pebble.Batch, collectionName, id string, document Document) error {
+	// Delete the document from the index
+	if err := db.deleteDocumentFromIndex(indexBatch, collectionName, id, document); err != nil {
+		return err
+	}
+
+	// Delete the document from the full-text search text index
+	return db.fts.DeleteFromIndexBatch(ftsBatch, collectionName, id, document)
+}
+
+// deleteDocumentFromIndex removes the ID of a document from the index entries
+// of its path-value pairs. The changes are written to the indexed batch.
+// Nothing is removed if indexing is disabled for the collection.
+func (db *DB) deleteDocumentFromIndex(batch *pebble.Batch, collectionName, id string, document Document) error {
+	indexed, err := isIndexed(batch, collectionName)
+	if err != nil || !indexed {
+		return err
+	}
+
+	delimiters, err := getDelimiters(batch, collectionName)
+	if err != nil {
+		return err
+	}
+
+	pv := getPathValues(document, "", delimiters)
+
+	for _, pathValue := range pv {
+		if err := batch.Delete(getIndexKey(collectionName, pathValue, id), nil); err != nil {
+			return err
+		}
+	}
+
+	// Delete the document from the numeric indexes
+	numericKeys, err := db.getNumericIndexKeys(collectionName, id, document)
+	if err != nil {
+		return err
+	}
+
+	for _, numericKey := range numericKeys {
+		if err := batch.Delete(numericKey, nil); err != nil {
+			return err
+		}
+	}
+
+	// Delete the document from the compound indexes
+	compoundKeys, err := db.getCompoundIndexKeys(collectionName, id, document)
+	if err != nil {
+		return err
+	}
+
+	for _, compoundKey := range compoundKeys {
+		if err := batch.Delete(compoundKey, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/****************
+ * Schema
+****************/
+
+// Types of the paths of a schema
+const (
+	TypeString = "string"
+	TypeNumber = "number"
+	TypeBool   = "bool"
+	TypeObject = "object"
+	TypeArray  = "array"
+)
+
+// schema is the schema of a collection, stored in its metadata.
+type schema struct {
+	Required []string          `json:"required"`
+	Types    map[string]string `json:"types"`
+}
+
+// SetSchema sets the schema that the documents inserted into or replaced in a
+// collection must match: the required paths must exist, and the values of the
+// typed paths must have their type, one of TypeString, TypeNumber, TypeBool,
+// TypeObject and TypeArray. Null values have none of the types. The documents
+// already in the collection are not checked. Passing no required paths and no
+// types removes the schema.
+func (db *DB) SetSchema(collectionName string, required []string, types map[string]string) error {
+	collectionName = db.collection(collectionName)
+
+	for path, pathType := range types {
+		switch pathType {
+		case TypeString, TypeNumber, TypeBool, TypeObject, TypeArray:
+		default:
+			return fmt.Errorf("invalid type for %s: %s", path, pathType)
+		}
+	}
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	key := getMetadataKey(collectionName, schemaMetadata)
+
+	if len(required) == 0 && len(types) == 0 {
+		return db.index.Delete(key, db.writeOptions)
+	}
+
+	bs, err := json.Marshal(schema{Required: required, Types: types})
+	if err != nil {
+		return err
+	}
+
+	return db.index.Set(key, bs, db.writeOptions)
+}
+
+// getSchema returns the schema of a collection, or nil if it has none.
+func (db *DB) getSchema(collectionName string) (*schema, error) {
+	value, closer, err := db.index.Get(getMetadataKey(collectionName, schemaMetadata))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer closer.Close()
+
+	var s schema
+	if err := json.Unmarshal(value, &s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// validateDocument checks a document against the schema of its collection.
+// It returns an ErrInvalidDocument error describing the first violation. A
+// _deleted field is rejected in every collection, as it marks the soft-deleted
+// documents, which are left out of the queries and purged.
+func (db *DB) validateDocument(collectionName string, document Document) error {
+	if _, ok := document["_deleted"]; ok {
+		return fmt.Errorf("%w: _deleted is reserved for soft-deleted documents", ErrInvalidDocument)
+	}
+
+	s, err := db.getSchema(collectionName)
+	if err != nil || s == nil {
+		return err
+	}
+
+	for _, path := range s.Required {
+		if _, ok := getValueFromPath(document, path); !ok {
+			return fmt.Errorf("%w: %s is required", ErrInvalidDocument, path)
+		}
+	}
+
+	// Check the paths in order, so that the error is deterministic
+	paths := make([]string, 0, len(s.Types))
+	for path := range s.Types {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		value, ok := getValueFromPath(document, path)
+		if !ok {
+			continue
+		}
+
+		if !hasType(value, s.Types[path]) {
+			return fmt.Errorf("%w: %s is not a %s", ErrInvalidDocument, path, s.Types[path])
+		}
+	}
+
+	return nil
+}
+
+// hasType checks if a JSON-decoded value has a type of a schema.
+func hasType(value interface{}, pathType string) bool {
+	switch value.(type) {
+	case string:
+		return pathType == TypeString
+	case float64:
+		return pathType == TypeNumber
+	case bool:
+		return pathType == TypeBool
+	case map[string]interface{}:
+		return pathType == TypeObject
+	case []interface{}:
+		return pathType == TypeArray
+	}
+
+	return false
+}
+
+/****************
+ * Transactions
+****************/
+
+// Txn buffers inserts, updates, replacements and deletions, and writes them all
+// at once on Commit, or discards them on Rollback. Reads through the
+// transaction see its pending writes. If an operation of the transaction
+// fails, part of its writes may already be buffered, so the transaction should
+// be rolled back.
+//
+// A transaction holds the write lock of the database until it is committed or
+// rolled back, so other reads and writes of the database wait for it; calling
+// them from the goroutine of the transaction deadlocks. Each of the store, the
+// index and the full-text search index is written with a single atomic batch,
+// the indexes first. If the machine crashes in between, the indexes may hold
+// entries of the pending documents, which are skipped by queries, but they may
+// also miss the entries of the documents whose update, replacement or deletion
+// was pending, which are then not found through the indexes until
+// RebuildIndexes is called. Outside of a transaction, deletions write the
+// store first instead, which avoids the latter.
+type Txn struct {
+	db         *DB
+	storeBatch *pebble.Batch
+	indexBatch *pebble.Batch
+	ftsBatch   *pebble.Batch
+	done       bool
+}
+
+// Begin starts a transaction. It must be ended with Commit or Rollback.
+func (db *DB) Begin() (*Txn, error) {
+	if err := db.lock(); err != nil {
+		return nil, err
+	}
+
+	return &Txn{
+		db:         db,
+		storeBatch: db.store.NewIndexedBatch(),
+		indexBatch: db.index.NewIndexedBatch(),
+		ftsBatch:   db.fts.NewBatch(),
+	}, nil
+}
+
+// InsertOne inserts a document into a collection within the transaction, and
+// returns its generated ID.
+func (txn *Txn) InsertOne(collectionName string, document interface{}) (string, error) {
+	collectionName = txn.db.collection(collectionName)
+
+	if txn.done {
+		return "", ErrTxnDone
+	}
+
+	id, err := txn.db.newId(txn.indexBatch, collectionName)
+	if err != nil {
+		return "", err
+	}
+
+	key, bs, err := txn.db.prepareInsert(txn.storeBatch, txn.indexBatch, txn.ftsBatch, collectionName, id, document, false)
+	if err != nil {
+		return "", err
+	}
+
+	if err := txn.storeBatch.Set(key, bs, nil); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// FindOneById returns the document stored under the given ID, including the
+// pending writes of the transaction.
+func (txn *Txn) FindOneById(collectionName, id string) (Document, error) {
+	collectionName = txn.db.collection(collectionName)
+
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+
+	return getLiveDocument(txn.storeBatch, collectionName, id)
+}
+
+// ReplaceOneById replaces the entire document stored under the given ID within
+// the transaction, keeping the same _id.
+func (txn *Txn) ReplaceOneById(collectionName, id string, document interface{}) error {
+	collectionName = txn.db.collection(collectionName)
+
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	key, bs, err := txn.db.prepareReplace(txn.storeBatch, txn.indexBatch, txn.ftsBatch, collectionName, id, document)
+	if err != nil {
+		return err
+	}
+
+	return txn.storeBatch.Set(key, bs, nil)
+}
+
+// UpdateOneById applies the update operations to the document stored under
+// the given ID within the transaction, like DB.UpdateOneById, e.g. to
+// increment a counter along with an insert.
+func (txn *Txn) UpdateOneById(collectionName, id string, update UpdateOps) error {
+	collectionName = txn.db.collection(collectionName)
+
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	key, bs, err := txn.db.prepareUpdate(txn.storeBatch, txn.indexBatch, txn.ftsBatch, collectionName, id, update)
+	if err != nil {
+		return err
+	}
+
+	return txn.storeBatch.Set(key, bs, nil)
+}
+
+// DeleteOneById deletes the document stored under the given ID within the
+// transaction.
+func (txn *Txn) DeleteOneById(collectionName, id string) error {
+	collectionName = txn.db.collection(collectionName)
+
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	document, err := getLiveDocument(txn.storeBatch, collectionName, id)
+	if err != nil {
+		return err
+	}
+
+	if err := txn.db.prepareDelete(txn.indexBatch, txn.ftsBatch, collectionName, id, document); err != nil {
+		return err
+	}
+
+	softDelete, err := hasMetadata(txn.indexBatch, collectionName, softDeleteMetadata)
+	if err != nil {
+		return err
+	}
+
+	if softDelete {
+		bs, err := markDeleted(document)
+		if err != nil {
+			return err
+		}
+
+		return txn.storeBatch.Set(getDocumentKey(collectionName, id), bs, nil)
+	}
+
+	return txn.storeBatch.Delete(getDocumentKey(collectionName, id), nil)
+}
+
+// Commit writes the pending writes of the transaction and ends it.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.end()
+
+	// Like InsertOne, commit the index changes before the documents
+	if err := txn.db.commitIndexBatches(txn.indexBatch, txn.ftsBatch); err != nil {
+		return err
+	}
+
+	return txn.storeBatch.Commit(txn.db.writeOptions)
+}
+
+// Rollback discards the pending writes of the transaction and ends it. It does
+// nothing if the transaction is already done, so it can be deferred right
+// after Begin.
+func (txn *Txn) Rollback() error {
+	if txn.done {
+		return nil
+	}
+
+	return txn.end()
+}
+
+// end closes the batches and releases the write lock.
+func (txn *Txn) end() error {
+	txn.done = true
+	defer txn.db.mu.Unlock()
+
+	return errors.Join(txn.storeBatch.Close(), txn.indexBatch.Close(), txn.ftsBatch.Close())
+}
+
+/****************
+ * Index
+****************/
+
+// Index a document. The changes are written to the indexed batch, so that
+// path-value pairs repeated in the document see the pending changes. Nothing
+// is indexed if indexing is disabled for the collection.
+func (db *DB) indexDocument(batch *pebble.Batch, collectionName, id string, document Document) error {
+	indexed, err := isIndexed(batch, collectionName)
+	if err != nil || !indexed {
+		return err
+	}
+
+	delimiters, err := getDelimiters(batch, collectionName)
+	if err != nil {
+		return err
+	}
+
+	pv := getPathValues(document, "", delimiters)
+
+	// The paths of the partial indexes whose filter the document doesn't match
+	// are left out
+	partialIndexes, err := getPartialIndexes(batch, collectionName)
+	if err != nil {
+		return err
+	}
+
+	skippedPaths := map[string]bool{}
+	for path, index := range partialIndexes {
+		if !matchQuery(document, index.Filter, delimiters) {
+			skippedPaths[path] = true
+		}
+	}
+
+	for _, pathValue := range pv {
+		if skippedPaths[getPathOfPathValue(pathValue)] {
+			continue
+		}
+
+		if err := batch.Set(getIndexKey(collectionName, pathValue, id), nil, nil); err != nil {
+			return err
+		}
+	}
+
+	// Add the document to the numeric indexes
+	numericKeys, err := db.getNumericIndexKeys(collectionName, id, document)
+	if err != nil {
+		return err
+	}
+
+	for _, numericKey := range numericKeys {
+		if err := batch.Set(numericKey, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	// Add the document to the compound indexes
+	compoundKeys, err := db.getCompoundIndexKeys(collectionName, id, document)
+	if err != nil {
+		return err
+	}
+
+	for _, compoundKey := range compoundKeys {
+		if err := batch.Set(compoundKey, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CreateNumericIndex declares a numeric index on a path of a collection, so
+// that range conditions (>, >=, <, <=) on the path can be served by the index
+// instead of a full collection scan. The existing documents of the collection
+// are added to the new index.
+func (db *DB) CreateNumericIndex(collectionName, path string) error {
+	collectionName = db.collection(collectionName)
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	numericPaths, err := db.getNumericIndexPaths(collectionName)
+	if err != nil {
+		return err
+	}
+
+	if numericPaths[path] {
+		return nil
+	}
+	numericPaths[path] = true
+
+	batch := db.index.NewBatch()
+	defer batch.Close()
+
+	if err := setIndexPaths(batch, collectionName, numericIndexesMetadata, numericPaths); err != nil {
+		return err
+	}
+
+	// Add the existing documents to the new index
+	prefix := getCollectionPrefix(collectionName)
+	iter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document Document
+		if err := json.Unmarshal(iter.Value(), &document); err != nil {
+			return err
+		}
+
+		// Soft-deleted documents are left out of the indexes
+		if isDeleted(document) {
+			continue
+		}
+
+		_, id, _ := parseKey(iter.Key())
+
+		value, _ := getValueFromPath(document, path)
+		number, ok := toNumber(value)
+		if !ok {
+			continue
+		}
+
+		if err := batch.Set(getNumericIndexKey(collectionName, path, number, id), nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return batch.Commit(db.writeOptions)
+}
+
+// getNumericIndexPaths returns the paths of a collection with a numeric index.
+func (db *DB) getNumericIndexPaths(collectionName string) (map[string]bool, error) {
+	return db.getIndexPaths(collectionName, numericIndexesMetadata)
+}
+
+// getIndexPaths returns the paths of a collection recorded in the metadata
+// with the given name, e.g. the paths with a numeric index.
+func (db *DB) getIndexPaths(collectionName, name string) (map[string]bool, error) {
+	value, closer, err := db.index.Get(getMetadataKey(collectionName, name))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return map[string]bool{}, nil
+		}
+
+		return nil, err
+	}
+	defer closer.Close()
+
+	var paths []string
+	if err := json.Unmarshal(value, &paths); err != nil {
+		return nil, err
+	}
+
+	indexPaths := map[string]bool{}
+	for _, path := range paths {
+		indexPaths[path] = true
+	}
+
+	return indexPaths, nil
+}
+
+// setIndexPaths writes the paths of a collection to the metadata with the
+// given name, as a sorted JSON array.
+func setIndexPaths(batch *pebble.Batch, collectionName, name string, indexPaths map[string]bool) error {
+	paths := []string{}
+	for path := range indexPaths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	bs, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+
+	return batch.Set(getMetadataKey(collectionName, name), bs, nil)
+}
+
+// CreateIndex declares a compound index on two or more paths of a
+// collection. A query whose top-level AND groups contain EQ conditions on all
+// the paths of the index is looked up with a single probe of the compound
+// index, instead of intersecting the IDs found for each condition. The
+// existing documents of the collection are added to the new index.
+func (db *DB) CreateIndex(collectionName string, paths []string) error {
+	collectionName = db.collection(collectionName)
+
+	if len(paths) < 2 || len(paths) > math.MaxUint8 {
+		return fmt.Errorf("a compound index needs 2 to %d paths, got %d", math.MaxUint8, len(paths))
+	}
+
+	for i, path := range paths {
+		if slices.Contains(paths[:i], path) {
+			return fmt.Errorf("duplicate path in compound index: %s", path)
+		}
+	}
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	compoundIndexes, err := db.getCompoundIndexes(collectionName)
+	if err != nil {
+		return err
+	}
+
+	for _, indexPaths := range compoundIndexes {
+		if slices.Equal(indexPaths, paths) {
+			return nil
+		}
+	}
+	compoundIndexes = append(compoundIndexes, paths)
+
+	bs, err := json.Marshal(compoundIndexes)
+	if err != nil {
+		return err
+	}
+
+	batch := db.index.NewBatch()
+	defer batch.Close()
+
+	if err := batch.Set(getMetadataKey(collectionName, compoundIndexesMetadata), bs, nil); err != nil {
+		return err
+	}
+
+	// Add the existing documents to the new index
+	prefix := getCollectionPrefix(collectionName)
+	iter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document Document
+		if err := json.Unmarshal(iter.Value(), &document); err != nil {
+			return err
+		}
+
+		// Soft-deleted documents are left out of the indexes
+		if isDeleted(document) {
+			continue
+		}
+
+		_, id, _ := parseKey(iter.Key())
+
+		for _, pathValues := range getCompoundPathValues(document, paths) {
+			if err := batch.Set(getCompoundIndexKey(collectionName, pathValues, id), nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	return batch.Commit(db.writeOptions)
+}
+
+// getCompoundIndexes returns the paths of the compound indexes of a collection.
+func (db *DB) getCompoundIndexes(collectionName string) ([][]string, error) {
+	value, closer, err := db.index.Get(getMetadataKey(collectionName, compoundIndexesMetadata))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer closer.Close()
+
+	var compoundIndexes [][]string
+	if err := json.Unmarshal(value, &compoundIndexes); err != nil {
+		return nil, err
+	}
+
+	return compoundIndexes, nil
+}
+
+// getCompoundIndexKeys returns the compound index keys of a document, for
+// each compound index of the collection.
+func (db *DB) getCompoundIndexKeys(collectionName, id string, document Document) ([][]byte, error) {
+	compoundIndexes, err := db.getCompoundIndexes(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	for _, paths := range compoundIndexes {
+		for _, pathValues := range getCompoundPathValues(document, paths) {
+			keys = append(keys, getCompoundIndexKey(collectionName, pathValues, id))
+		}
+	}
+
+	return keys, nil
+}
+
+// getCompoundPathValues returns the combinations of the path-value pairs of a
+// document for the paths of a compound index. Like in the index, each scalar
+// element of an array is a value of the path of the array, so a document has
+// a combination for each element. Missing paths and paths whose value is an
+// object have no path-value pairs, so the document has no combinations.
+func getCompoundPathValues(document Document, paths []string) [][]string {
+	combinations := [][]string{{}}
+
+	for _, path := range paths {
+		value, ok := getValueFromPath(document, path)
+		if !ok {
+			return nil
+		}
+
+		elements, isArray := value.([]interface{})
+		if !isArray {
+			elements = []interface{}{value}
+		}
+
+		var next [][]string
+		for _, combination := range combinations {
+			for _, element := range elements {
+				switch element.(type) {
+				case map[string]interface{}, []interface{}:
+					continue
+				}
+
+				next = append(next, append(slices.Clip(combination), buildPathValue(path, element)))
+			}
+		}
+		combinations = next
+	}
+
+	return combinations
+}
+
+// findCompoundIndex returns the compound index with the most paths whose
+// paths are all covered by the EQ conditions of the top-level AND groups of
+// the query, along with the conditions used for its paths, by their positions
+// in the query. It returns nil if no compound index can be used.
+func findCompoundIndex(query Query, compoundIndexes [][]string) ([]string, map[[2]int]bool) {
+	// The first EQ condition on each path. Case-insensitive and negated
+	// conditions can't be looked up in the compound index, which holds the
+	// values as is.
+	eqConditions := map[string][2]int{}
+	for i, topOperand := range query {
+		if topOperand.Operator == OR {
+			continue
+		}
+
+		for j, operand := range topOperand.Operands {
+			if operand.Operator != EQ || operand.CaseInsensitive || operand.Negate || hasObjectValue(operand) {
+				continue
+			}
+
+			if _, ok := eqConditions[operand.Path]; !ok {
+				eqConditions[operand.Path] = [2]int{i, j}
+			}
+		}
+	}
+
+	var bestPaths []string
+	for _, paths := range compoundIndexes {
+		covered := true
+		for _, path := range paths {
+			if _, ok := eqConditions[path]; !ok {
+				covered = false
+				break
+			}
+		}
+
+		if covered && len(paths) > len(bestPaths) {
+			bestPaths = paths
+		}
+	}
+
+	if bestPaths == nil {
+		return nil, nil
+	}
+
+	used := map[[2]int]bool{}
+	for _, path := range bestPaths {
+		used[eqConditions[path]] = true
+	}
+
+	return bestPaths, used
+}
+
+// getIdsFromCompoundIndex returns the IDs of the documents matching the EQ
+// conditions on the paths of a compound index, given in the order of the
+// paths, by iterating the keys with the path-value pairs of the conditions.
+func (db *DB) getIdsFromCompoundIndex(collectionName string, conditions []Condition) (map[string]bool, error) {
+	pathValues := make([]string, len(conditions))
+	for i, condition := range conditions {
+		pathValues[i] = buildPathValue(condition.Path, condition.Value)
+	}
+
+	prefix := getCompoundIndexPrefix(collectionName, pathValues)
+	iter := db.index.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	matchedIds := map[string]bool{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		matchedIds[string(iter.Key()[len(prefix):])] = true
+	}
+
+	if db.logger != nil {
+		db.logger.Debug("compound index probe", logAttrs(collectionName, "keys", pathValues, "ids", len(matchedIds))...)
+	}
+
+	return matchedIds, iter.Error()
+}
+
+// CreateUniqueIndex declares a unique index on a path of a collection, so that
+// inserting or replacing a document fails with ErrDuplicateKey if another
+// document of the collection has the same value at the path. Each element of
+// an array is constrained like a value, and documents without a value at the
+// path are not constrained. It fails with ErrDuplicateKey if the existing
+// documents already have duplicate values, and with ErrIndexingRequired if the
+// indexing of the collection is disabled.
+func (db *DB) CreateUniqueIndex(collectionName, path string) error {
+	collectionName = db.collection(collectionName)
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	indexed, err := isIndexed(db.index, collectionName)
+	if err != nil {
+		return err
+	}
+
+	if !indexed {
+		return fmt.Errorf("%w: indexing is disabled", ErrIndexingRequired)
+	}
+
+	uniquePaths, err := db.getIndexPaths(collectionName, uniqueIndexesMetadata)
+	if err != nil {
+		return err
+	}
+
+	if uniquePaths[path] {
+		return nil
+	}
+	uniquePaths[path] = true
+
+	// Check the existing documents for duplicate values
+	prefix := getCollectionPrefix(collectionName)
+	iter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	seen := map[string]string{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document Document
+		if err := json.Unmarshal(iter.Value(), &document); err != nil {
+			return err
+		}
+
+		// Soft-deleted documents are left out of the indexes
+		if isDeleted(document) {
+			continue
+		}
+
+		_, id, _ := parseKey(iter.Key())
+
+		for _, pathValue := range getUniquePathValues(document, path) {
+			if otherId, ok := seen[pathValue]; ok && otherId != id {
+				return fmt.Errorf("%w: %s in %s and %s", ErrDuplicateKey, pathValue, otherId, id)
+			}
+			seen[pathValue] = id
+		}
+	}
+
+	batch := db.index.NewBatch()
+	defer batch.Close()
+
+	if err := setIndexPaths(batch, collectionName, uniqueIndexesMetadata, uniquePaths); err != nil {
+		return err
+	}
+
+	return batch.Commit(db.writeOptions)
+}
+
+// getUniquePathValues returns the path-value pairs of the scalar values at a
+// path of a document, which are constrained by a unique index on the path.
+func getUniquePathValues(document Document, path string) []string {
+	value, _ := getValueFromPath(document, path)
+
+	elements, isArray := value.([]interface{})
+	if !isArray {
+		elements = []interface{}{value}
+	}
+
+	var pvs []string
+	for _, element := range elements {
+		switch element.(type) {
+		case nil, map[string]interface{}, []interface{}:
+			continue
+		}
+
+		pvs = append(pvs, buildPathValue(path, element))
+	}
+
+	return pvs
+}
+
+// getUniqueIndexPaths returns the sorted paths of the unique indexes of a
+// collection, including the unique partial indexes.
+func (db *DB) getUniqueIndexPaths(collectionName string) ([]string, error) {
+	uniquePaths, err := db.getIndexPaths(collectionName, uniqueIndexesMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	partialIndexes, err := getPartialIndexes(db.index, collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	for path, index := range partialIndexes {
+		if index.Unique {
+			uniquePaths[path] = true
+		}
+	}
+
+	paths := make([]string, 0, len(uniquePaths))
+	for path := range uniquePaths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// checkUniqueIndexes returns ErrDuplicateKey if another document of the
+// collection has the same value as the document at a path with a unique index.
+// The index is read through the batch and the store through the given reader,
+// so that the pending changes are seen.
+func (db *DB) checkUniqueIndexes(store pebble.Reader, batch *pebble.Batch, collectionName, id string, document Document) error {
+	uniquePaths, err := db.getIndexPaths(collectionName, uniqueIndexesMetadata)
+	if err != nil {
+		return err
+	}
+
+	// Unique partial indexes only constrain the documents matching their filter
+	partialIndexes, err := getPartialIndexes(batch, collectionName)
+	if err != nil {
+		return err
+	}
+
+	if len(partialIndexes) > 0 {
+		delimiters, err := getDelimiters(batch, collectionName)
+		if err != nil {
+			return err
+		}
+
+		for path, index := range partialIndexes {
+			if index.Unique && matchQuery(document, index.Filter, delimiters) {
+				uniquePaths[path] = true
+			}
+		}
+	}
+
+	for path := range uniquePaths {
+		for _, pathValue := range getUniquePathValues(document, path) {
+			ids, err := getIndexedIds(batch, collectionName, pathValue)
+			if err != nil {
+				return err
+			}
+
+			for _, existingId := range ids {
+				if existingId == id {
+					continue
+				}
+
+				// The index may refer to a document that no longer exists
+				exists, err := documentExists(store, collectionName, existingId)
+				if err != nil {
+					return err
+				}
+
+				if exists {
+					return fmt.Errorf("%w: %s in %s", ErrDuplicateKey, pathValue, existingId)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// PartialIndex restricts the index of a path to the documents matching a
+// filter, e.g. to only index the emails of the active users.
+type PartialIndex struct {
+	Path   string
+	Filter Query
+	Unique bool // Whether the documents matching the filter must have distinct values at the path
+}
+
+// CreatePartialIndex restricts the index entries of a path of a collection to
+// the documents matching the filter of the index, which keeps the index small
+// when few documents are queried by the path. A unique partial index only
+// constrains the documents matching the filter, e.g. the emails of the active
+// users, and fails with ErrDuplicateKey if the existing documents matching the
+// filter already have duplicate values, and with ErrIndexingRequired if the
+// indexing of the collection is disabled. Creating a partial index on a path
+// with one replaces it, and the entries of the existing documents are updated.
+//
+// EQ and IN conditions on the path are only looked up in the index when the
+// query implies the filter, i.e. when its top-level groups contain the
+// conditions of the filter. Otherwise, they are checked against the documents
+// found by the other conditions, or by a full collection scan.
+func (db *DB) CreatePartialIndex(collectionName string, index PartialIndex) error {
+	collectionName = db.collection(collectionName)
+
+	if index.Path == "" {
+		return fmt.Errorf("%w: partial index with an empty path", ErrInvalidQuery)
+	}
+
+	if len(index.Filter) == 0 {
+		return ErrNilQuery
+	}
+
+	if err := ValidateQuery(index.Filter); err != nil {
+		return err
+	}
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	batch := db.index.NewIndexedBatch()
+	defer batch.Close()
+
+	partialIndexes, err := getPartialIndexes(batch, collectionName)
+	if err != nil {
+		return err
+	}
+	partialIndexes[index.Path] = index
+
+	bs, err := json.Marshal(partialIndexes)
+	if err != nil {
+		return err
+	}
+
+	if err := batch.Set(getMetadataKey(collectionName, partialIndexesMetadata), bs, nil); err != nil {
+		return err
+	}
+
+	indexed, err := isIndexed(batch, collectionName)
+	if err != nil {
+		return err
+	}
+
+	if index.Unique && !indexed {
+		return fmt.Errorf("%w: indexing is disabled", ErrIndexingRequired)
+	}
+
+	delimiters, err := getDelimiters(batch, collectionName)
+	if err != nil {
+		return err
+	}
+
+	// Update the entries of the path of the existing documents, and check
+	// those matching the filter for duplicate values
+	prefix := getCollectionPrefix(collectionName)
+	iter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	seen := map[string]string{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document Document
+		if err := json.Unmarshal(iter.Value(), &document); err != nil {
+			return err
+		}
+
+		// Soft-deleted documents are left out of the indexes
+		if isDeleted(document) {
+			continue
+		}
+
+		_, id, _ := parseKey(iter.Key())
+		matched := matchQuery(document, index.Filter, delimiters)
+
+		if index.Unique && matched {
+			for _, pathValue := range getUniquePathValues(document, index.Path) {
+				if otherId, ok := seen[pathValue]; ok && otherId != id {
+					return fmt.Errorf("%w: %s in %s and %s", ErrDuplicateKey, pathValue, otherId, id)
+				}
+				seen[pathValue] = id
+			}
+		}
+
+		if !indexed {
+			continue
+		}
+
+		for _, pathValue := range getPathValues(document, "", delimiters) {
+			if getPathOfPathValue(pathValue) != index.Path {
+				continue
+			}
+
+			key := getIndexKey(collectionName, pathValue, id)
+			if matched {
+				err = batch.Set(key, nil, nil)
+			} else {
+				err = batch.Delete(key, nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return batch.Commit(db.writeOptions)
+}
+
+// getPartialIndexes returns the partial indexes of a collection by path.
+func getPartialIndexes(reader pebble.Reader, collectionName string) (map[string]PartialIndex, error) {
+	value, closer, err := reader.Get(getMetadataKey(collectionName, partialIndexesMetadata))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return map[string]PartialIndex{}, nil
+		}
+
+		return nil, err
+	}
+	defer closer.Close()
+
+	partialIndexes := map[string]PartialIndex{}
+	if err := json.Unmarshal(value, &partialIndexes); err != nil {
+		return nil, err
+	}
+
+	return partialIndexes, nil
+}
+
+// getPathOfPathValue returns the path of a path-value pair, folded or not.
+func getPathOfPathValue(pathValue string) string {
+	path, _, _ := splitPathValue(strings.TrimPrefix(pathValue, "\x01"))
+	return path
+}
+
+// hidePartialConditions returns the query with the EQ and IN conditions on the
+// paths of partial indexes wrapped in nested groups, so that they are checked
+// against the documents instead of looked up in the index, which lacks the
+// documents not matching the filter of the index. The conditions are kept as
+// they are when the query implies the filter.
+func hidePartialConditions(query Query, partialIndexes map[string]PartialIndex) Query {
+	if len(partialIndexes) == 0 {
+		return query
+	}
+
+	planned := make(Query, len(query))
+	for i, topOperand := range query {
+		planned[i].Operator = topOperand.Operator
+		planned[i].Operands = make([]Condition, len(topOperand.Operands))
+
+		for j, operand := range topOperand.Operands {
+			index, ok := partialIndexes[operand.Path]
+			if ok && isIndexableOperator(operand.Operator) && !impliesFilter(query, index.Filter) {
+				operand = Condition{Operator: AND, Operands: []Condition{operand}}
+			}
+
+			planned[i].Operands[j] = operand
+		}
+	}
+
+	return planned
+}
+
+// impliesFilter checks if every document matching the query matches the
+// filter, as far as can be told from the conditions of their top-level groups:
+// each condition of an AND group of the filter has to be in an AND group of
+// the query, and each OR group of the filter has one of its conditions in an
+// AND group of the query, or all the conditions of an OR group of the query.
+func impliesFilter(query Query, filter Query) bool {
+	for _, filterGroup := range filter {
+		if filterGroup.Operator == AND {
+			for _, condition := range filterGroup.Operands {
+				if !hasANDCondition(query, condition) {
+					return false
+				}
+			}
+			continue
+		}
+
+		implied := false
+		for _, topOperand := range query {
+			if topOperand.Operator == AND {
+				implied = slices.ContainsFunc(topOperand.Operands, func(condition Condition) bool {
+					return containsCondition(filterGroup.Operands, condition)
+				})
+			} else {
+				implied = !slices.ContainsFunc(topOperand.Operands, func(condition Condition) bool {
+					return !containsCondition(filterGroup.Operands, condition)
+				})
+			}
+
+			if implied {
+				break
+			}
+		}
+
+		if !implied {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasANDCondition checks if a condition is in a top-level AND group of a query.
+func hasANDCondition(query Query, condition Condition) bool {
+	for _, topOperand := range query {
+		if topOperand.Operator == AND && containsCondition(topOperand.Operands, condition) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsCondition(conditions []Condition, condition Condition) bool {
+	return slices.ContainsFunc(conditions, func(other Condition) bool {
+		return sameCondition(other, condition)
+	})
+}
+
+// sameCondition checks if two conditions are the same, comparing their values
+// like equalValues, since the values of the filters are stored as JSON.
+func sameCondition(a, b Condition) bool {
+	if a.Path != b.Path || a.Operator != b.Operator || a.Negate != b.Negate || a.CaseInsensitive != b.CaseInsensitive {
+		return false
+	}
+
+	if !slices.EqualFunc(a.Operands, b.Operands, sameCondition) {
+		return false
+	}
+
+	return isGroupCondition(a) || sameValue(a.Value, b.Value)
+}
+
+func sameValue(a, b interface{}) bool {
+	leftList, leftIsList := a.([]interface{})
+	rightList, rightIsList := b.([]interface{})
+	if leftIsList || rightIsList {
+		return leftIsList && rightIsList && slices.EqualFunc(leftList, rightList, sameValue)
+	}
+
+	return equalValues(a, b, false)
+}
+
+// getNumericIndexKeys returns the numeric index keys of a document, one for
+// each path with a numeric index whose value in the document is a number.
+func (db *DB) getNumericIndexKeys(collectionName, id string, document Document) ([][]byte, error) {
+	numericPaths, err := db.getNumericIndexPaths(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	for path := range numericPaths {
+		value, _ := getValueFromPath(document, path)
+
+		// Index each number of an array, as range conditions match arrays
+		// by element
+		values, isArray := value.([]interface{})
+		if !isArray {
+			values = []interface{}{value}
+		}
+
+		for _, value := range values {
+			number, ok := toNumber(value)
+			if !ok {
+				continue
+			}
+
+			keys = append(keys, getNumericIndexKey(collectionName, path, number, id))
+		}
+	}
+
+	return keys, nil
+}
+
+// getIdsFromNumericIndex returns the IDs of the documents whose value at the
+// path of a range condition is within the bound of the condition, by iterating
+// the bounded key range of the numeric index. The bound is inclusive, so the
+// documents still have to be checked against the condition.
+func (db *DB) getIdsFromNumericIndex(collectionName string, condition Condition) (map[string]bool, error) {
+	low, high, err := getNumericBounds(condition)
+	if err != nil {
+		return nil, err
+	}
+
+	pathPrefix := getNumericIndexPrefix(collectionName, condition.Path)
+	lowerBound := pathPrefix
+	upperBound := prefixUpperBound(pathPrefix)
+
+	if !math.IsInf(low, -1) {
+		lowerBound = append(append([]byte(nil), pathPrefix...), encodeNumber(low)...)
+	}
+	if !math.IsInf(high, 1) {
+		upperBound = prefixUpperBound(append(append([]byte(nil), pathPrefix...), encodeNumber(high)...))
+	}
+
+	iter := db.index.NewIter(&pebble.IterOptions{
+		LowerBound: lowerBound,
+		UpperBound: upperBound,
+	})
+	defer iter.Close()
+
+	matchedIds := map[string]bool{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if len(key) < len(pathPrefix)+8 {
+			continue
+		}
+
+		matchedIds[string(key[len(pathPrefix)+8:])] = true
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	if db.logger != nil {
+		db.logger.Debug("numeric index probe", logAttrs(collectionName, "path", condition.Path, "low", low, "high", high, "ids", len(matchedIds))...)
+	}
+
+	return matchedIds, nil
+}
+
+// IndexStats returns the number of distinct values indexed for each path of a
+// collection, e.g. to decide which paths are worth querying by. A path with
+// few distinct values is shared by many documents, so a condition on it
+// narrows down the candidates less. The elements of arrays count as values of
+// the path of the array.
+func (db *DB) IndexStats(collectionName string) (map[string]int, error) {
+	collectionName = db.collection(collectionName)
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	prefix := getCollectionPrefix(collectionName)
+	iter := db.index.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	stats := map[string]int{}
+	previous := ""
+	for iter.First(); iter.Valid(); iter.Next() {
+		// Skip the numeric and compound index keys, and the folded pairs
+		pathValue, _, ok := parseIndexKey(iter.Key()[len(prefix):])
+		if !ok || strings.HasPrefix(pathValue, "\x01") {
+			continue
+		}
+
+		// The keys of the documents with the same pair are next to each other
+		if pathValue == previous {
+			continue
+		}
+		previous = pathValue
+
+		path, _, ok := splitPathValue(pathValue)
+		if !ok {
+			continue
+		}
+
+		stats[path]++
+	}
+
+	return stats, iter.Error()
+}
+
+// LookupIndex returns the IDs of the documents of a collection with each of
+// the values at a path, as found in the index, e.g. to join the documents of
+// another collection referring to them. The lists of IDs are in the same order
+// as the values, with an empty list for a value without documents. As in the
+// index, e.g. true is kept apart from "true", and nil apart from "<nil>". IDs
+// left in the index by documents that no longer exist are skipped. Like with
+// EQ conditions, numbers are found whether they are given as ints, floats or
+// json.Numbers. No IDs are found if indexing is disabled for the collection,
+// and a partial index only has the documents matching its filter.
+func (db *DB) LookupIndex(collectionName string, path string, values []interface{}) ([][]string, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	found := make([][]string, len(values))
+	foundByPathValue := map[string][]string{} // A value given more than once is looked up once
+	matched := 0
+	for i, value := range values {
+		pathValue := buildPathValue(path, value)
+		if ids, ok := foundByPathValue[pathValue]; ok {
+			found[i] = slices.Clone(ids)
+			matched += len(ids)
+			continue
+		}
+
+		ids, err := getIndexedIds(db.index, collectionName, pathValue)
+		if err != nil {
+			db.observeQuery("LookupIndex", start, matched)
+			return nil, err
+		}
+
+		liveIds := []string{}
+		for _, id := range ids {
+			exists, err := documentExists(db.store, collectionName, id)
+			if err != nil {
+				db.observeQuery("LookupIndex", start, matched)
+				return nil, err
+			}
+
+			if exists {
+				liveIds = append(liveIds, id)
+			}
+		}
+
+		found[i] = liveIds
+		foundByPathValue[pathValue] = liveIds
+		matched += len(liveIds)
+	}
+	db.observeQuery("LookupIndex", start, matched)
+
+	return found, nil
+}
+
+// SetIndexing sets whether the documents of a collection are indexed, which
+// it is by default. Maintaining the index slows down every write, so a
+// write-heavy collection that is rarely queried by field can do without it.
+// Without an index, queries always scan the full collection; documents can
+// still be looked up by ID. The unique indexes are enforced through the index,
+// so disabling it fails with ErrIndexingRequired if the collection has one. The
+// entries of the collection are removed from the index when it is disabled,
+// and the documents are indexed again when it is enabled. The full-text
+// search index is not affected.
+func (db *DB) SetIndexing(collectionName string, enabled bool) error {
+	collectionName = db.collection(collectionName)
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	indexed, err := isIndexed(db.index, collectionName)
+	if err != nil {
+		return err
+	}
+
+	if indexed == enabled {
+		return nil
+	}
+
+	if !enabled {
+		uniquePaths, err := db.getUniqueIndexPaths(collectionName)
+		if err != nil {
+			return err
+		}
+
+		if len(uniquePaths) > 0 {
+			return fmt.Errorf("%w: unique indexes on %s", ErrIndexingRequired, strings.Join(uniquePaths, ", "))
+		}
+	}
+
+	prefix := getCollectionPrefix(collectionName)
+	key := getMetadataKey(collectionName, noIndexMetadata)
+
+	batch := db.index.NewIndexedBatch()
+	defer batch.Close()
+
+	// Remove the entries of the collection from the index, including those
+	// written by the index declarations while indexing was disabled
+	if err := deletePrefix(db.index, batch, prefix); err != nil {
+		return err
+	}
+
+	if !enabled {
+		if err := batch.Set(key, nil, nil); err != nil {
+			return err
+		}
+
+		return batch.Commit(db.writeOptions)
+	}
+
+	if err := batch.Delete(key, nil); err != nil {
+		return err
+	}
+
+	if err := db.indexDocuments(batch, collectionName); err != nil {
+		return err
+	}
+
+	return batch.Commit(db.writeOptions)
+}
+
+// indexDocuments indexes every document of a collection in the indexed batch.
+func (db *DB) indexDocuments(batch *pebble.Batch, collectionName string) error {
+	prefix := getCollectionPrefix(collectionName)
+	iter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document Document
+		if err := json.Unmarshal(iter.Value(), &document); err != nil {
+			return err
+		}
+
+		// Soft-deleted documents are left out of the indexes
+		if isDeleted(document) {
+			continue
+		}
+
+		_, id, _ := parseKey(iter.Key())
+
+		if err := db.indexDocument(batch, collectionName, id, document); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// reindexCollections rebuilds the index of every collection whose documents
+// are under the prefix, including the collections of nested namespaces, e.g.
+// to convert the index entries written by an earlier version. The full-text
+// search index is left as is.
+func (db *DB) reindexCollections(prefix []byte) error {
+	collectionNames, err := getCollectionNames(db.store, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, collectionName := range collectionNames {
+		if err := db.reindexCollection(collectionName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getCollectionNames returns the names of the collections with documents
+// under the prefix, qualified with their namespace, including those of the
+// nested namespaces.
+func getCollectionNames(store pebble.Reader, prefix []byte) ([]string, error) {
+	iter := store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	var collectionNames []string
+	for valid := iter.First(); valid; {
+		collectionName, _, ok := parseKey(iter.Key())
+		if !ok {
+			valid = iter.Next()
+			continue
+		}
+
+		collectionNames = append(collectionNames, collectionName)
+
+		// Skip the rest of the documents of the collection
+		upperBound := prefixUpperBound(getCollectionPrefix(collectionName))
+		if upperBound == nil {
+			break
+		}
+		valid = iter.SeekGE(upperBound)
+	}
+
+	return collectionNames, iter.Error()
+}
+
+// reindexCollection replaces the index entries of a collection with those of
+// its documents.
+func (db *DB) reindexCollection(collectionName string) error {
+	batch := db.index.NewIndexedBatch()
+	defer batch.Close()
+
+	if err := deletePrefix(db.index, batch, getCollectionPrefix(collectionName)); err != nil {
+		return err
+	}
+
+	if err := db.indexDocuments(batch, collectionName); err != nil {
+		return err
+	}
+
+	return batch.Commit(db.writeOptions)
+}
+
+// upgradeIndex upgrades the indexes if they were written by an earlier
+// version, so that queries and searches don't miss the documents of the
+// entries in an earlier layout, and records the current version. A read-only
+// index can't be upgraded, so ErrIndexOutdated is returned instead.
+func (db *DB) upgradeIndex() error {
+	version := 1
+	value, closer, err := db.index.Get(indexVersionKey)
+	if err == nil {
+		version, err = strconv.Atoi(string(value))
+		closer.Close()
+		if err != nil {
+			return ErrIndexVersion
+		}
+	} else if err != pebble.ErrNotFound {
+		return err
+	}
+
+	if version == indexVersion {
+		return nil
+	}
+	if version > indexVersion {
+		return ErrIndexVersion
+	}
+
+	// An empty store has no index to upgrade
+	iter := db.store.NewIter(nil)
+	empty := !iter.First()
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if db.readOnly {
+		if empty {
+			return nil
+		}
+		return ErrIndexOutdated
+	}
+
+	if !empty {
+		if err := db.upgradeCollections(nil, version); err != nil {
+			return err
+		}
+	}
+
+	return setIndexVersion(db.index, db.writeOptions)
+}
+
+// upgradeCollections converts the indexes of the collections under the
+// prefix, written by an earlier version, into the current layout.
+func (db *DB) upgradeCollections(prefix []byte, version int) error {
+	// The index entries of the earlier layouts are rebuilt from the documents
+	if version < 2 {
+		if err := db.reindexCollections(prefix); err != nil {
+			return err
+		}
+	}
+
+	collectionNames, err := getCollectionNames(db.store, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, collectionName := range collectionNames {
+		// The full-text search entries can't be rebuilt without the struct
+		// types of the documents, so their posting lists are converted instead
+		if version < 3 {
+			if err := db.fts.UpgradePostingLists(collectionName); err != nil {
+				return err
+			}
+		}
+
+		// Likewise, the tokens indexed before they were folded of their
+		// accents can't be folded, so their collections are marked as stale
+		// until they are rebuilt
+		if version < 4 {
+			if err := db.fts.MarkUnrecordedStale(collectionName); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// setIndexVersion records the current version of the layout of the index.
+func setIndexVersion(index *pebble.DB, writeOptions *pebble.WriteOptions) error {
+	return index.Set(indexVersionKey, []byte(strconv.Itoa(indexVersion)), writeOptions)
+}
+
+// isIndexed reports whether the documents of a collection are indexed.
+func isIndexed(reader pebble.Reader, collectionName string) (bool, error) {
+	disabled, err := hasMetadata(reader, collectionName, noIndexMetadata)
+	return !disabled, err
+}
+
+// SetDelimiter splits the string values at a dot-separated path of the
+// collection on the delimiter, e.g. "," for tags stored as "a,b,c", and
+// indexes each part, trimmed of spaces, as a separate value. A condition on
+// the path then matches a document if the whole string or any of its parts
+// matches, e.g. an EQ condition on "b", which gives lightweight set
+// membership without full-text search. An empty delimiter stops splitting the
+// values. Struct documents can set the delimiter of a string field with a
+// tag instead, e.g. `objectdb:"split=,"`. The existing documents of the
+// collection are indexed again.
+func (db *DB) SetDelimiter(collectionName, path, delimiter string) error {
+	collectionName = db.collection(collectionName)
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	batch := db.index.NewIndexedBatch()
+	defer batch.Close()
+
+	delimiters, err := getDelimiters(batch, collectionName)
+	if err != nil {
+		return err
+	}
+
+	if delimiters[path] == delimiter {
+		return nil
+	}
+
+	// Collect the existing documents, to swap their index entries for the
+	// entries with the new delimiter
+	var ids []string
+	var documents []Document
+
+	prefix := getCollectionPrefix(collectionName)
+	iter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document Document
+		if err := json.Unmarshal(iter.Value(), &document); err != nil {
+			return err
+		}
+
+		// Soft-deleted documents are left out of the indexes
+		if isDeleted(document) {
+			continue
+		}
+
+		_, id, _ := parseKey(iter.Key())
+		ids = append(ids, id)
+		documents = append(documents, document)
+	}
+
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	for i, document := range documents {
+		if err := db.deleteDocumentFromIndex(batch, collectionName, ids[i], document); err != nil {
+			return err
+		}
+	}
+
+	if delimiter == "" {
+		delete(delimiters, path)
+	} else {
+		delimiters[path] = delimiter
+	}
+
+	if err := setDelimiters(batch, collectionName, delimiters); err != nil {
+		return err
+	}
+
+	for i, document := range documents {
+		if err := db.indexDocument(batch, collectionName, ids[i], document); err != nil {
+			return err
+		}
+	}
+
+	return batch.Commit(db.writeOptions)
+}
+
+// getDelimiters returns the delimiters of the paths of a collection whose
+// string values are split into parts, by path.
+func getDelimiters(reader pebble.Reader, collectionName string) (map[string]string, error) {
+	value, closer, err := reader.Get(getMetadataKey(collectionName, delimitersMetadata))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return map[string]string{}, nil
+		}
+
+		return nil, err
+	}
+	defer closer.Close()
+
+	delimiters := map[string]string{}
+	if err := json.Unmarshal(value, &delimiters); err != nil {
+		return nil, err
+	}
+
+	return delimiters, nil
+}
+
+// setDelimiters writes the delimiters of the paths of a collection to the
+// metadata, or deletes the metadata if there are none.
+func setDelimiters(batch *pebble.Batch, collectionName string, delimiters map[string]string) error {
+	key := getMetadataKey(collectionName, delimitersMetadata)
+	if len(delimiters) == 0 {
+		return batch.Delete(key, nil)
+	}
+
+	bs, err := json.Marshal(delimiters)
+	if err != nil {
+		return err
+	}
+
+	return batch.Set(key, bs, nil)
+}
+
+// recordSplitTags records the delimiters set by the split tags of a struct
+// document, so that they also apply when the document is stored as a map,
+// e.g. when it is deleted. The documents already indexed with another
+// delimiter are not indexed again.
+func recordSplitTags(batch *pebble.Batch, collectionName string, v reflect.Value) error {
+	tags := map[string]string{}
+	getSplitTags(v, "", tags)
+	if len(tags) == 0 {
+		return nil
+	}
+
+	delimiters, err := getDelimiters(batch, collectionName)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for path, delimiter := range tags {
+		if delimiters[path] != delimiter {
+			delimiters[path] = delimiter
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return setDelimiters(batch, collectionName, delimiters)
+}
+
+// getSplitTags adds the delimiters set by the split tags of the fields of a
+// struct, including those of nested structs, to tags by the dot-separated
+// path of the field in the JSON representation. Values that are not structs
+// have no tags.
+func getSplitTags(v reflect.Value, prefix string, tags map[string]string) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() && !field.Anonymous {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		// The fields of an embedded struct without a JSON name are promoted
+		path := prefix
+		if !field.Anonymous || name != "" {
+			if name == "" {
+				name = field.Name
+			}
+			path = prefix + name
+		}
+
+		for _, tag := range strings.Split(field.Tag.Get("objectdb"), ";") {
+			if delimiter, ok := strings.CutPrefix(tag, "split="); ok && delimiter != "" {
+				tags[path] = delimiter
+			}
+		}
+
+		if path == prefix {
+			getSplitTags(v.Field(i), prefix, tags)
+		} else {
+			getSplitTags(v.Field(i), path+".", tags)
+		}
+	}
+}
+
+// RebuildIndexes rebuilds the index and the full-text search index of a
+// collection from the documents in the store, e.g. to repair the indexes after
+// a crash. The entries of the collection are removed from the indexes before
+// every document is indexed again.
+//
+// The full-text search index is rebuilt on the text fields recorded for the
+// collection, i.e. the fields tagged with textIndex in the documents inserted
+// so far and the fields added with AddTextFields. Alternatively, pass a value
+// of the struct type of the documents (e.g. Restaurant{}) as documentType to
+// index them on its textIndex struct tags instead; each document is decoded
+// into that type before it is indexed. The split tags of the type are
+// recorded for the collection as well.
+func (db *DB) RebuildIndexes(collectionName string, documentType ...interface{}) error {
+	collectionName = db.collection(collectionName)
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	prefix := getCollectionPrefix(collectionName)
+
+	indexBatch := db.index.NewIndexedBatch()
+	defer indexBatch.Close()
+
+	ftsBatch := db.fts.NewBatch()
+	defer ftsBatch.Close()
+
+	// Remove the entries of the collection from the indexes
+	if err := deletePrefix(db.index, indexBatch, prefix); err != nil {
+		return err
+	}
+
+	var textIndexType reflect.Type
+	if len(documentType) > 0 && documentType[0] != nil {
+		textIndexType = reflect.TypeOf(documentType[0])
+		if textIndexType.Kind() == reflect.Ptr {
+			textIndexType = textIndexType.Elem()
+		}
+	}
+
+	if err := db.fts.ClearCollectionBatch(ftsBatch, collectionName); err != nil {
+		return err
+	}
+
+	if textIndexType != nil {
+		if err := recordSplitTags(indexBatch, collectionName, reflect.New(textIndexType)); err != nil {
+			return err
+		}
+	}
+
+	// Index every document of the collection again
+	iter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document Document
+		if err := json.Unmarshal(iter.Value(), &document); err != nil {
+			return err
+		}
+
+		// Soft-deleted documents are left out of the indexes
+		if isDeleted(document) {
+			continue
+		}
+
+		_, id, _ := parseKey(iter.Key())
+
+		if err := db.indexDocument(indexBatch, collectionName, id, document); err != nil {
+			return err
+		}
+
+		// Maps are indexed on the text fields recorded for the collection
+		var textDocument interface{} = document
+		if textIndexType != nil {
+			typedDocument := reflect.New(textIndexType)
+			if err := Unmarshal(document, typedDocument.Interface()); err != nil {
+				return err
+			}
+			textDocument = typedDocument.Elem().Interface()
+		}
+
+		if err := db.fts.AddToIndexBatch(ftsBatch, collectionName, id, textDocument); err != nil {
+			return err
+		}
+	}
+
+	return db.commitIndexBatches(indexBatch, ftsBatch)
+}
+
+// VacuumIndex removes the IDs of the documents that no longer exist from the
+// index of a collection, and returns the number of removed IDs. Such IDs are
+// left behind by a crash between the index changes of a write and the write
+// itself; queries skip them, but still look their documents up. The IDs of
+// soft-deleted documents are removed as well, as they are left out of the
+// index. Unlike RebuildIndexes, the entries of the existing documents are
+// kept as they are, except that the lists of IDs of the index entries written
+// by earlier versions are converted into the current entries.
+func (db *DB) VacuumIndex(collectionName string) (int, error) {
+	collectionName = db.collection(collectionName)
+
+	if err := db.lock(); err != nil {
+		return 0, err
+	}
+	defer db.mu.Unlock()
+
+	prefix := getCollectionPrefix(collectionName)
+
+	// Collect the IDs of the existing documents, and the numeric and compound
+	// index keys they have, as those keys can't be split into their parts
+	liveIds := map[string]bool{}
+	liveKeys := map[string]bool{}
+
+	storeIter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer storeIter.Close()
+
+	for storeIter.First(); storeIter.Valid(); storeIter.Next() {
+		var document Document
+		if err := json.Unmarshal(storeIter.Value(), &document); err != nil {
+			return 0, err
+		}
+
+		if isDeleted(document) {
+			continue
+		}
+
+		_, id, _ := parseKey(storeIter.Key())
+		liveIds[id] = true
+
+		numericKeys, err := db.getNumericIndexKeys(collectionName, id, document)
+		if err != nil {
+			return 0, err
+		}
+
+		compoundKeys, err := db.getCompoundIndexKeys(collectionName, id, document)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, key := range append(numericKeys, compoundKeys...) {
+			liveKeys[string(key)] = true
+		}
+	}
+
+	if err := storeIter.Error(); err != nil {
+		return 0, err
+	}
+
+	batch := db.index.NewBatch()
+	defer batch.Close()
+
+	iter := db.index.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	removed := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+
+		// Numeric and compound index keys hold a single ID
+		if rest := key[len(prefix):]; len(rest) > 0 && (rest[0] == 0 || rest[0] == 2) {
+			if liveKeys[string(key)] {
+				continue
+			}
 
-		for id, count := range idsConditionCount {
-			if count == nonRangeConditionCount {
-				allMatchedIdsFromIndex = append(allMatchedIdsFromIndex, id)
+			if err := batch.Delete(key, nil); err != nil {
+				return 0, err
 			}
+			removed++
+			continue
 		}
 
-		if len(allMatchedIdsFromIndex) > 0 {
-			for _, id := range allMatchedIdsFromIndex {
-				document, err := db.FindOneById(collectionName, id)
-				if err != nil && err != ErrDocumentNotExists {
-					return nil, err
-				}
-
-				// Since the allMatchedIdsFromIndex are those that match the EQ conditions only,
-				// we need to check if the document matches the other conditions as well.
-				if matchQuery(document, query) {
-					documents = append(documents, document)
+		// Index keys end with the ID of their document
+		if _, id, ok := parseIndexKey(key[len(prefix):]); ok {
+			if liveIds[id] {
+				continue
+			}
 
-					// Limit = 0 means no limit
-					if options.Limit > 0 && len(documents) >= options.Limit {
-						break
-					}
-				}
+			if err := batch.Delete(key, nil); err != nil {
+				return 0, err
 			}
+			removed++
+			continue
 		}
-	} else {
-		// Fallback to scanning the entire collection
-		iter := db.store.NewIter(nil)
-		defer iter.Close()
 
-		for iter.First(); iter.Valid(); iter.Next() {
-			var document Document
-			if err := json.Unmarshal(iter.Value(), &document); err != nil {
-				return nil, err
+		// Keys written by earlier versions hold the list of the IDs with the
+		// path-value pair, and are converted into a key for each live ID
+		pathValue := string(key[len(prefix):])
+		for _, id := range strings.Split(string(iter.Value()), idSeparator) {
+			if !liveIds[id] {
+				removed++
+				continue
 			}
 
-			// Check the collection name
-			if strings.Split(string(iter.Key()), ":")[0] != collectionName {
-				continue
+			if err := batch.Set(getIndexKey(collectionName, pathValue, id), nil, nil); err != nil {
+				return 0, err
 			}
+		}
 
-			if matchQuery(document, query) {
-				documents = append(documents, document)
+		if err := batch.Delete(key, nil); err != nil {
+			return 0, err
+		}
+	}
 
-				// Limit = 0 means no limit
-				if options.Limit > 0 && len(documents) >= options.Limit {
-					break
-				}
-			}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	return removed, batch.Commit(db.writeOptions)
+}
+
+// deletePrefix writes the deletion of all the keys with the prefix in the store to the batch.
+func deletePrefix(store *pebble.DB, batch *pebble.Batch, prefix []byte) error {
+	iter := store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			return err
 		}
 	}
 
-	return documents, nil
+	return iter.Error()
 }
 
-func getDocumentKey(collectionName, id string) []byte {
-	return []byte(collectionName + ":" + id)
+// prefixUpperBound returns the smallest key greater than all the keys with the prefix.
+func prefixUpperBound(prefix []byte) []byte {
+	upper := append([]byte(nil), prefix...)
+	for i := len(upper) - 1; i >= 0; i-- {
+		upper[i]++
+		if upper[i] != 0 {
+			return upper[:i+1]
+		}
+	}
+
+	return nil
 }
 
-func getIndexKey(collectionName, pathValue string) []byte {
-	return []byte(collectionName + ":" + pathValue)
+// commitIndexBatches commits the changes to the index and the full-text search
+// index. Each batch is applied atomically to its store.
+func (db *DB) commitIndexBatches(indexBatch, ftsBatch *pebble.Batch) error {
+	if err := indexBatch.Commit(db.writeOptions); err != nil {
+		return err
+	}
+
+	return ftsBatch.Commit(db.writeOptions)
 }
 
-// matchQuery checks if a document matches a query.
-func matchQuery(document Document, query Query) bool {
-	// Top-level implicitly ANDs all the conditions
-	for _, topOperand := range query {
-		// OR condition
-		if topOperand.Operator == "OR" {
-			foundMatch := false
-			for _, operand := range topOperand.Operands {
-				if matchCondition(document, operand) {
-					foundMatch = true
-					break
+// getPathValues returns the path-value pairs of a document to index. The
+// string values at the paths with a delimiter are also indexed part by part.
+func getPathValues(document Document, prefix string, delimiters map[string]string) []string {
+	var pvs []string
+
+	for key, value := range document {
+		// Exclude _id from the index. The document is not modified, as it may
+		// still be used by the caller.
+		if prefix == "" && key == "_id" {
+			continue
+		}
+
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			pvs = append(pvs, getPathValues(v, key, delimiters)...)
+			continue
+		}
+
+		// Index each scalar element of an array under the path of the array,
+		// and the fields of each object element under the path of the array
+		// followed by the fields, e.g. "reviews.rating"
+		if elements, isArray := value.([]interface{}); isArray {
+			for _, element := range elements {
+				switch e := element.(type) {
+				case map[string]interface{}:
+					pvs = append(pvs, getPathValues(e, key, delimiters)...)
+					continue
+				case []interface{}:
+					continue
 				}
-			}
 
-			if !foundMatch {
-				return false
+				pvs = appendPathValues(pvs, key, element, delimiters[key])
 			}
-		} else {
-			// AND condition
-			for _, operand := range topOperand.Operands {
-				if !matchCondition(document, operand) {
-					return false
-				}
+			continue
+		}
+
+		pvs = appendPathValues(pvs, key, value, delimiters[key])
+	}
+
+	return pvs
+}
+
+// appendPathValues appends the path-value pair of a value. Strings containing
+// uppercase letters are also indexed in lowercase under a separate key, so
+// that case-insensitive conditions can be looked up in the index. With a
+// delimiter, the parts of a string are appended as well.
+func appendPathValues(pvs []string, path string, value interface{}, delimiter string) []string {
+	pvs = append(pvs, buildPathValue(path, value))
+
+	s, ok := value.(string)
+	if !ok {
+		return pvs
+	}
+
+	if strings.ToLower(s) != s {
+		pvs = append(pvs, buildFoldedPathValue(path, s))
+	}
+
+	for _, part := range splitValue(s, delimiter) {
+		pvs = appendPathValues(pvs, path, part, "")
+	}
+
+	return pvs
+}
+
+// splitValue splits a string on the delimiter into its parts, trimmed of
+// spaces. Empty parts are left out, and so is a single part equal to the
+// whole string, which is matched already. There are no parts without a
+// delimiter.
+func splitValue(s, delimiter string) []string {
+	if delimiter == "" || !strings.Contains(s, delimiter) {
+		return nil
+	}
+
+	var parts []string
+	for _, part := range strings.Split(s, delimiter) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	return parts
+}
+
+// buildPathValue builds the path-value pair of the index key of a value. It
+// is used both to index documents and to look up conditions, so numbers are
+// formatted canonically, whatever their type: 30, 30.0 and json.Number("30")
+// are all formatted as 30, and large numbers are not formatted with exponents.
+// The backslashes and equal signs of the path are escaped with a backslash, so
+// that the first unescaped equal sign always ends the path.
+func buildPathValue(path string, value interface{}) string {
+	path = pathEscaper.Replace(path)
+
+	// Keep null apart from the string "<nil>"
+	if value == nil {
+		return path + "=\x00null"
+	}
+
+	// Keep booleans apart from the strings "true" and "false"
+	if b, ok := value.(bool); ok {
+		return path + "=\x00" + strconv.FormatBool(b)
+	}
+
+	return path + "=" + stringValue(value)
+}
+
+// formatNumber formats a number canonically, without an exponent, e.g. 1e21
+// as 1000000000000000000000.
+func formatNumber(number float64) string {
+	// Format -0 as 0, as they are equal
+	if number == 0 {
+		number = 0
+	}
+
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
+
+// The escapers of the paths of the path-value pairs, see buildPathValue
+var (
+	pathEscaper   = strings.NewReplacer(`\`, `\\`, "=", `\=`)
+	pathUnescaper = strings.NewReplacer(`\\`, `\`, `\=`, "=")
+)
+
+// splitPathValue splits a path-value pair into the unescaped path and the
+// value.
+func splitPathValue(pathValue string) (path, value string, ok bool) {
+	for i := 0; i < len(pathValue); i++ {
+		switch pathValue[i] {
+		case '\\':
+			i++
+		case '=':
+			return pathUnescaper.Replace(pathValue[:i]), pathValue[i+1:], true
+		}
+	}
+
+	return "", "", false
+}
+
+// buildFoldedPathValue builds the path-value pair of the lowercase value. The
+// 0x01 prefix keeps it apart from the path-value pairs of the values that are
+// already lowercase.
+func buildFoldedPathValue(path string, value string) string {
+	return "\x01" + buildPathValue(path, strings.ToLower(value))
+}
+
+/****************
+ * Full-text search
+****************/
+
+// Logger receives the debug logs of a DB, e.g. the decisions of the query
+// planner, the probes of the index and the tokens of the full-text searches.
+// It is satisfied by *slog.Logger.
+type Logger = fts.Logger
+
+// logAttrs returns the attributes of a log about a collection: the name of
+// the collection and the key prefix of its namespace, logged apart so that
+// the qualified name doesn't leak into the logs, followed by the other
+// attributes.
+func logAttrs(collectionName string, keysAndValues ...interface{}) []interface{} {
+	namespace, name := splitCollectionName(collectionName)
+	return append([]interface{}{"collection", name, "namespace", namespace}, keysAndValues...)
+}
+
+// SearchOptions configures a full-text search, e.g. to match the search terms
+// fuzzily.
+type SearchOptions = fts.SearchOptions
+
+// SearchResult is a document matched by a full-text search, with its relevance score.
+type SearchResult struct {
+	Document   Document
+	Score      float64
+	Highlights map[string]string // Texts of the matching fields by path, with the matches in <mark> tags
+}
+
+// AddTextFields adds dot-separated paths to the fields of the collection that
+// are indexed for full-text search. Documents inserted as maps have no struct
+// tags, so only these fields of the map documents are indexed. The fields are
+// persisted with the collection; call RebuildIndexes to index the documents
+// inserted before they were added.
+func (db *DB) AddTextFields(collectionName string, paths ...string) error {
+	collectionName = db.collection(collectionName)
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	return db.fts.AddTextFields(collectionName, paths...)
+}
+
+// SetTextFieldWeight sets the weight of the text field at a dot-separated path
+// of the collection, e.g. to make a match on the name of a restaurant outweigh
+// a match on its cuisine. The occurrences of the search terms in the field
+// are multiplied by its weight when scoring the search results. Fields weigh
+// 1 by default, or the weight set by their tag, e.g.
+// `objectdb:"textIndex;weight=3"`.
+func (db *DB) SetTextFieldWeight(collectionName, path string, weight float64) error {
+	collectionName = db.collection(collectionName)
+
+	if weight <= 0 {
+		return ErrInvalidWeight
+	}
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	return db.fts.SetTextFieldWeight(collectionName, path, weight)
+}
+
+// SearchWithScores is like Search, but also returns the TF-IDF score of each
+// document. Documents with higher scores contain the search terms more often,
+// or contain terms that are rarer in the collection.
+func (db *DB) SearchWithScores(collectionName, text string, options ...SearchOptions) ([]SearchResult, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	results, err := db.searchWithScores(collectionName, text, options...)
+	db.observeQuery("SearchWithScores", start, len(results))
+
+	return results, err
+}
+
+func (db *DB) searchWithScores(collectionName, text string, options ...SearchOptions) ([]SearchResult, error) {
+	results, err := db.fts.SearchWithScores(collectionName, text, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	var searchResults []SearchResult
+	for _, result := range results {
+		document, err := db.findOneById(collectionName, result.Id)
+		if err == ErrDocumentNotExists {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		searchResults = append(searchResults, SearchResult{Document: document, Score: result.Score})
+	}
+
+	return searchResults, nil
+}
+
+// SearchWithHighlights is like SearchWithScores, but also returns the texts of
+// the text fields of each document that match the search, with the matching
+// words wrapped in <mark> tags, e.g. to show why a document matched.
+func (db *DB) SearchWithHighlights(collectionName, text string, options ...SearchOptions) ([]SearchResult, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	results, err := db.searchWithHighlights(collectionName, text, options...)
+	db.observeQuery("SearchWithHighlights", start, len(results))
+
+	return results, err
+}
+
+func (db *DB) searchWithHighlights(collectionName, text string, options ...SearchOptions) ([]SearchResult, error) {
+	results, err := db.searchWithScores(collectionName, text, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, result := range results {
+		results[i].Highlights, err = db.fts.Highlight(collectionName, result.Document, text, "<mark>", "</mark>", options...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// Search returns the documents matching the text, ordered by descending
+// relevance. SearchOptions can be passed optionally, e.g. to match the search
+// terms fuzzily.
+func (db *DB) Search(collectionName, text string, options ...SearchOptions) ([]Document, error) {
+	collectionName = db.collection(collectionName)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	documents, err := db.search(collectionName, text, options...)
+	db.observeQuery("Search", start, len(documents))
+
+	return documents, err
+}
+
+func (db *DB) search(collectionName, text string, options ...SearchOptions) ([]Document, error) {
+	documentIds, err := db.fts.Search(collectionName, text, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.findManyByIds(collectionName, documentIds)
+}
+
+// SearchWithQuery returns the documents matching the text that also match the
+// query, e.g. the restaurants matching "noodles" whose cuisine is Chinese. The
+// documents are ordered by descending relevance, unless Options sort them,
+// and the offset and the limit apply to the documents matching both.
+func (db *DB) SearchWithQuery(collectionName, text string, query Query, options Options) ([]Document, error) {
+	collectionName = db.collection(collectionName)
+
+	if err := ValidateQuery(query); err != nil {
+		return nil, err
+	}
+	query = compilePatterns(query)
+
+	start := time.Now()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	documents, err := db.searchWithQuery(collectionName, text, query, options)
+	db.observeQuery("SearchWithQuery", start, len(documents))
+
+	return documents, err
+}
+
+func (db *DB) searchWithQuery(collectionName, text string, query Query, options Options) ([]Document, error) {
+	delimiters, err := getDelimiters(db.index, collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err := db.search(collectionName, text)
+	if err != nil {
+		return nil, err
+	}
+
+	matchingDocuments := []Document{}
+	for _, document := range documents {
+		if isDeleted(document) || !matchQuery(document, query, delimiters) {
+			continue
+		}
+
+		matchingDocuments = append(matchingDocuments, document)
+	}
+
+	return applyOptions(matchingDocuments, options), nil
+}
+
+// StaleTextIndexes returns the sorted names of the collections whose
+// full-text search entries are stale, i.e. built with another FTSConfig, or
+// mixed with the entries of documents whose struct type has other textIndex
+// tags. Searching them can miss documents until they are rebuilt with
+// RebuildIndexes. The collections of nested namespaces are left out. Open
+// looks for them in all the namespaces, and logs a warning for each if a
+// Logger is set.
+func (db *DB) StaleTextIndexes() ([]string, error) {
+	collectionNames, err := db.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	staleNames := []string{}
+	for _, collectionName := range collectionNames {
+		stale, err := db.fts.IsStale(db.collection(collectionName))
+		if err != nil {
+			return nil, err
+		}
+
+		if stale {
+			staleNames = append(staleNames, collectionName)
+		}
+	}
+
+	return staleNames, nil
+}
+
+// Collections returns the sorted names of the collections with at least one
+// document. The collections of nested namespaces are left out.
+func (db *DB) Collections() ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	collectionNames := []string{}
+
+	iter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(db.namespace),
+		UpperBound: prefixUpperBound([]byte(db.namespace)),
+	})
+	defer iter.Close()
+
+	for valid := iter.First(); valid; {
+		collectionName, _, ok := parseKey(iter.Key())
+		if !ok {
+			valid = iter.Next()
+			continue
+		}
+
+		namespace, name := splitCollectionName(collectionName)
+		if namespace != db.namespace {
+			// Skip the nested namespaces
+			upperBound := prefixUpperBound([]byte(db.namespace + namespacePrefix))
+			if upperBound == nil {
+				break
 			}
+			valid = iter.SeekGE(upperBound)
+			continue
+		}
+
+		collectionNames = append(collectionNames, name)
+
+		// Skip the rest of the documents of the collection
+		upperBound := prefixUpperBound(getCollectionPrefix(collectionName))
+		if upperBound == nil {
+			break
 		}
+		valid = iter.SeekGE(upperBound)
+	}
+
+	// The keys are ordered by the escaped collection names
+	sort.Strings(collectionNames)
+
+	return collectionNames, iter.Error()
+}
+
+// DropCollection deletes all the documents of a collection, along with their
+// index and full-text search entries and the indexes declared on the collection.
+// Other collections are left untouched.
+func (db *DB) DropCollection(collectionName string) error {
+	collectionName = db.collection(collectionName)
+
+	if err := db.lock(); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+
+	prefix := getCollectionPrefix(collectionName)
+
+	// Delete the documents first, so that a crash before the indexes are
+	// updated leaves at most dangling IDs in the indexes.
+	storeBatch := db.store.NewBatch()
+	defer storeBatch.Close()
+
+	if err := deletePrefix(db.store, storeBatch, prefix); err != nil {
+		return err
+	}
+
+	if err := storeBatch.Commit(db.writeOptions); err != nil {
+		return err
+	}
+
+	// Delete the index entries and the metadata of the collection
+	indexBatch := db.index.NewIndexedBatch()
+	defer indexBatch.Close()
+
+	if err := deletePrefix(db.index, indexBatch, prefix); err != nil {
+		return err
+	}
+
+	if err := deletePrefix(db.index, indexBatch, getMetadataPrefix(collectionName)); err != nil {
+		return err
 	}
 
-	return true
-}
+	// Delete the full-text search entries
+	ftsBatch := db.fts.NewBatch()
+	defer ftsBatch.Close()
 
-// matchCondition checks if a document matches a condition.
-func matchCondition(document Document, condition Condition) bool {
-	value, ok := getValueFromPath(document, condition.Path)
+	if err := db.fts.DropCollectionBatch(ftsBatch, collectionName); err != nil {
+		return err
+	}
 
-	if !ok {
-		return false
+	return db.commitIndexBatches(indexBatch, ftsBatch)
+}
+
+// Clear all data in the store and index. Only the data of the namespace of
+// the DB is cleared; nested namespaces are left untouched.
+func (db *DB) Clear() error {
+	if err := db.lock(); err != nil {
+		return err
 	}
+	defer db.mu.Unlock()
 
-	if condition.Operator == EQ {
-		return fmt.Sprintf("%v", value) == fmt.Sprintf("%v", condition.Value)
-	} else if condition.Operator == NE {
-		return fmt.Sprintf("%v", value) != fmt.Sprintf("%v", condition.Value)
+	// Clear the store
+	if err := clearNamespace(db.store, db.namespace, db.writeOptions); err != nil {
+		return err
 	}
 
-	// Handle >, >=, <, <=
-	right, err := strconv.ParseFloat(fmt.Sprintf("%v", condition.Value), 64)
-	if err != nil {
-		return false
+	// Clear the index
+	if err := clearNamespace(db.index, db.namespace, db.writeOptions); err != nil {
+		return err
 	}
 
-	var left float64
-	switch v := value.(type) {
-	case float64:
-		left = v
-	case float32:
-		left = float64(v)
-	case uint:
-		left = float64(v)
-	case uint8:
-		left = float64(v)
-	case uint16:
-		left = float64(v)
-	case uint32:
-		left = float64(v)
-	case uint64:
-		left = float64(v)
-	case int:
-		left = float64(v)
-	case int8:
-		left = float64(v)
-	case int16:
-		left = float64(v)
-	case int32:
-		left = float64(v)
-	case int64:
-		left = float64(v)
-	case string:
-		left, err = strconv.ParseFloat(v, 64)
-		if err != nil {
-			return false
+	// Keep the version of the index, as the nested namespaces are kept
+	if db.namespace == "" {
+		if err := setIndexVersion(db.index, db.writeOptions); err != nil {
+			return err
 		}
-	default:
-		return false
 	}
 
-	switch condition.Operator {
-	case GT:
-		return left > right
-	case GTE:
-		return left >= right
-	case LT:
-		return left < right
-	case LTE:
-		return left <= right
+	// Clear the full-text search index
+	if err := db.fts.ClearNamespace(db.namespace); err != nil {
+		return err
 	}
 
-	return false
+	return nil
 }
 
-func getValueFromPath(document map[string]interface{}, path string) (interface{}, bool) {
-	var docSegment any = document
-	for _, part := range strings.Split(path, ".") {
-		switch v := docSegment.(type) {
-		case map[string]interface{}:
-			docSegment = v[part]
-		default:
-			return nil, false
+// clearNamespace deletes all the keys of a namespace from the store, except
+// those of its nested namespaces, in a single batch.
+func clearNamespace(store *pebble.DB, namespace string, writeOptions *pebble.WriteOptions) error {
+	nestedPrefix := []byte(namespace + namespacePrefix)
+
+	iter := store.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(namespace),
+		UpperBound: prefixUpperBound([]byte(namespace)),
+	})
+	defer iter.Close()
+
+	batch := store.NewBatch()
+	defer batch.Close()
+
+	for valid := iter.First(); valid; {
+		if bytes.HasPrefix(iter.Key(), nestedPrefix) {
+			// Skip the nested namespaces
+			upperBound := prefixUpperBound(nestedPrefix)
+			if upperBound == nil {
+				break
+			}
+			valid = iter.SeekGE(upperBound)
+			continue
 		}
+
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			return err
+		}
+		valid = iter.Next()
 	}
 
-	return docSegment, true
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return batch.Commit(writeOptions)
 }
 
-// Unmarshal a document into a struct
-func Unmarshal(doc Document, v interface{}) error {
-	b, err := json.Marshal(doc)
-	if err != nil {
-		return err
+// Pretty print all the key value pairs in the index
+func (db *DB) PrintIndex() error {
+	iter := db.index.NewIter(nil)
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		fmt.Printf("%s: %s\n", iter.Key(), iter.Value())
 	}
 
-	return json.Unmarshal(b, v)
+	return nil
 }
 
 /****************
- * Delete
+ * Backup
 ****************/
 
-func (db *DB) DeleteOneById(collectionName, id string) error {
-	// Build the key
-	key := getDocumentKey(collectionName, id)
+// A backup starts with backupHeader, followed by the version of the index and
+// the key-value pairs of the stores. Each pair is made of the byte of its
+// store, the length of the key as a uvarint, the key, the length of the value
+// as a uvarint, and the value. backupEnd follows the last pair, so that a
+// truncated backup is detected.
 
-	// Get document by ID
-	document, err := db.FindOneById(collectionName, id)
-	if err != nil {
+const backupHeader = "objectdb backup v1\n"
+
+// Bytes of the stores in a backup
+const (
+	backupStore byte = iota
+	backupIndex
+	backupFTS
+	backupEnd byte = 0xff
+)
+
+// restoreBatchSize is the number of key-value pairs written per batch by Restore.
+const restoreBatchSize = 1000
+
+// Backup writes a point-in-time copy of the documents, the index and the
+// full-text search index to w, which can be loaded with Restore. The stores
+// are read from snapshots taken together, so the backup is consistent even
+// with concurrent writes, which are not blocked while it is written.
+//
+// The backup of a namespace holds the data of the namespace and its nested
+// namespaces, and can be restored into another namespace.
+func (db *DB) Backup(w io.Writer) error {
+	// Writes hold the lock until all the stores are updated
+	db.mu.RLock()
+	// Snapshots of the stores, in the order of their bytes in the backup
+	snapshots := []*pebble.Snapshot{db.store.NewSnapshot(), db.index.NewSnapshot(), db.fts.NewSnapshot()}
+	db.mu.RUnlock()
+
+	defer func() {
+		for _, snapshot := range snapshots {
+			snapshot.Close()
+		}
+	}()
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(backupHeader); err != nil {
 		return err
 	}
 
-	// Delete the document from the index
-	err = db.deleteDocumentFromIndex(collectionName, id, document)
-	if err != nil {
+	// The version of the index comes first, so that Restore can refuse a
+	// backup of a later version before writing anything. It is stored outside
+	// of the namespaces, and skipped below in the index of the root DB.
+	if err := writeBackupPair(bw, backupIndex, indexVersionKey, []byte(strconv.Itoa(indexVersion))); err != nil {
 		return err
 	}
 
-	// Delete the document from the full-text search text index
-	err = db.fts.DeleteFromIndex(collectionName, id, document)
-	if err != nil {
+	// The keys are written without the prefix of the namespace
+	prefix := []byte(db.namespace)
+
+	for store, snapshot := range snapshots {
+		iter := snapshot.NewIter(&pebble.IterOptions{
+			LowerBound: prefix,
+			UpperBound: prefixUpperBound(prefix),
+		})
+
+		for iter.First(); iter.Valid(); iter.Next() {
+			if byte(store) == backupIndex && bytes.Equal(iter.Key(), indexVersionKey) {
+				continue
+			}
+
+			if err := writeBackupPair(bw, byte(store), iter.Key()[len(prefix):], iter.Value()); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.WriteByte(backupEnd); err != nil {
 		return err
 	}
 
-	// Delete the document from the store
-	err = db.store.Delete(key, pebble.Sync)
-	if err != nil {
+	return bw.Flush()
+}
+
+// writeBackupPair writes a key-value pair of a store to a backup.
+func writeBackupPair(w *bufio.Writer, store byte, key, value []byte) error {
+	b := []byte{store}
+	b = binary.AppendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	b = append(b, value...)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// Restore loads a backup written by Backup. It is meant to be used on an
+// empty DB, e.g. a newly created one; the keys of the backup overwrite the
+// existing ones, but the other keys are left as is. The pairs are written in
+// batches, so a failed restore can leave part of the backup in the DB. The
+// indexes of a backup written by an earlier version are upgraded, and a
+// backup written by a later version fails with ErrIndexVersion before anything
+// is written.
+func (db *DB) Restore(r io.Reader) error {
+	start := time.Now()
+
+	if err := db.lock(); err != nil {
 		return err
 	}
+	defer db.mu.Unlock()
 
-	return nil
+	err := db.restore(r)
+	db.observeWrite("Restore", start, err)
+
+	return err
 }
 
-func (db *DB) deleteDocumentFromIndex(collectionName, id string, document Document) error {
-	pv := getPathValues(document, "")
+// restore loads a backup written by Backup. The caller must hold the write
+// lock.
+func (db *DB) restore(r io.Reader) error {
+	br := bufio.NewReader(r)
 
-	for _, pathValue := range pv {
-		// Build the index key
-		indexKey := getIndexKey(collectionName, pathValue)
+	header := make([]byte, len(backupHeader))
+	if _, err := io.ReadFull(br, header); err != nil || string(header) != backupHeader {
+		return ErrInvalidBackup
+	}
 
-		// Get the current value of the index
-		idsString, closer, err := db.index.Get([]byte(indexKey))
-		if err != nil && err != pebble.ErrNotFound {
-			return err
+	batches := []*pebble.Batch{db.store.NewBatch(), db.index.NewBatch(), db.fts.NewBatch()}
+	defer func() {
+		for _, batch := range batches {
+			batch.Close()
 		}
+	}()
 
-		if len(idsString) == 0 {
-			// The document does not exist in the index
-			if closer != nil {
-				err = closer.Close()
-				if err != nil {
-					return err
-				}
-			}
+	// Backups written before the version was recorded have the first layout
+	version := 1
+	for {
+		store, err := br.ReadByte()
+		if err != nil {
+			return ErrInvalidBackup
+		}
 
-			return nil
+		if store == backupEnd {
+			break
+		}
+		if int(store) >= len(batches) {
+			return ErrInvalidBackup
 		}
 
-		ids := strings.Split(string(idsString), ",")
+		key, err := readBackupBytes(br)
+		if err != nil {
+			return err
+		}
 
-		// Remove the ID from the index
-		newIds := []string{}
-		for _, existingId := range ids {
-			if id != existingId {
-				newIds = append(newIds, existingId)
-			}
+		value, err := readBackupBytes(br)
+		if err != nil {
+			return err
 		}
 
-		// If there are no more IDs, delete the index key
-		if len(newIds) == 0 {
-			err = db.index.Delete([]byte(indexKey), pebble.Sync)
-			if err != nil {
-				return err
+		// The index of a backup written by an earlier version is upgraded
+		// below, so its version isn't restored. Backup writes the version
+		// first, so a backup of a later version is refused before any batch
+		// is committed.
+		if store == backupIndex && bytes.Equal(key, indexVersionKey) {
+			if version, err = strconv.Atoi(string(value)); err != nil {
+				return ErrInvalidBackup
 			}
-		} else {
-			idsString = []byte(strings.Join(newIds, ","))
-			err = db.index.Set([]byte(indexKey), idsString, pebble.Sync)
-			if err != nil {
-				return err
+			if version > indexVersion {
+				return ErrIndexVersion
 			}
+			continue
 		}
 
-		if closer != nil {
-			err = closer.Close()
-			if err != nil {
+		batch := batches[store]
+		if err := batch.Set(append([]byte(db.namespace), key...), value, nil); err != nil {
+			return err
+		}
+
+		if batch.Count() >= restoreBatchSize {
+			if err := batch.Commit(db.writeOptions); err != nil {
 				return err
 			}
+			batch.Reset()
 		}
 	}
 
-	return nil
+	for _, batch := range batches {
+		if err := batch.Commit(db.writeOptions); err != nil {
+			return err
+		}
+	}
+
+	return db.upgradeCollections([]byte(db.namespace), version)
+}
+
+// readBackupBytes reads a key or a value of a backup, preceded by its length.
+func readBackupBytes(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrInvalidBackup
+	}
+
+	// Read up to the length, rather than allocating it upfront, in case it is corrupted
+	b, err := io.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(b)) != length {
+		return nil, ErrInvalidBackup
+	}
+
+	return b, nil
 }
 
 /****************
- * Index
+ * Export
 ****************/
 
-// Index a document
-func (db *DB) indexDocument(collectionName, id string, document Document) error {
-	pv := getPathValues(document, "")
-
-	for _, pathValue := range pv {
-		// Build the index key
-		indexKey := getIndexKey(collectionName, pathValue)
+// Export writes the documents of a collection to w in the JSON Lines format,
+// i.e. one JSON document per line, including its _id. Soft-deleted documents
+// are left out. The documents are read from a point-in-time view of the
+// store, so concurrent writes are not blocked.
+func (db *DB) Export(collectionName string, w io.Writer) error {
+	collectionName = db.collection(collectionName)
+
+	prefix := getCollectionPrefix(collectionName)
+	iter := db.store.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
 
-		// Get the current value of the index
-		idsString, closer, err := db.index.Get([]byte(indexKey))
-		if err != nil && err != pebble.ErrNotFound {
+	bw := bufio.NewWriter(w)
+	for iter.First(); iter.Valid(); iter.Next() {
+		var document Document
+		if err := json.Unmarshal(iter.Value(), &document); err != nil {
 			return err
 		}
 
-		if len(idsString) == 0 {
-			idsString = []byte(id)
-		} else {
-			ids := strings.Split(string(idsString), ",")
-
-			found := false
-			for _, existingId := range ids {
-				if id == existingId {
-					found = true
-				}
-			}
-
-			if !found {
-				idsString = append(idsString, []byte(","+id)...)
-			}
+		if isDeleted(document) {
+			continue
 		}
 
-		if closer != nil {
-			err = closer.Close()
-			if err != nil {
-				return err
-			}
+		// The documents are stored as compact JSON, which has no newlines
+		if _, err := bw.Write(iter.Value()); err != nil {
+			return err
 		}
-
-		err = db.index.Set([]byte(indexKey), idsString, pebble.Sync)
-		if err != nil {
+		if err := bw.WriteByte('\n'); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
 }
 
-func getPathValues(document Document, prefix string) []string {
-	var pvs []string
+// Import reads documents in the JSON Lines format from r, e.g. written by
+// Export, and inserts them one by one into a collection. A document is
+// inserted under its _id if it has one, or under a new ID otherwise; an _id
+// that is already taken fails with ErrDuplicateKey, and one that isn't a
+// string with ErrInvalidId. With timestamps, the documents keep their
+// _createdAt, e.g. when moving a collection. If an error occurs, the
+// documents imported before are kept, and their IDs are returned with the
+// error.
+func (db *DB) Import(collectionName string, r io.Reader) ([]string, error) {
+	collectionName = db.collection(collectionName)
 
-	// Exclude _id from the index
-	delete(document, "_id")
+	start := time.Now()
 
-	for key, value := range document {
-		switch v := value.(type) {
-		case map[string]interface{}:
-			pvs = append(pvs, getPathValues(v, key)...)
-			continue
-		case []interface{}:
-			continue
+	if err := db.lock(); err != nil {
+		return nil, err
+	}
+	defer db.mu.Unlock()
+
+	ids, err := db.importDocuments(collectionName, r)
+	db.observeWrite("Import", start, err)
+
+	return ids, err
+}
+
+// importDocuments inserts the documents read from r into a collection and
+// returns their IDs. The caller must hold the write lock.
+func (db *DB) importDocuments(collectionName string, r io.Reader) ([]string, error) {
+	ids := []string{}
+
+	decoder := json.NewDecoder(r)
+	for {
+		var document Document
+		err := decoder.Decode(&document)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ids, err
 		}
 
-		if prefix != "" {
-			key = prefix + "." + key
+		var id string
+		if value, ok := document["_id"]; ok {
+			if id, ok = value.(string); !ok {
+				return ids, fmt.Errorf("%w: %v is not a string", ErrInvalidId, value)
+			}
+			delete(document, "_id")
 		}
 
-		pvs = append(pvs, buildPathValue(key, value))
-	}
+		id, err = db.insertOne(collectionName, id, document, true)
+		if err != nil {
+			return ids, err
+		}
 
-	return pvs
-}
+		ids = append(ids, id)
+	}
 
-func buildPathValue(path string, value interface{}) string {
-	return fmt.Sprintf("%s=%v", path, value)
+	return ids, nil
 }
 
 /****************
- * Full-text search
+ * Storage
 ****************/
 
-func (db *DB) Search(collectionName, text string) ([]Document, error) {
-	documentIds, err := db.fts.Search(collectionName, text)
-	if err != nil {
-		return nil, err
+// Compact compacts the keys of a collection in the document store, the index
+// and the full-text search index, e.g. to reclaim the space of the documents
+// removed by a large deletion, whose deletion markers linger until their keys
+// are compacted. Reads and writes are not blocked, but compete with the
+// compaction for disk bandwidth.
+func (db *DB) Compact(collectionName string) error {
+	collectionName = db.collection(collectionName)
+
+	if db.readOnly {
+		return ErrReadOnly
 	}
 
-	var documents []Document
-	for _, id := range documentIds {
-		document, err := db.FindOneById(collectionName, id)
-		if err != nil {
-			return nil, err
+	prefix := getCollectionPrefix(collectionName)
+	for _, store := range []*pebble.DB{db.store, db.index} {
+		if err := store.Compact(prefix, prefixUpperBound(prefix), true); err != nil {
+			return err
 		}
-
-		documents = append(documents, document)
 	}
 
-	return documents, nil
+	return db.fts.CompactCollection(collectionName)
 }
 
-// Clear all data in the store and index
-func (db *DB) Clear() error {
-	// Clear the store
-	iter := db.store.NewIter(nil)
-	defer iter.Close()
+// DBStats reports the footprint of each store of a DB.
+type DBStats struct {
+	Store     StoreStats // Documents
+	Index     StoreStats // Path-value, numeric and compound indexes, and the metadata
+	TextIndex StoreStats // Full-text search index
+}
 
-	for iter.First(); iter.Valid(); iter.Next() {
-		if err := db.store.Delete(iter.Key(), pebble.Sync); err != nil {
-			return err
-		}
-	}
+// StoreStats reports the footprint of a store, taken from the metrics of
+// Pebble, and its number of keys.
+type StoreStats struct {
+	DiskSize     uint64 // Bytes used on disk by the tables, the write-ahead log and the other files of the store
+	Tables       int64  // Number of tables on disk
+	MemTableSize uint64 // Bytes held in memory by the tables not yet flushed to disk
+	Tombstones   uint64 // Approximate number of deletions not yet reclaimed by a compaction
+	Keys         int    // Number of live keys, within the namespace of the DB if any
+}
 
-	// Clear the index
-	iter = db.index.NewIter(nil)
-	defer iter.Close()
+// Stats returns the footprint of the document store, the index and the
+// full-text search index, e.g. to monitor their growth and plan capacity. The
+// sizes cover the whole stores, shared by all the namespaces, while the keys
+// are counted by iterating over a point-in-time view of each store, which
+// takes time proportional to their number.
+func (db *DB) Stats() (DBStats, error) {
+	db.mu.RLock()
+	metrics := []*pebble.Metrics{db.store.Metrics(), db.index.Metrics(), db.fts.Metrics()}
+	snapshots := []*pebble.Snapshot{db.store.NewSnapshot(), db.index.NewSnapshot(), db.fts.NewSnapshot()}
+	db.mu.RUnlock()
+
+	defer func() {
+		for _, snapshot := range snapshots {
+			snapshot.Close()
+		}
+	}()
 
-	for iter.First(); iter.Valid(); iter.Next() {
-		if err := db.index.Delete(iter.Key(), pebble.Sync); err != nil {
-			return err
+	stats := make([]StoreStats, len(snapshots))
+	for i, snapshot := range snapshots {
+		keys, err := countKeys(snapshot, []byte(db.namespace))
+		if err != nil {
+			return DBStats{}, err
 		}
-	}
 
-	// Clear the full-text search index
-	if err := db.fts.Clear(); err != nil {
-		return err
+		stats[i] = StoreStats{
+			DiskSize:     metrics[i].DiskSpaceUsage(),
+			Tables:       metrics[i].Total().NumFiles,
+			MemTableSize: metrics[i].MemTable.Size,
+			Tombstones:   metrics[i].Keys.TombstoneCount,
+			Keys:         keys,
+		}
 	}
 
-	return nil
+	return DBStats{Store: stats[0], Index: stats[1], TextIndex: stats[2]}, nil
 }
 
-// Pretty print all the key value pairs in the index
-func (db *DB) PrintIndex() error {
-	iter := db.index.NewIter(nil)
+// countKeys returns the number of keys with the prefix in the snapshot.
+func countKeys(snapshot *pebble.Snapshot, prefix []byte) (int, error) {
+	iter := snapshot.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
 	defer iter.Close()
 
+	count := 0
 	for iter.First(); iter.Valid(); iter.Next() {
-		fmt.Printf("%s: %s\n", iter.Key(), iter.Value())
+		count++
 	}
 
-	return nil
+	return count, iter.Error()
 }
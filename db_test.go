@@ -0,0 +1,2363 @@
+package objectdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// openTestDB opens a DB in a temporary directory, closed when the test ends.
+func openTestDB(tb testing.TB, options ...OpenOptions) *DB {
+	tb.Helper()
+
+	db, err := Open(filepath.Join(tb.TempDir(), "db"), options...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// insertDocuments inserts the documents into the "restaurants" collection,
+// with a numeric index on the numeric paths. Each document gets its key in the
+// map as its "key" field, by which the results are compared.
+func insertDocuments(t *testing.T, db *DB, documents map[string]Document, numericPaths ...string) {
+	t.Helper()
+
+	for _, path := range numericPaths {
+		if err := db.CreateNumericIndex("restaurants", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for key, document := range documents {
+		document["key"] = key
+		if _, err := db.InsertOne("restaurants", document); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fullScanQuery returns a query matching the same documents as the given one,
+// but that can't be looked up in the index: its groups are nested in an OR
+// group, all of whose operands would have to be looked up.
+func fullScanQuery(query Query) Query {
+	group := Condition{Operator: AND}
+	for _, topOperand := range query {
+		group.Operands = append(group.Operands, Condition{Operator: topOperand.Operator, Operands: topOperand.Operands})
+	}
+
+	return Query{{OR, []Condition{group}}}
+}
+
+// findKeys returns the sorted keys of the restaurants matching the query.
+func findKeys(t *testing.T, db *DB, query Query) []string {
+	t.Helper()
+
+	documents, err := db.FindMany("restaurants", query, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for _, document := range documents {
+		keys = append(keys, document["key"].(string))
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+// checkResults checks that the query finds and counts the wanted restaurants,
+// by their keys, both as planned and by a full scan of the collection.
+func checkResults(t *testing.T, db *DB, query Query, want ...string) {
+	t.Helper()
+
+	if want == nil {
+		want = []string{}
+	}
+	slices.Sort(want)
+
+	for _, q := range []Query{query, fullScanQuery(query)} {
+		if keys := findKeys(t, db, q); !slices.Equal(keys, want) {
+			t.Errorf("%v: found %v, want %v", q, keys, want)
+		}
+
+		count, err := db.Count("restaurants", q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(want) {
+			t.Errorf("%v: counted %d, want %d", q, count, len(want))
+		}
+	}
+}
+
+// Insert
+
+func BenchmarkInsertMany(b *testing.B) {
+	documents := make([]interface{}, 10000)
+	for i := range documents {
+		documents[i] = Document{"name": fmt.Sprintf("restaurant %d", i), "cuisine": "Chinese", "rating": i % 5}
+	}
+
+	db := openTestDB(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.InsertMany(fmt.Sprintf("restaurants%d", i), documents); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestInsertManyReturnsWrittenIds(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateUniqueIndex("users", "email"); err != nil {
+		t.Fatal(err)
+	}
+
+	documents := make([]interface{}, insertManyBatchSize+1)
+	for i := range documents {
+		documents[i] = Document{"email": fmt.Sprintf("user%d@example.com", i)}
+	}
+	// The last document, alone in the second batch, duplicates the first one
+	documents[insertManyBatchSize] = Document{"email": "user0@example.com"}
+
+	ids, err := db.InsertMany("users", documents)
+	if err == nil {
+		t.Fatal("expected a unique index violation")
+	}
+
+	if len(ids) != insertManyBatchSize {
+		t.Fatalf("got %d IDs, want the %d IDs of the first batch", len(ids), insertManyBatchSize)
+	}
+
+	for _, id := range ids {
+		if _, err := db.FindOneById("users", id); err != nil {
+			t.Fatalf("document %s of the first batch: %v", id, err)
+		}
+	}
+}
+
+func TestAutoIncrementAfterExplicitIds(t *testing.T) {
+	source := openTestDB(t)
+
+	if err := source.SetAutoIncrement("orders", true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := source.InsertOne("orders", Document{"number": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var exported bytes.Buffer
+	if err := source.Export("orders", &exported); err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestDB(t)
+	if err := db.SetAutoIncrement("orders", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Import("orders", &exported); err != nil {
+		t.Fatal(err)
+	}
+
+	// The imported IDs raise the counter
+	id, err := db.InsertOne("orders", Document{"number": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "00000000000000000003"; id != want {
+		t.Fatalf("got ID %s after the import, want %s", id, want)
+	}
+
+	// So does an upserted numeric ID, but not a smaller one or another string
+	for _, upsertedId := range []string{"00000000000000000010", "5", "order"} {
+		if _, err := db.Upsert("orders", upsertedId, Document{"number": upsertedId}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, err = db.InsertOne("orders", Document{"number": 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "00000000000000000011"; id != want {
+		t.Fatalf("got ID %s after the upserts, want %s", id, want)
+	}
+}
+
+func TestImportKeepsIdsAndCreationTimes(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.SetTimestamps("orders", true); err != nil {
+		t.Fatal(err)
+	}
+
+	createdAt := "2020-01-02T03:04:05Z"
+	input := `{"_id":"a","_createdAt":"` + createdAt + `","number":1}` + "\n" + `{"number":2}` + "\n"
+	ids, err := db.Import("orders", strings.NewReader(input))
+	if err != nil || len(ids) != 2 || ids[0] != "a" {
+		t.Fatalf("imported %v (%v), want a and a new ID", ids, err)
+	}
+
+	for id, want := range map[string]bool{ids[0]: true, ids[1]: false} {
+		document, err := db.FindOneById("orders", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stamped, _ := document["_createdAt"].(string); stamped == "" || (stamped == createdAt) != want {
+			t.Fatalf("document %s was created at %q, want the imported time: %v", id, stamped, want)
+		}
+	}
+
+	// Only an imported document keeps its _createdAt
+	id, err := db.InsertOne("orders", map[string]interface{}{"_createdAt": createdAt, "number": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	document, err := db.FindOneById("orders", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document["_createdAt"] == createdAt {
+		t.Fatalf("inserted document kept its _createdAt %v", createdAt)
+	}
+
+	// An _id that isn't a string isn't replaced by a new ID
+	ids, err = db.Import("orders", strings.NewReader(`{"_id":42,"number":3}`))
+	if !errors.Is(err, ErrInvalidId) || len(ids) != 0 {
+		t.Fatalf("imported %v (%v), want ErrInvalidId", ids, err)
+	}
+}
+
+// Run with -race: the values read from the stores must be copied before their
+// closer is closed, while other goroutines write and read the same keys.
+func TestConcurrentWritesKeepIndexesIntact(t *testing.T) {
+	db := openTestDB(t)
+
+	const writers = 8
+	const documents = 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+
+		// All the writers share the index entries of the cuisine and the
+		// posting lists of the words of the name
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < documents; i++ {
+				document := restaurant{Name: fmt.Sprintf("golden dragon %d %d", w, i), Cuisine: "Chinese"}
+				if _, err := db.InsertOne("restaurants", document); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+
+		go func() {
+			defer wg.Done()
+			query := Query{{AND, []Condition{{Path: "cuisine", Operator: EQ, Value: "Chinese"}}}}
+			for i := 0; i < documents; i++ {
+				if _, err := db.FindMany("restaurants", query, Options{}); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := db.Search("restaurants", "golden dragon"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	query := Query{{AND, []Condition{{Path: "cuisine", Operator: EQ, Value: "Chinese"}}}}
+	found, err := db.FindMany("restaurants", query, Options{})
+	if err != nil || len(found) != writers*documents {
+		t.Fatalf("found %d documents (%v), want %d", len(found), err, writers*documents)
+	}
+
+	searched, err := db.Search("restaurants", "golden dragon")
+	if err != nil || len(searched) != writers*documents {
+		t.Fatalf("searched %d documents (%v), want %d", len(searched), err, writers*documents)
+	}
+}
+
+// Collections
+
+type note struct {
+	Tag  string `json:"tag"`
+	Text string `json:"text" objectdb:"textIndex"`
+}
+
+func TestCollectionsWithSeparatorsStaySeparate(t *testing.T) {
+	db := openTestDB(t)
+
+	collectionNames := []string{"a", "a:b", `a\`, `a\:b`}
+	for _, collectionName := range collectionNames {
+		if _, err := db.InsertOne(collectionName, note{Tag: "shared", Text: "shared words"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := Query{{AND, []Condition{{Path: "tag", Operator: EQ, Value: "shared"}}}}
+	for _, collectionName := range collectionNames {
+		// Document keys
+		documents, err := db.FindMany(collectionName, nil, Options{})
+		if err != nil || len(documents) != 1 {
+			t.Fatalf("%q: found %d documents (%v), want 1", collectionName, len(documents), err)
+		}
+
+		// Index keys
+		documents, err = db.FindMany(collectionName, query, Options{})
+		if err != nil || len(documents) != 1 {
+			t.Fatalf("%q: found %d documents by index (%v), want 1", collectionName, len(documents), err)
+		}
+
+		// Full-text search keys
+		documents, err = db.Search(collectionName, "words")
+		if err != nil || len(documents) != 1 {
+			t.Fatalf("%q: found %d documents by search (%v), want 1", collectionName, len(documents), err)
+		}
+	}
+
+	collections, err := db.Collections()
+	if err != nil || !slices.Equal(collections, []string{"a", "a:b", `a\`, `a\:b`}) {
+		t.Fatalf("collections %v (%v), want %v", collections, err, collectionNames)
+	}
+
+	// Dropping a collection leaves the others untouched
+	if err := db.DropCollection("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, collectionName := range collectionNames[1:] {
+		count, err := db.Count(collectionName, query)
+		if err != nil || count != 1 {
+			t.Fatalf("%q: counted %d documents after dropping a (%v), want 1", collectionName, count, err)
+		}
+
+		documents, err := db.Search(collectionName, "words")
+		if err != nil || len(documents) != 1 {
+			t.Fatalf("%q: found %d documents by search after dropping a (%v), want 1", collectionName, len(documents), err)
+		}
+	}
+}
+
+// Find
+
+func TestCountMatchesFindMany(t *testing.T) {
+	db := openTestDB(t)
+
+	type ratedRestaurant struct {
+		Cuisine string `json:"cuisine"`
+		City    string `json:"city"`
+		Rating  int    `json:"rating"`
+	}
+
+	ids := map[string]string{}
+	for name, document := range map[string]ratedRestaurant{
+		"wok":    {"Chinese", "Penang", 5},
+		"dragon": {"Chinese", "Ipoh", 3},
+		"lotus":  {"Chinese", "Penang", 2},
+		"siam":   {"Thai", "Penang", 4},
+	} {
+		id, err := db.InsertOne("restaurants", document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+
+	chinese := Condition{Path: "cuisine", Operator: EQ, Value: "Chinese"}
+	penang := Condition{Path: "city", Operator: EQ, Value: "Penang"}
+	rated := Condition{Path: "rating", Operator: GTE, Value: 3}
+
+	check := func(step string, tests map[string]struct {
+		query Query
+		want  int
+	}) {
+		t.Helper()
+		for name, test := range tests {
+			count, err := db.Count("restaurants", test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			documents, err := db.FindMany("restaurants", test.query, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != test.want || len(documents) != test.want {
+				t.Errorf("%s, %s: counted %d and found %d documents, want %d", step, name, count, len(documents), test.want)
+			}
+		}
+	}
+
+	tests := map[string]struct {
+		query Query
+		want  int
+	}{
+		"all":                    {nil, 4},
+		"only EQ":                {Query{{AND, []Condition{chinese, penang}}}, 2},
+		"EQ and range":           {Query{{AND, []Condition{chinese, rated}}}, 2},
+		"full scan":              {Query{{AND, []Condition{rated}}}, 3},
+		"OR of EQ":               {Query{{OR, []Condition{chinese, penang}}}, 4},
+		"AND of EQ and OR of EQ": {Query{{AND, []Condition{penang}}, {OR, []Condition{chinese, rated}}}, 3},
+	}
+	check("after inserting", tests)
+
+	// The IDs left in the index by a replaced or deleted document must not be
+	// counted
+	if err := db.ReplaceOneById("restaurants", ids["wok"], ratedRestaurant{"Thai", "Penang", 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteOneById("restaurants", ids["lotus"]); err != nil {
+		t.Fatal(err)
+	}
+
+	tests["all"] = struct {
+		query Query
+		want  int
+	}{nil, 3}
+	for name, want := range map[string]int{"only EQ": 0, "EQ and range": 1, "full scan": 3, "OR of EQ": 3, "AND of EQ and OR of EQ": 2} {
+		test := tests[name]
+		test.want = want
+		tests[name] = test
+	}
+	check("after replacing and deleting", tests)
+}
+
+func TestDistinctKeepsNull(t *testing.T) {
+	db := openTestDB(t)
+
+	insertDocuments(t, db, map[string]Document{
+		"null":    {"cuisine": nil},
+		"thai":    {"cuisine": "Thai"},
+		"both":    {"cuisine": []interface{}{"Chinese", nil, "Thai"}},
+		"missing": {"name": "no cuisine"},
+	})
+
+	values, err := db.Distinct("restaurants", "cuisine", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"Chinese", "Thai", nil}; !slices.Equal(values, want) {
+		t.Fatalf("got %v, want %v", values, want)
+	}
+}
+
+func BenchmarkMatchQuery(b *testing.B) {
+	db := openTestDB(b)
+
+	documents := make([]interface{}, 1000)
+	for i := range documents {
+		documents[i] = Document{"name": fmt.Sprintf("restaurant %d", i)}
+	}
+	if _, err := db.InsertMany("restaurants", documents); err != nil {
+		b.Fatal(err)
+	}
+
+	query := Query{{AND, []Condition{{Path: "name", Operator: MATCH, Value: `^restaurant \d*7$`}}}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.FindMany("restaurants", query, Options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMatchConditions(t *testing.T) {
+	db := openTestDB(t)
+
+	insertDocuments(t, db, map[string]Document{
+		"wok":    {"name": "Golden Wok", "tags": []interface{}{"noodles", "rice"}},
+		"dragon": {"name": "Red Dragon", "tags": []interface{}{"dumplings"}},
+		"siam":   {"name": "Siam Garden", "rating": 4},
+		"none":   {"name": nil},
+	})
+
+	checkResults(t, db, Query{{AND, []Condition{{Path: "name", Operator: MATCH, Value: "^(Golden|Red) "}}}}, "wok", "dragon")
+	checkResults(t, db, Query{{AND, []Condition{{Path: "tags", Operator: MATCH, Value: "^d"}}}}, "dragon")
+	checkResults(t, db, Query{{AND, []Condition{{Path: "rating", Operator: MATCH, Value: `^\d$`}}}}, "siam")
+	checkResults(t, db, Query{{AND, []Condition{{Path: "name", Operator: MATCH, Value: "Dragon", Negate: true}}}}, "wok", "siam", "none")
+	checkResults(t, db, Query{{OR, []Condition{
+		{Operator: AND, Operands: []Condition{{Path: "name", Operator: MATCH, Value: "^Siam"}}},
+		{Path: "tags", Operator: MATCH, Value: "ice$"},
+	}}}, "wok", "siam")
+
+	// The patterns are compiled in a copy of the query
+	query := Query{{OR, []Condition{{Operator: AND, Operands: []Condition{{Path: "name", Operator: MATCH, Value: "^Siam"}}}}}}
+	compiled := compilePatterns(query)
+	if compiled[0].Operands[0].Operands[0].pattern == nil {
+		t.Error("the pattern of the nested condition isn't compiled")
+	}
+	if query[0].Operands[0].Operands[0].pattern != nil {
+		t.Error("the pattern is compiled in the given query")
+	}
+
+	if _, err := db.FindMany("restaurants", Query{{AND, []Condition{{Path: "name", Operator: MATCH, Value: "("}}}}, Options{}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v for an invalid pattern, want ErrInvalidQuery", err)
+	}
+}
+
+func TestStringValueOfCompositeValues(t *testing.T) {
+	type address struct {
+		Zip  string `json:"zip"`
+		City string `json:"city"`
+		Tags []int  `json:"tags"`
+	}
+
+	// Maps are written with sorted keys whatever their iteration order,
+	// structs like the map of their fields, and numbers alike whatever their
+	// type
+	want := `{"city":"Paris","tags":[1,2],"zip":"75001"}`
+	for _, value := range []interface{}{
+		address{Zip: "75001", City: "Paris", Tags: []int{1, 2}},
+		&address{Zip: "75001", City: "Paris", Tags: []int{1, 2}},
+		map[string]interface{}{"zip": "75001", "city": "Paris", "tags": []interface{}{1.0, json.Number("2")}},
+		Document{"tags": []interface{}{int64(1), 2}, "city": "Paris", "zip": "75001"},
+	} {
+		for i := 0; i < 20; i++ {
+			if got := stringValue(value); got != want {
+				t.Fatalf("%#v: got %s, want %s", value, got, want)
+			}
+		}
+	}
+
+	// The index only holds the scalar values of the stored documents, whose
+	// keys are unchanged by the representation of the composite values
+	document := Document{"name": "wok", "address": map[string]interface{}{"city": "paris"}, "tags": []interface{}{"rice", []interface{}{"nested"}, map[string]interface{}{"kind": "noodles"}}}
+	pvs := getPathValues(document, "", nil)
+	slices.Sort(pvs)
+	if want := []string{"address.city=paris", "name=wok", "tags.kind=noodles", "tags=rice"}; !slices.Equal(pvs, want) {
+		t.Fatalf("got path-value pairs %q, want %q", pvs, want)
+	}
+
+	db := openTestDB(t)
+	insertDocuments(t, db, map[string]Document{
+		"paris": {"address": Document{"zip": "75001", "city": "Paris"}},
+		"lyon":  {"address": Document{"zip": "69001", "city": "Lyon"}},
+	})
+
+	checkResults(t, db, Query{{AND, []Condition{{Path: "address", Operator: MATCH, Value: `^\{"city":"Paris",`}}}}, "paris")
+	checkResults(t, db, Query{{AND, []Condition{{Path: "address", Operator: CONTAINS, Value: `"zip":"69001"`}}}}, "lyon")
+}
+
+func TestNotEqualComparesWholeArrays(t *testing.T) {
+	db := openTestDB(t)
+
+	insertDocuments(t, db, map[string]Document{
+		"both":    {"tags": []interface{}{"go", "db"}, "reviews": []interface{}{Document{"rating": 5}, Document{"rating": 3}}},
+		"db":      {"tags": []interface{}{"db"}, "reviews": []interface{}{Document{"rating": 3}}},
+		"missing": {"name": "no tags nor reviews"},
+	})
+
+	// NE compares the array as a whole, so no array equals a single element
+	checkResults(t, db, Query{{AND, []Condition{{Path: "tags", Operator: NE, Value: "go"}}}}, "both", "db", "missing")
+	checkResults(t, db, Query{{AND, []Condition{{Path: "tags", Operator: NE, Value: []interface{}{"go", "db"}}}}}, "db", "missing")
+	checkResults(t, db, Query{{AND, []Condition{{Path: "reviews.rating", Operator: NE, Value: 5}}}}, "both", "db", "missing")
+
+	// A negated EQ matches the arrays where no element equals the value
+	checkResults(t, db, Query{{AND, []Condition{{Path: "tags", Operator: EQ, Value: "go", Negate: true}}}}, "db", "missing")
+	checkResults(t, db, Query{{AND, []Condition{{Path: "reviews.rating", Operator: EQ, Value: 5, Negate: true}}}}, "db", "missing")
+}
+
+// Index
+
+func TestNumericIndexRanges(t *testing.T) {
+	db := openTestDB(t)
+
+	prices := map[string]float64{
+		"-100":  -100,
+		"-10.5": -10.5,
+		"-1":    -1,
+		"-0.25": -0.25,
+		"-0":    math.Copysign(0, -1),
+		"0":     0,
+		"0.25":  0.25,
+		"1":     1,
+		"10.5":  10.5,
+		"100":   100,
+	}
+
+	documents := map[string]Document{}
+	for key, price := range prices {
+		documents[key] = Document{"price": price}
+	}
+	insertDocuments(t, db, documents, "price")
+
+	bounds := []float64{-100, -10.5, -1, -0.3, -0.25, math.Copysign(0, -1), 0, 0.25, 1, 10.5, 100}
+	compare := map[string]func(price, bound float64) bool{
+		GT:  func(price, bound float64) bool { return price > bound },
+		GTE: func(price, bound float64) bool { return price >= bound },
+		LT:  func(price, bound float64) bool { return price < bound },
+		LTE: func(price, bound float64) bool { return price <= bound },
+	}
+
+	for _, bound := range bounds {
+		for operator, matches := range compare {
+			query := Query{{AND, []Condition{{Path: "price", Operator: operator, Value: bound}}}}
+
+			plan, err := db.Explain("restaurants", query, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plan.Strategy != StrategyIndex {
+				t.Fatalf("%v: planned a %s, want the numeric index", query, plan.Strategy)
+			}
+
+			var want []string
+			for key, price := range prices {
+				if matches(price, bound) {
+					want = append(want, key)
+				}
+			}
+
+			checkResults(t, db, query, want...)
+		}
+	}
+
+	// The bounds of BETWEEN are inclusive
+	for _, between := range [][2]float64{{-10.5, -0.25}, {math.Copysign(0, -1), 0}, {-1, 1}, {0.25, 100}} {
+		query := Query{{AND, []Condition{{Path: "price", Operator: BETWEEN, Value: []interface{}{between[0], between[1]}}}}}
+
+		var want []string
+		for key, price := range prices {
+			if price >= between[0] && price <= between[1] {
+				want = append(want, key)
+			}
+		}
+
+		checkResults(t, db, query, want...)
+	}
+}
+
+func TestMixedConditionsMatchFullScan(t *testing.T) {
+	db := openTestDB(t)
+
+	numericPaths := map[string]bool{"rating": true}
+	insertDocuments(t, db, map[string]Document{
+		"1": {"cuisine": "Chinese", "rating": 5, "city": "Penang"},
+		"2": {"cuisine": "Chinese", "rating": 3, "city": "Ipoh"},
+		"3": {"cuisine": "Chinese", "city": "Penang"},
+		"4": {"cuisine": "Thai", "rating": 4, "city": "Penang"},
+		"5": {"cuisine": "Thai", "rating": 2, "city": "Ipoh"},
+		"6": {"cuisine": "Indian", "rating": 4.5},
+	}, "rating")
+
+	tests := []struct {
+		query   Query
+		indexed bool
+		want    []string
+	}{
+		{Query{{AND, []Condition{
+			{Path: "cuisine", Operator: EQ, Value: "Chinese"},
+			{Path: "city", Operator: NE, Value: "Ipoh"},
+			{Path: "rating", Operator: GTE, Value: 3},
+		}}}, true, []string{"1"}},
+		{Query{{AND, []Condition{
+			{Path: "city", Operator: NE, Value: "Penang"},
+			{Path: "rating", Operator: GTE, Value: 2},
+			{Path: "rating", Operator: LTE, Value: 4.5},
+		}}}, true, []string{"2", "5", "6"}},
+		// An OR group with an NE condition can't be looked up in the index
+		{Query{
+			{AND, []Condition{{Path: "rating", Operator: LT, Value: 4.5}}},
+			{OR, []Condition{
+				{Path: "cuisine", Operator: EQ, Value: "Thai"},
+				{Path: "city", Operator: NE, Value: "Penang"},
+			}},
+		}, false, []string{"2", "4", "5"}},
+		{Query{
+			{AND, []Condition{{Path: "rating", Operator: LT, Value: 4.5}}},
+			{OR, []Condition{
+				{Path: "cuisine", Operator: EQ, Value: "Thai"},
+				{Path: "city", Operator: EQ, Value: "Ipoh"},
+			}},
+		}, true, []string{"2", "4", "5"}},
+		{Query{{AND, []Condition{
+			{Path: "cuisine", Operator: IN, Value: []interface{}{"Chinese", "Indian"}},
+			{Path: "rating", Operator: GT, Value: 3},
+			{Path: "cuisine", Operator: NE, Value: "Indian"},
+		}}}, true, []string{"1"}},
+		// A nested group is only checked against the documents found for the
+		// other conditions, so an OR group containing one can't use the index
+		{Query{{AND, []Condition{
+			{Path: "city", Operator: EQ, Value: "Penang"},
+			{Operator: OR, Operands: []Condition{
+				{Path: "cuisine", Operator: EQ, Value: "Thai"},
+				{Path: "rating", Operator: GT, Value: 4},
+			}},
+		}}}, true, []string{"1", "4"}},
+		{Query{{OR, []Condition{
+			{Path: "city", Operator: EQ, Value: "Ipoh"},
+			{Operator: AND, Operands: []Condition{
+				{Path: "cuisine", Operator: EQ, Value: "Indian"},
+			}},
+		}}}, false, []string{"2", "5", "6"}},
+	}
+
+	for _, test := range tests {
+		if indexed := canUseIndex(test.query, numericPaths); indexed != test.indexed {
+			t.Errorf("%v: can use the index: %v, want %v", test.query, indexed, test.indexed)
+		}
+		checkResults(t, db, test.query, test.want...)
+	}
+}
+
+func TestNullAndMissingNeverMatchRanges(t *testing.T) {
+	db := openTestDB(t)
+
+	numericPaths := map[string]bool{"score": true}
+	insertDocuments(t, db, map[string]Document{
+		"number":       {"score": 5},
+		"zero":         {"score": 0},
+		"null":         {"score": nil},
+		"missing":      {"name": "no score"},
+		"otherNumber":  {"other": 1},
+		"otherNull":    {"other": nil},
+		"otherMissing": {"name": "no other"},
+	}, "score")
+
+	// Looked up in the numeric index
+	for _, condition := range []Condition{
+		{Path: "score", Operator: GT, Value: -1},
+		{Path: "score", Operator: GTE, Value: 0},
+		{Path: "score", Operator: LT, Value: 10},
+		{Path: "score", Operator: LTE, Value: 5},
+		{Path: "score", Operator: BETWEEN, Value: []interface{}{-10, 10}},
+	} {
+		query := Query{{AND, []Condition{condition}}}
+		if !canUseIndex(query, numericPaths) {
+			t.Errorf("%v: can't use the numeric index", condition)
+		}
+		checkResults(t, db, query, "number", "zero")
+	}
+
+	// Checked against every document, as there is no numeric index on "other"
+	for _, condition := range []Condition{
+		{Path: "other", Operator: GT, Value: -1},
+		{Path: "other", Operator: LT, Value: 10},
+		{Path: "other", Operator: BETWEEN, Value: []interface{}{-10, 10}},
+	} {
+		checkResults(t, db, Query{{AND, []Condition{condition}}}, "otherNumber")
+	}
+
+	// EQ nil matches the explicit nulls only
+	checkResults(t, db, Query{{AND, []Condition{{Path: "score", Operator: EQ, Value: nil}}}}, "null")
+}
+
+func TestNegatedConditions(t *testing.T) {
+	db := openTestDB(t)
+
+	numericPaths := map[string]bool{"rating": true}
+	insertDocuments(t, db, map[string]Document{
+		"chinese": {"cuisine": "Chinese", "rating": 5},
+		"thai":    {"cuisine": "Thai", "rating": 3},
+		"indian":  {"cuisine": "Indian", "rating": 4},
+		"missing": {"name": "no cuisine nor rating"},
+	}, "rating")
+
+	tests := []struct {
+		condition Condition
+		want      []string
+	}{
+		{Condition{Path: "cuisine", Operator: EQ, Value: "Chinese", Negate: true}, []string{"thai", "indian", "missing"}},
+		{Condition{Path: "cuisine", Operator: IN, Value: []interface{}{"Chinese", "Thai"}, Negate: true}, []string{"indian", "missing"}},
+		{Condition{Path: "rating", Operator: GT, Value: 3, Negate: true}, []string{"thai", "missing"}},
+		{Condition{Path: "rating", Operator: LTE, Value: 4, Negate: true}, []string{"chinese", "missing"}},
+		{Condition{Path: "rating", Operator: BETWEEN, Value: []interface{}{4, 5}, Negate: true}, []string{"thai", "missing"}},
+	}
+
+	for _, test := range tests {
+		// A negated condition is never looked up in the index, even on a path
+		// with a numeric index
+		query := Query{{AND, []Condition{test.condition}}}
+		if canUseIndex(query, numericPaths) {
+			t.Errorf("%v: negated condition can use the index", test.condition)
+		}
+		checkResults(t, db, query, test.want...)
+
+		// Alongside an indexed condition, the negated condition is checked
+		// against the documents found in the index
+		query = Query{{AND, []Condition{{Path: "cuisine", Operator: IN, Value: []interface{}{"Chinese", "Thai", "Indian"}}, test.condition}}}
+		if !canUseIndex(query, numericPaths) {
+			t.Errorf("%v: can't use the index alongside an IN condition", test.condition)
+		}
+		checkResults(t, db, query, slices.DeleteFunc(slices.Clone(test.want), func(key string) bool { return key == "missing" })...)
+	}
+}
+
+func TestBooleansDontEqualStrings(t *testing.T) {
+	db := openTestDB(t)
+
+	insertDocuments(t, db, map[string]Document{
+		"true":        {"value": true},
+		"trueString":  {"value": "true"},
+		"false":       {"value": false},
+		"falseString": {"value": "false"},
+	})
+
+	tests := []struct {
+		value interface{}
+		want  []string
+	}{
+		{true, []string{"true"}},
+		{"true", []string{"trueString"}},
+		{false, []string{"false"}},
+		{"false", []string{"falseString"}},
+	}
+
+	for _, test := range tests {
+		checkResults(t, db, Query{{AND, []Condition{{Path: "value", Operator: EQ, Value: test.value}}}}, test.want...)
+		checkResults(t, db, Query{{AND, []Condition{{Path: "value", Operator: IN, Value: []interface{}{test.value}}}}}, test.want...)
+	}
+}
+
+func TestObjectValuesMatchWhateverTheKeyOrder(t *testing.T) {
+	db := openTestDB(t)
+
+	insertDocuments(t, db, map[string]Document{
+		"paris":  {"cuisine": "French", "address": Document{"city": "Paris", "zip": "75001"}},
+		"lyon":   {"cuisine": "French", "address": Document{"city": "Lyon", "zip": "69001"}},
+		"nested": {"cuisine": "Thai", "address": Document{"city": "Paris", "zip": "75001", "floor": 2}},
+	})
+
+	// The fields of the struct are in the other order than the keys of the
+	// stored objects, which are sorted
+	type address struct {
+		Zip  string `json:"zip"`
+		City string `json:"city"`
+	}
+
+	for _, value := range []interface{}{
+		address{Zip: "75001", City: "Paris"},
+		&address{Zip: "75001", City: "Paris"},
+		map[string]interface{}{"zip": "75001", "city": "Paris"},
+	} {
+		// An object matches a whole object, not one with more keys
+		condition := Condition{Path: "address", Operator: EQ, Value: value}
+		checkResults(t, db, Query{{AND, []Condition{condition}}}, "paris")
+		checkResults(t, db, Query{{AND, []Condition{{Path: "address", Operator: IN, Value: []interface{}{"Paris", value}}}}}, "paris")
+
+		// Alongside an indexed condition, the object is compared with the
+		// documents found in the index
+		query := Query{{AND, []Condition{{Path: "cuisine", Operator: EQ, Value: "French"}, condition}}}
+		checkResults(t, db, query, "paris")
+	}
+
+	checkResults(t, db, Query{{AND, []Condition{{Path: "address", Operator: EQ, Value: address{City: "Paris"}}}}})
+}
+
+func TestFindRange(t *testing.T) {
+	db := openTestDB(t)
+
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := db.Upsert("books", id, Document{"title": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		startId, endId string
+		want           string
+	}{
+		{"", "", "a,b,c"},
+		{"b", "", "b,c"},
+		{"", "b", "a"},
+		{"a", "c", "a,b"},
+		// An empty or inverted range has no documents
+		{"b", "b", ""},
+		{"c", "a", ""},
+	} {
+		documents, err := db.FindRange("books", test.startId, test.endId, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := []string{}
+		for _, document := range documents {
+			ids = append(ids, document["_id"].(string))
+		}
+		if got := strings.Join(ids, ","); got != test.want {
+			t.Errorf("range from %q to %q: found %s, want %s", test.startId, test.endId, got, test.want)
+		}
+	}
+}
+
+func TestFindAfterAcrossEqualSortKeys(t *testing.T) {
+	db := openTestDB(t)
+
+	// Many restaurants share a rating, so a page can end in the middle of the
+	// restaurants of a rating
+	for i := 0; i < 10; i++ {
+		if _, err := db.Upsert("restaurants", fmt.Sprintf("r%d", i), Document{"rating": i % 3}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	options := Options{Sort: []SortField{{Path: "rating", Descending: true}}, Limit: 3}
+
+	var ids []string
+	pageToken := ""
+	for pages := 0; ; pages++ {
+		if pages > 4 {
+			t.Fatalf("more than 4 pages of 3 documents, got %v", ids)
+		}
+
+		documents, nextPageToken, err := db.FindAfter("restaurants", nil, options, pageToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, document := range documents {
+			ids = append(ids, document["_id"].(string))
+		}
+
+		if nextPageToken == "" {
+			break
+		}
+		pageToken = nextPageToken
+	}
+
+	// Sorted by rating, then by ID, each restaurant exactly once
+	want := []string{"r2", "r5", "r8", "r1", "r4", "r7", "r0", "r3", "r6", "r9"}
+	if !slices.Equal(ids, want) {
+		t.Fatalf("paged through %v, want %v", ids, want)
+	}
+
+	if _, _, err := db.FindAfter("restaurants", nil, options, "not a token"); !errors.Is(err, ErrInvalidPageToken) {
+		t.Fatalf("got %v for an invalid page token, want ErrInvalidPageToken", err)
+	}
+}
+
+// Namespaces
+
+func TestNamespaceClearAndDropLeaveOtherNamespaces(t *testing.T) {
+	db := openTestDB(t)
+	tenant := db.Namespace("tenant")
+	team := tenant.Namespace("team")
+
+	dbs := map[string]*DB{"root": db, "tenant": tenant, "team": team}
+	insert := func() {
+		for _, d := range dbs {
+			if _, err := d.InsertOne("notes", note{Tag: "shared", Text: "shared words"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	query := Query{{AND, []Condition{{Path: "tag", Operator: EQ, Value: "shared"}}}}
+	check := func(step string, want map[string]int) {
+		t.Helper()
+		for name, d := range dbs {
+			count, err := d.Count("notes", query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			documents, err := d.Search("notes", "words")
+			if err != nil {
+				t.Fatal(err)
+			}
+			all, err := d.FindMany("notes", nil, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != want[name] || len(documents) != want[name] || len(all) != want[name] {
+				t.Errorf("after %s, %s: counted %d, searched %d and found %d documents, want %d", step, name, count, len(documents), len(all), want[name])
+			}
+		}
+	}
+
+	insert()
+	if err := tenant.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	check("clearing tenant", map[string]int{"root": 1, "tenant": 0, "team": 1})
+
+	insert()
+	if err := tenant.DropCollection("notes"); err != nil {
+		t.Fatal(err)
+	}
+	check("dropping the notes of tenant", map[string]int{"root": 2, "tenant": 0, "team": 2})
+
+	if err := db.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	check("clearing root", map[string]int{"root": 0, "tenant": 0, "team": 2})
+}
+
+// attrLogger records the attributes of the logs of a DB.
+type attrLogger struct {
+	attrs []map[string]interface{}
+}
+
+func (l *attrLogger) Debug(msg string, keysAndValues ...interface{}) {
+	attrs := map[string]interface{}{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		attrs[keysAndValues[i].(string)] = keysAndValues[i+1]
+	}
+	l.attrs = append(l.attrs, attrs)
+}
+
+func (l *attrLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.Debug(msg, keysAndValues...)
+}
+
+func TestNamespaceLogsCollectionName(t *testing.T) {
+	logger := &attrLogger{}
+	tenant := openTestDB(t, OpenOptions{Logger: logger}).Namespace("tenant")
+
+	if _, err := tenant.InsertOne("notes", note{Tag: "a", Text: "some words"}); err != nil {
+		t.Fatal(err)
+	}
+	query := Query{{AND, []Condition{{Path: "tag", Operator: EQ, Value: "a"}}}}
+	if _, err := tenant.FindMany("notes", query, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tenant.Search("notes", "words"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logger.attrs) == 0 {
+		t.Fatal("nothing logged")
+	}
+	for _, attrs := range logger.attrs {
+		if attrs["collection"] != "notes" || attrs["namespace"] != tenant.namespace {
+			t.Fatalf("logged collection %q in namespace %q, want notes in %q", attrs["collection"], attrs["namespace"], tenant.namespace)
+		}
+	}
+}
+
+func TestBackupRestoreIntoNamespace(t *testing.T) {
+	db := openTestDB(t)
+	tenant := db.Namespace("tenant")
+
+	if _, err := db.InsertOne("notes", note{Tag: "root", Text: "root words"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"a", "b"} {
+		if _, err := tenant.InsertOne("notes", note{Tag: tag, Text: "tenant words"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var backup bytes.Buffer
+	if err := tenant.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backup of the tenant holds none of the root namespace, and can be
+	// restored under another name
+	restored := openTestDB(t)
+	copied := restored.Namespace("copy")
+	if err := copied.Restore(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, d := range map[string]*DB{"root": restored, "tenant": restored.Namespace("tenant")} {
+		if documents, err := d.FindMany("notes", nil, Options{}); err != nil || len(documents) != 0 {
+			t.Fatalf("%s: found %d documents (%v) after restoring into copy, want none", name, len(documents), err)
+		}
+	}
+
+	documents, err := copied.FindMany("notes", nil, Options{})
+	if err != nil || len(documents) != 2 {
+		t.Fatalf("found %d documents (%v), want 2", len(documents), err)
+	}
+
+	query := Query{{AND, []Condition{{Path: "tag", Operator: EQ, Value: "b"}}}}
+	if documents, err := copied.FindMany("notes", query, Options{}); err != nil || len(documents) != 1 {
+		t.Fatalf("found %d documents by index (%v), want 1", len(documents), err)
+	}
+
+	if documents, err := copied.Search("notes", "words"); err != nil || len(documents) != 2 {
+		t.Fatalf("found %d documents by search (%v), want 2", len(documents), err)
+	}
+}
+
+func TestRestoreLaterVersionWritesNothing(t *testing.T) {
+	db := openTestDB(t)
+
+	id, err := db.InsertOne("notes", note{Tag: "a", Text: "some words"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bump the version, which Backup writes first
+	version := append(append([]byte{backupIndex, byte(len(indexVersionKey))}, indexVersionKey...), 1)
+	if !bytes.HasPrefix(backup.Bytes()[len(backupHeader):], version) {
+		t.Fatal("the backup doesn't start with the version of the index")
+	}
+	backup.Bytes()[len(backupHeader)+len(version)] = byte('0' + indexVersion + 1)
+
+	restored := openTestDB(t)
+	if err := restored.Restore(&backup); !errors.Is(err, ErrIndexVersion) {
+		t.Fatalf("got %v, want ErrIndexVersion", err)
+	}
+
+	if _, err := restored.FindOneById("notes", id); err != ErrDocumentNotExists {
+		t.Fatalf("got %v when finding a document of the refused backup, want ErrDocumentNotExists", err)
+	}
+}
+
+func TestNamespacesShareTheWriteLock(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.Namespace("tenant").CreateUniqueIndex("users", "email"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each writer inserts the same email through its own handle of the
+	// namespace, so only one may succeed
+	const writers = 20
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	inserted := 0
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.Namespace("tenant").InsertOne("users", Document{"email": "a@example.com"})
+			if err != nil && !errors.Is(err, ErrDuplicateKey) {
+				t.Error(err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				inserted++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if inserted != 1 {
+		t.Fatalf("inserted %d documents with the same email, want 1", inserted)
+	}
+}
+
+// Index
+
+func TestCompoundIndex(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateIndex("restaurants", []string{"cuisine"}); err == nil {
+		t.Fatal("created a compound index on a single path")
+	}
+
+	ids := map[string]string{}
+	for name, document := range map[string]Document{
+		"wok":    {"cuisine": "Chinese", "address": Document{"postcode": "10200"}},
+		"dragon": {"cuisine": "Chinese", "address": Document{"postcode": "30450"}},
+		"siam":   {"cuisine": "Thai", "address": Document{"postcode": "10200"}},
+	} {
+		id, err := db.InsertOne("restaurants", document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+
+	// The existing documents are added to the new index
+	if err := db.CreateIndex("restaurants", []string{"cuisine", "address.postcode"}); err != nil {
+		t.Fatal(err)
+	}
+
+	query := Query{{AND, []Condition{
+		{Path: "cuisine", Operator: EQ, Value: "Chinese"},
+		{Path: "address.postcode", Operator: EQ, Value: "10200"},
+	}}}
+	check := func(step string, want ...string) {
+		t.Helper()
+		documents, err := db.FindMany("restaurants", query, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := []string{}
+		for _, document := range documents {
+			found = append(found, document["_id"].(string))
+		}
+		slices.Sort(found)
+		slices.Sort(want)
+		if !slices.Equal(found, want) {
+			t.Errorf("%s: found %v, want %v", step, found, want)
+		}
+	}
+	check("after creating the index", ids["wok"])
+
+	// The index is maintained on insert, replace and delete
+	id, err := db.InsertOne("restaurants", Document{"cuisine": "Chinese", "address": Document{"postcode": "10200"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after inserting", ids["wok"], id)
+
+	if err := db.ReplaceOneById("restaurants", ids["dragon"], Document{"cuisine": "Chinese", "address": Document{"postcode": "10200"}}); err != nil {
+		t.Fatal(err)
+	}
+	check("after replacing", ids["wok"], ids["dragon"], id)
+
+	if err := db.DeleteOneById("restaurants", ids["wok"]); err != nil {
+		t.Fatal(err)
+	}
+	check("after deleting", ids["dragon"], id)
+}
+
+func TestPartialUniqueIndex(t *testing.T) {
+	db := openTestDB(t)
+
+	active := Query{{AND, []Condition{{Path: "active", Operator: EQ, Value: true}}}}
+	if err := db.CreatePartialIndex("users", PartialIndex{Path: "email", Filter: active, Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the active users must have distinct emails
+	for _, document := range []Document{
+		{"email": "a@example.com", "active": true},
+		{"email": "a@example.com", "active": false},
+		{"email": "a@example.com", "active": false},
+	} {
+		if _, err := db.InsertOne("users", document); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.InsertOne("users", Document{"email": "a@example.com", "active": true}); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("inserting a duplicate active email returned %v, want ErrDuplicateKey", err)
+	}
+
+	// The emails of the active users are looked up in the partial index, and
+	// the others are found by a full scan
+	email := Condition{Path: "email", Operator: EQ, Value: "a@example.com"}
+	tests := []struct {
+		query    Query
+		strategy string
+		want     int
+	}{
+		{Query{{AND, []Condition{email, {Path: "active", Operator: EQ, Value: true}}}}, StrategyIndex, 1},
+		{Query{{AND, []Condition{email}}}, StrategyFullScan, 3},
+	}
+	for _, test := range tests {
+		plan, err := db.Explain("users", test.query, Options{})
+		if err != nil || plan.Strategy != test.strategy {
+			t.Errorf("%v: strategy %s (%v), want %s", test.query, plan.Strategy, err, test.strategy)
+		}
+		if documents, err := db.FindMany("users", test.query, Options{}); err != nil || len(documents) != test.want {
+			t.Errorf("%v: found %d documents (%v), want %d", test.query, len(documents), err, test.want)
+		}
+	}
+
+	// A unique partial index can't be created over existing duplicates
+	if err := db.CreatePartialIndex("users", PartialIndex{Path: "email", Filter: Query{{AND, []Condition{{Path: "active", Operator: EQ, Value: false}}}}, Unique: true}); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("creating a unique partial index over duplicates returned %v, want ErrDuplicateKey", err)
+	}
+}
+
+func TestLegacyIndexIsUpgradedOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cuisine := range []string{"Chinese", "Chinese", "Thai"} {
+		if _, err := db.InsertOne("restaurants", Document{"cuisine": cuisine}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rewrite the index entries in the layout of version 1, with the list of
+	// IDs of each path-value pair under a single key
+	prefix := getCollectionPrefix("restaurants")
+	lists := map[string][]string{}
+
+	batch := db.index.NewBatch()
+	iter := db.index.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	for iter.First(); iter.Valid(); iter.Next() {
+		if pathValue, id, ok := parseIndexKey(iter.Key()[len(prefix):]); ok {
+			lists[pathValue] = append(lists[pathValue], id)
+			batch.Delete(iter.Key(), nil)
+		}
+	}
+	iter.Close()
+
+	for pathValue, ids := range lists {
+		batch.Set(append(getCollectionPrefix("restaurants"), pathValue...), []byte(strings.Join(ids, idSeparator)), nil)
+	}
+	batch.Delete(indexVersionKey, nil)
+	if err := batch.Commit(pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// A read-only DB can't upgrade the index, and releases the stores it
+	// opened so that the DB can be opened again
+	if _, err := OpenReadOnly(path); err != ErrIndexOutdated {
+		t.Fatalf("got %v when opening read-only, want ErrIndexOutdated", err)
+	}
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := Query{{AND, []Condition{{Path: "cuisine", Operator: EQ, Value: "Chinese"}}}}
+	count, err := db.Count("restaurants", query)
+	if err != nil || count != 2 {
+		t.Fatalf("counted %d documents (%v), want 2", count, err)
+	}
+
+	stats, err := db.IndexStats("restaurants")
+	if err != nil || stats["cuisine"] != 2 {
+		t.Fatalf("index stats %v (%v), want 2 values for cuisine", stats, err)
+	}
+	db.Close()
+
+	// Once upgraded, the index can be read read-only
+	db, err = OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	documents, err := db.FindMany("restaurants", query, Options{})
+	if err != nil || len(documents) != 2 {
+		t.Fatalf("found %d documents read-only (%v), want 2", len(documents), err)
+	}
+}
+
+func TestLookupIndexKeepsTypesApart(t *testing.T) {
+	db := openTestDB(t)
+
+	ids := map[string]string{}
+	for name, flag := range map[string]interface{}{"bool": true, "string": "true", "number": 1} {
+		id, err := db.InsertOne("flags", Document{"flag": flag})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+
+	// true and "true", and nil and "<nil>", have the same string
+	// representation, but the index keeps them apart
+	found, err := db.LookupIndex("flags", "flag", []interface{}{true, 1, "true", 1.0, nil, "missing", true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{ids["bool"]}, {ids["number"]}, {ids["string"]}, {ids["number"]}, {}, {}, {ids["bool"]}}
+	if !slices.EqualFunc(found, want, slices.Equal) {
+		t.Fatalf("found %v, want %v", found, want)
+	}
+}
+
+// Update
+
+func TestFindOneAndUpdateThroughArray(t *testing.T) {
+	db := openTestDB(t)
+
+	id, err := db.InsertOne("orders", Document{
+		"customer": "Alice",
+		"items":    []interface{}{Document{"name": "tea", "price": 3}, Document{"name": "cake", "price": 4}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := Query{{AND, []Condition{{Path: "customer", Operator: EQ, Value: "Alice"}}}}
+	document, err := db.FindOneAndUpdate("orders", query, Document{"items.1.price": 5}, UpdateOptions{ReturnNew: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, ok := document["items"].([]interface{})
+	if !ok || len(items) != 2 {
+		t.Fatalf("got items %v, want the array of both items", document["items"])
+	}
+	if first := items[0].(map[string]interface{}); first["name"] != "tea" || first["price"] != 3.0 {
+		t.Errorf("got first item %v, want it unchanged", first)
+	}
+	if second := items[1].(map[string]interface{}); second["name"] != "cake" || second["price"] != 5.0 {
+		t.Errorf("got second item %v, want its price updated", second)
+	}
+
+	// Paths crossing a string, or an array at a part that isn't a position in
+	// range, are rejected without changing the document
+	for _, path := range []string{"customer.name", "items.price", "items.2.price"} {
+		if _, err := db.FindOneAndUpdate("orders", query, Document{path: 1}); !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("%s: got %v, want ErrInvalidUpdate", path, err)
+		}
+	}
+
+	stored, err := db.FindOneById("orders", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored["customer"] != "Alice" || fmt.Sprint(stored["items"]) != fmt.Sprint(items) {
+		t.Errorf("got %v after the invalid updates, want the document unchanged", stored)
+	}
+}
+
+func TestUpdateOneByIdThroughArray(t *testing.T) {
+	db := openTestDB(t)
+
+	id, err := db.InsertOne("orders", Document{
+		"customer": "Alice",
+		"items":    []interface{}{Document{"name": "tea", "price": 1, "note": "hot"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := UpdateOps{
+		Set:   map[string]interface{}{"items.0.name": "green tea"},
+		Inc:   map[string]float64{"items.0.price": 1},
+		Unset: []string{"items.0.note"},
+	}
+	if err := db.UpdateOneById("orders", id, update); err != nil {
+		t.Fatal(err)
+	}
+
+	document, err := db.FindOneById("orders", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(document["items"]), "[map[name:green tea price:2]]"; got != want {
+		t.Fatalf("got items %s, want %s", got, want)
+	}
+
+	invalidUpdates := []UpdateOps{
+		{Set: map[string]interface{}{"customer.name": "Bob"}},
+		{Inc: map[string]float64{"customer.visits": 1}},
+		{Inc: map[string]float64{"items.price": 1}},
+		{Set: map[string]interface{}{"items.1.price": 1}},
+	}
+	for _, update := range invalidUpdates {
+		if err := db.UpdateOneById("orders", id, update); !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("%+v: got %v, want ErrInvalidUpdate", update, err)
+		}
+	}
+
+	stored, err := db.FindOneById("orders", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored["customer"] != "Alice" || fmt.Sprint(stored["items"]) != fmt.Sprint(document["items"]) {
+		t.Errorf("got %v after the invalid updates, want the document unchanged", stored)
+	}
+}
+
+func TestUpdateCantChangeId(t *testing.T) {
+	db := openTestDB(t)
+
+	id, err := db.InsertOne("orders", Document{"customer": "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, update := range []UpdateOps{
+		{Set: map[string]interface{}{"_id": "other", "customer": "Bob"}},
+		{Inc: map[string]float64{"_id": 1}},
+		{Push: map[string]interface{}{"_id": "other"}},
+		{Pull: map[string]interface{}{"_id": id}},
+		{Unset: []string{"customer", "_id"}},
+	} {
+		if err := db.UpdateOneById("orders", id, update); !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("%+v: got %v, want ErrInvalidUpdate", update, err)
+		}
+		if _, err := db.UpdateMany("orders", Query{{AND, []Condition{{Path: "customer", Operator: EQ, Value: "Alice"}}}}, update); !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("%+v: got %v from UpdateMany, want ErrInvalidUpdate", update, err)
+		}
+	}
+
+	document, err := db.FindOneById("orders", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document["_id"] != id || document["customer"] != "Alice" {
+		t.Fatalf("got %v after the updates of _id, want the document unchanged", document)
+	}
+}
+
+func TestPushAndPullUpdateIndexEntries(t *testing.T) {
+	db := openTestDB(t)
+
+	insertDocuments(t, db, map[string]Document{
+		"noodles": {"tags": []interface{}{"spicy"}, "reviews": []interface{}{Document{"tags": []interface{}{"cheap"}}}},
+		"dim sum": {"tags": []interface{}{"spicy", "sweet"}},
+	})
+
+	documents, err := db.FindMany("restaurants", Query{{AND, []Condition{{Path: "key", Operator: EQ, Value: "noodles"}}}}, Options{})
+	if err != nil || len(documents) != 1 {
+		t.Fatalf("found %v (%v), want the noodles", documents, err)
+	}
+	id := documents[0]["_id"].(string)
+
+	update := UpdateOps{
+		Push: map[string]interface{}{"tags": "vegan", "reviews.0.tags": "quick"},
+		Pull: map[string]interface{}{"tags": "spicy"},
+	}
+	if err := db.UpdateOneById("restaurants", id, update); err != nil {
+		t.Fatal(err)
+	}
+
+	checkResults(t, db, Query{{AND, []Condition{{Path: "tags", Operator: EQ, Value: "vegan"}}}}, "noodles")
+	checkResults(t, db, Query{{AND, []Condition{{Path: "tags", Operator: EQ, Value: "spicy"}}}}, "dim sum")
+	checkResults(t, db, Query{{AND, []Condition{{Path: "reviews.tags", Operator: EQ, Value: "quick"}}}}, "noodles")
+
+	// A path crossing the array of reviews must select a review
+	for _, update := range []UpdateOps{
+		{Push: map[string]interface{}{"reviews.tags": "slow"}},
+		{Pull: map[string]interface{}{"reviews.tags": "cheap"}},
+	} {
+		if err := db.UpdateOneById("restaurants", id, update); !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("%+v: got %v, want ErrInvalidUpdate", update, err)
+		}
+	}
+
+	document, err := db.FindOneById("restaurants", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(document["reviews"]), "[map[tags:[cheap quick]]]"; got != want {
+		t.Errorf("got reviews %s, want %s", got, want)
+	}
+}
+
+func TestIndexStatsOfPathsWithEqualSigns(t *testing.T) {
+	db := openTestDB(t)
+
+	insertDocuments(t, db, map[string]Document{
+		"a": {"x=y": "z", `w\`: "v"},
+		"b": {"x": "y=z", "w": `\=v`},
+	})
+
+	stats, err := db.IndexStats("restaurants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"x=y", "x", `w\`, "w"} {
+		if stats[path] != 1 {
+			t.Fatalf("index stats %v, want a value for %q", stats, path)
+		}
+	}
+
+	checkResults(t, db, Query{{AND, []Condition{{Path: "x=y", Operator: EQ, Value: "z"}}}}, "a")
+	checkResults(t, db, Query{{AND, []Condition{{Path: "x", Operator: EQ, Value: "y=z"}}}}, "b")
+	checkResults(t, db, Query{{AND, []Condition{{Path: `w\`, Operator: EQ, Value: "v"}}}}, "a")
+	checkResults(t, db, Query{{AND, []Condition{{Path: "w", Operator: EQ, Value: `\=v`}}}}, "b")
+}
+
+func TestUniqueIndexesRequireIndexing(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.CreateUniqueIndex("users", "email"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreatePartialIndex("accounts", PartialIndex{
+		Path:   "email",
+		Filter: Query{{AND, []Condition{{Path: "active", Operator: EQ, Value: true}}}},
+		Unique: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Disabling the index would silently stop enforcing the unique indexes
+	for _, collectionName := range []string{"users", "accounts"} {
+		if err := db.SetIndexing(collectionName, false); !errors.Is(err, ErrIndexingRequired) {
+			t.Fatalf("%s: disabling indexing returned %v, want ErrIndexingRequired", collectionName, err)
+		}
+	}
+
+	if _, err := db.InsertOne("users", Document{"email": "a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.InsertOne("users", Document{"email": "a@example.com"}); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("inserting a duplicate email returned %v, want ErrDuplicateKey", err)
+	}
+
+	// Nor can a unique index be created without indexing
+	if err := db.SetIndexing("logs", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateUniqueIndex("logs", "requestId"); !errors.Is(err, ErrIndexingRequired) {
+		t.Fatalf("creating a unique index returned %v, want ErrIndexingRequired", err)
+	}
+	if err := db.CreatePartialIndex("logs", PartialIndex{
+		Path:   "requestId",
+		Filter: Query{{AND, []Condition{{Path: "level", Operator: EQ, Value: "error"}}}},
+		Unique: true,
+	}); !errors.Is(err, ErrIndexingRequired) {
+		t.Fatalf("creating a unique partial index returned %v, want ErrIndexingRequired", err)
+	}
+}
+
+func TestDeleteByIndexValue(t *testing.T) {
+	db := openTestDB(t)
+
+	sessions := []Document{
+		{"status": "expired", "user": Document{"name": "a", "role": "admin"}, "items": []interface{}{Document{"price": 5}}},
+		{"status": "expired", "user": Document{"name": "b", "role": "admin"}, "items": []interface{}{Document{"price": 7}}},
+		{"status": "active", "user": Document{"name": "c", "role": "user"}, "items": []interface{}{Document{"price": 5}}},
+		{"status": "active", "user": Document{"name": "d", "role": "user"}, "items": []interface{}{Document{"price": 9}}},
+	}
+	for _, session := range sessions {
+		if _, err := db.InsertOne("sessions", session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		path    string
+		value   interface{}
+		deleted int
+	}{
+		{"status", "expired", 2},
+		// Neither objects nor paths with array positions are indexed, so
+		// these are deleted by a query
+		{"user", map[string]interface{}{"role": "user", "name": "c"}, 1},
+		{"items.0.price", 9, 1},
+		{"status", "expired", 0},
+	} {
+		deleted, err := db.DeleteByIndexValue("sessions", test.path, test.value)
+		if err != nil || deleted != test.deleted {
+			t.Fatalf("deleted %d documents (%v) with %s = %v, want %d", deleted, err, test.path, test.value, test.deleted)
+		}
+	}
+
+	if count, err := db.Count("sessions", nil); err != nil || count != 0 {
+		t.Fatalf("counted %d documents (%v), want 0", count, err)
+	}
+}
+
+// Soft delete
+
+func TestSoftDeletedDocumentsAreNotReplaced(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.SetSoftDelete("orders", true); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := db.InsertOne("orders", Document{"status": "open"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteOneById("orders", id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.ReplaceOneById("orders", id, Document{"status": "paid"}); err != ErrDocumentNotExists {
+		t.Fatalf("got %v when replacing a soft-deleted document, want ErrDocumentNotExists", err)
+	}
+
+	query := Query{{AND, []Condition{{Path: "_id", Operator: EQ, Value: id}}}}
+	if _, err := db.FindOneAndUpdate("orders", query, Document{"status": "paid"}); err != ErrNoDocuments {
+		t.Fatalf("got %v when updating a soft-deleted document, want ErrNoDocuments", err)
+	}
+
+	if _, err := db.FindOneById("orders", id); err != ErrDocumentNotExists {
+		t.Fatalf("got %v when finding the soft-deleted document, want ErrDocumentNotExists", err)
+	}
+
+	// Upsert inserts a new document in place of the soft-deleted one
+	if _, err := db.Upsert("orders", id, Document{"status": "new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	document, err := db.FindOneById("orders", id)
+	if err != nil || document["status"] != "new" || isDeleted(document) {
+		t.Fatalf("found %v (%v), want the upserted document", document, err)
+	}
+
+	statusQuery := Query{{AND, []Condition{{Path: "status", Operator: EQ, Value: "new"}}}}
+	if count, err := db.Count("orders", statusQuery); err != nil || count != 1 {
+		t.Fatalf("counted %d documents (%v), want the upserted document", count, err)
+	}
+}
+
+func TestCountMatchesFindManyAfterDisablingSoftDelete(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := db.SetSoftDelete("orders", true); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, status := range []string{"open", "paid"} {
+		id, err := db.InsertOne("orders", Document{"status": status, "meta": Document{"_deleted": false}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.DeleteOneById("orders", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The soft-deleted document stays left out until it is purged
+	if err := db.SetSoftDelete("orders", false); err != nil {
+		t.Fatal(err)
+	}
+
+	documents, err := db.FindMany("orders", nil, Options{})
+	if err != nil || len(documents) != 1 {
+		t.Fatalf("found %d documents (%v), want 1", len(documents), err)
+	}
+	if count, err := db.Count("orders", nil); err != nil || count != 1 {
+		t.Fatalf("counted %d documents (%v), want 1 like FindMany", count, err)
+	}
+}
+
+func TestDeletedFieldIsReservedWithoutSoftDelete(t *testing.T) {
+	db := openTestDB(t)
+
+	if _, err := db.InsertOne("orders", Document{"status": "open", "_deleted": true}); !errors.Is(err, ErrInvalidDocument) {
+		t.Fatalf("got %v when inserting a document with _deleted, want ErrInvalidDocument", err)
+	}
+
+	id, err := db.InsertOne("orders", Document{"status": "open"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.ReplaceOneById("orders", id, Document{"status": "paid", "_deleted": true}); !errors.Is(err, ErrInvalidDocument) {
+		t.Fatalf("got %v when replacing with a document with _deleted, want ErrInvalidDocument", err)
+	}
+	if err := db.UpdateOneById("orders", id, UpdateOps{Set: Document{"_deleted": true}}); !errors.Is(err, ErrInvalidDocument) {
+		t.Fatalf("got %v when setting _deleted, want ErrInvalidDocument", err)
+	}
+
+	// Nothing is soft-deleted, so nothing is purged or hidden
+	if purged, err := db.Purge("orders"); err != nil || purged != 0 {
+		t.Fatalf("purged %d documents (%v), want 0", purged, err)
+	}
+
+	query := Query{{AND, []Condition{{Path: "status", Operator: EQ, Value: "open"}}}}
+	for _, options := range []Options{{}, {IncludeDeleted: true}} {
+		documents, err := db.FindMany("orders", query, options)
+		if err != nil || len(documents) != 1 || documents[0]["_id"] != id || isDeleted(documents[0]) {
+			t.Fatalf("found %v (%v) with %+v, want the inserted document", documents, err, options)
+		}
+	}
+
+	if count, err := db.Count("orders", query); err != nil || count != 1 {
+		t.Fatalf("counted %d documents (%v), want 1", count, err)
+	}
+}
+
+// Full-text search
+
+type restaurant struct {
+	Name    string `json:"name" objectdb:"textIndex"`
+	Cuisine string `json:"cuisine"`
+}
+
+// searchIds returns the IDs of the search results, in order.
+func searchIds(results []SearchResult) []string {
+	ids := []string{}
+	for _, result := range results {
+		ids = append(ids, result.Document["_id"].(string))
+	}
+
+	return ids
+}
+
+func TestLargeAndSmallNumbersMatchTheIndex(t *testing.T) {
+	db := openTestDB(t)
+
+	insertDocuments(t, db, map[string]Document{
+		"large": {"value": 1e21},
+		"small": {"value": 1e-7},
+	})
+
+	tests := []struct {
+		value interface{}
+		want  []string
+	}{
+		{1e21, []string{"large"}},
+		{json.Number("1e21"), []string{"large"}},
+		{"1000000000000000000000", []string{"large"}},
+		{"1e+21", nil},
+		{1e-7, []string{"small"}},
+		{"0.0000001", []string{"small"}},
+		{"1e-07", nil},
+	}
+
+	for _, test := range tests {
+		checkResults(t, db, Query{{AND, []Condition{{Path: "value", Operator: EQ, Value: test.value}}}}, test.want...)
+		checkResults(t, db, Query{{AND, []Condition{{Path: "value", Operator: IN, Value: []interface{}{test.value}}}}}, test.want...)
+	}
+}
+
+func TestSearchRanksByScore(t *testing.T) {
+	db := openTestDB(t)
+
+	ids := map[string]string{}
+	for name, document := range map[string]restaurant{
+		"often":  {Name: "Noodle house of noodles and noodle soup"},
+		"once":   {Name: "Noodle and rice bar"},
+		"rarer":  {Name: "Dumpling noodle bar"},
+		"absent": {Name: "Rice bowl"},
+	} {
+		id, err := db.InsertOne("restaurants", document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+
+	results, err := db.SearchWithScores("restaurants", "noodle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || searchIds(results)[0] != ids["often"] {
+		t.Fatalf("found %v, want the 3 restaurants with noodles, the one mentioning them most first", searchIds(results))
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i].Score > results[i-1].Score {
+			t.Fatalf("results are not sorted by descending score: %v", results)
+		}
+	}
+
+	// "dumpling" is rarer than "bar", so it weighs more
+	results, err = db.SearchWithScores("restaurants", "dumpling bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(searchIds(results), []string{ids["rarer"]}) {
+		t.Fatalf("found %v, want the only restaurant with both words", searchIds(results))
+	}
+
+	// Search returns the documents in the same order
+	documents, err := db.Search("restaurants", "noodle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = db.SearchWithScores("restaurants", "noodle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, document := range documents {
+		if document["_id"] != results[i].Document["_id"] {
+			t.Fatalf("Search and SearchWithScores differ at %d", i)
+		}
+	}
+}
+
+func TestFuzzySearch(t *testing.T) {
+	db := openTestDB(t)
+
+	if _, err := db.InsertOne("restaurants", restaurant{Name: "Pizza palace"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text    string
+		options SearchOptions
+		want    int
+	}{
+		{"piza", SearchOptions{}, 0},
+		{"piza", SearchOptions{Fuzzy: true}, 1},
+		{"pzz", SearchOptions{Fuzzy: true}, 1},
+		{"pzz", SearchOptions{Fuzzy: true, MaxDistance: 1}, 0},
+		// The words with an exact match are matched exactly, the others fuzzily
+		{"piza palace", SearchOptions{Fuzzy: true}, 1},
+	}
+
+	for _, test := range tests {
+		documents, err := db.Search("restaurants", test.text, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(documents) != test.want {
+			t.Errorf("%q with %+v: found %d documents, want %d", test.text, test.options, len(documents), test.want)
+		}
+	}
+}
+
+func TestSearchWithHighlights(t *testing.T) {
+	db := openTestDB(t)
+
+	type dish struct {
+		Name        string `json:"name" objectdb:"textIndex"`
+		Description string `json:"description" objectdb:"textIndex"`
+	}
+	if _, err := db.InsertOne("dishes", dish{Name: "Spicy noodles", Description: "Hand-pulled noodles in a spicy broth"}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := db.SearchWithHighlights("dishes", "noodle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("found %d results, want 1", len(results))
+	}
+
+	want := map[string]string{
+		"name":        "Spicy <mark>noodles</mark>",
+		"description": "Hand-pulled <mark>noodles</mark> in a spicy broth",
+	}
+	if highlights := results[0].Highlights; len(highlights) != len(want) || highlights["name"] != want["name"] || highlights["description"] != want["description"] {
+		t.Fatalf("highlights %q, want %q", highlights, want)
+	}
+
+	// Only the fields matching the search are highlighted
+	results, err = db.SearchWithHighlights("dishes", "broth")
+	if err != nil || len(results) != 1 {
+		t.Fatalf("found %d results (%v), want 1", len(results), err)
+	}
+	if highlights := results[0].Highlights; len(highlights) != 1 || highlights["description"] != "Hand-pulled noodles in a spicy <mark>broth</mark>" {
+		t.Fatalf("highlights %q, want the description only", highlights)
+	}
+}
+
+func TestTextFieldWeights(t *testing.T) {
+	db := openTestDB(t)
+
+	type weighted struct {
+		Name    string `json:"name" objectdb:"textIndex;weight=3"`
+		Cuisine string `json:"cuisine" objectdb:"textIndex"`
+	}
+
+	// A match on the name outweighs a match on the cuisine
+	name, err := db.InsertOne("restaurants", weighted{Name: "Thai Garden", Cuisine: "Chinese"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cuisine, err := db.InsertOne("restaurants", weighted{Name: "Golden Wok", Cuisine: "Thai"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := db.SearchWithScores("restaurants", "thai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(searchIds(results), []string{name, cuisine}) {
+		t.Fatalf("found %v, want the name match first", searchIds(results))
+	}
+
+	// The weights apply when scoring, so setting one reorders the results of
+	// the existing documents
+	if err := db.SetTextFieldWeight("restaurants", "cuisine", 10); err != nil {
+		t.Fatal(err)
+	}
+	results, err = db.SearchWithScores("restaurants", "thai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(searchIds(results), []string{cuisine, name}) {
+		t.Fatalf("found %v, want the cuisine match first", searchIds(results))
+	}
+
+	if err := db.SetTextFieldWeight("restaurants", "cuisine", 0); !errors.Is(err, ErrInvalidWeight) {
+		t.Fatalf("setting a weight of 0 returned %v, want ErrInvalidWeight", err)
+	}
+}
+
+// warnLogger records the warnings logged by a DB.
+type warnLogger struct {
+	warnings []string
+}
+
+func (l *warnLogger) Debug(msg string, keysAndValues ...interface{}) {}
+
+func (l *warnLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprint(append([]interface{}{msg}, keysAndValues...)...))
+}
+
+type articleV1 struct {
+	Title string `json:"title" objectdb:"textIndex"`
+	Body  string `json:"body"`
+}
+
+type articleV2 struct {
+	Title string `json:"title" objectdb:"textIndex"`
+	Body  string `json:"body" objectdb:"textIndex"`
+}
+
+func TestStaleTextIndexes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant := db.Namespace("tenant")
+	for _, d := range []*DB{db, tenant} {
+		if _, err := d.InsertOne("articles", articleV1{"Go", "Concurrency"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.InsertOne("notes", Document{"text": "plain"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stale, err := db.StaleTextIndexes(); err != nil || len(stale) != 0 {
+		t.Fatalf("stale text indexes %v (%v), want none", stale, err)
+	}
+
+	// Tagging another field makes the collection stale, until it is rebuilt
+	if _, err := db.InsertOne("articles", articleV2{"Go", "Generics"}); err != nil {
+		t.Fatal(err)
+	}
+	if stale, err := db.StaleTextIndexes(); err != nil || !slices.Equal(stale, []string{"articles"}) {
+		t.Fatalf("stale text indexes %v (%v), want articles", stale, err)
+	}
+	if err := db.RebuildIndexes("articles", articleV2{}); err != nil {
+		t.Fatal(err)
+	}
+	if stale, err := db.StaleTextIndexes(); err != nil || len(stale) != 0 {
+		t.Fatalf("stale text indexes %v (%v) after rebuilding, want none", stale, err)
+	}
+	db.Close()
+
+	// Another configuration makes all the indexed collections stale, in all
+	// the namespaces, whether a logger is set or not
+	logger := &warnLogger{}
+	db, err = Open(path, OpenOptions{Logger: logger, FTS: FTSConfig{Language: "french"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if len(logger.warnings) != 4 {
+		t.Fatalf("warnings %v, want one per collection", logger.warnings)
+	}
+	for _, d := range []*DB{db, db.Namespace("tenant")} {
+		if stale, err := d.StaleTextIndexes(); err != nil || !slices.Equal(stale, []string{"articles", "notes"}) {
+			t.Fatalf("stale text indexes %v (%v), want articles and notes", stale, err)
+		}
+	}
+}
+
+// Transactions
+
+func TestTxnUpdateOneById(t *testing.T) {
+	db := openTestDB(t)
+
+	counterId, err := db.InsertOne("counters", Document{"orders": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Rollback()
+
+	orderId, err := txn.InsertOne("orders", Document{"status": "open"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := UpdateOps{Set: map[string]interface{}{"lastOrderId": orderId}, Inc: map[string]float64{"orders": 1}}
+	if err := txn.UpdateOneById("counters", counterId, update); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads through the transaction see its pending writes
+	if _, err := txn.FindOneById("orders", orderId); err != nil {
+		t.Fatalf("pending order: %v", err)
+	}
+	counter, err := txn.FindOneById("counters", counterId)
+	if err != nil || counter["orders"] != 1.0 || counter["lastOrderId"] != orderId {
+		t.Fatalf("found pending counter %v (%v), want it updated", counter, err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Fatalf("got %v when committing again, want ErrTxnDone", err)
+	}
+	if err := txn.UpdateOneById("counters", counterId, update); err != ErrTxnDone {
+		t.Fatalf("got %v when updating after the commit, want ErrTxnDone", err)
+	}
+
+	query := Query{{AND, []Condition{{Path: "lastOrderId", Operator: EQ, Value: orderId}}}}
+	counters, err := db.FindMany("counters", query, Options{})
+	if err != nil || len(counters) != 1 || counters[0]["orders"] != 1.0 {
+		t.Fatalf("found %v (%v), want the updated counter through the index", counters, err)
+	}
+}
+
+func TestTxnRollbackDiscardsAllWrites(t *testing.T) {
+	db := openTestDB(t)
+
+	id, err := db.InsertOne("restaurants", restaurant{Name: "Noodle bar", Cuisine: "Chinese"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := txn.InsertOne("restaurants", restaurant{Name: "Dumpling house", Cuisine: "Chinese"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.UpdateOneById("restaurants", id, UpdateOps{Set: map[string]interface{}{"name": "Rice bowl", "cuisine": "Japanese"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store is unchanged
+	documents, err := db.FindMany("restaurants", nil, Options{})
+	if err != nil || len(documents) != 1 || documents[0]["name"] != "Noodle bar" {
+		t.Fatalf("found %v (%v), want the restaurant as before the transaction", documents, err)
+	}
+
+	// So is the index
+	for cuisine, want := range map[string]int{"Chinese": 1, "Japanese": 0} {
+		query := Query{{AND, []Condition{{Path: "cuisine", Operator: EQ, Value: cuisine}}}}
+		if count, err := db.Count("restaurants", query); err != nil || count != want {
+			t.Errorf("%s: counted %d (%v), want %d", cuisine, count, err, want)
+		}
+	}
+
+	// And the full-text search index
+	for text, want := range map[string]int{"noodle": 1, "dumpling": 0, "rice": 0} {
+		if results, err := db.SearchWithScores("restaurants", text); err != nil || len(results) != want {
+			t.Errorf("%s: found %v (%v), want %d results", text, searchIds(results), err, want)
+		}
+	}
+
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Fatalf("got %v when committing after the rollback, want ErrTxnDone", err)
+	}
+}
+
+// Metrics
+
+// recordingMetrics records the operations observed by a DB, with the matched
+// documents of the queries and the errors of the writes.
+type recordingMetrics struct {
+	mu      sync.Mutex
+	queries map[string]int
+	writes  map[string]error
+}
+
+func (m *recordingMetrics) ObserveQuery(op string, d time.Duration, matched int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries[op] = matched
+}
+
+func (m *recordingMetrics) ObserveWrite(op string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes[op] = err
+}
+
+func TestMetricsObserveAllQueriesAndWrites(t *testing.T) {
+	metrics := &recordingMetrics{queries: map[string]int{}, writes: map[string]error{}}
+	db := openTestDB(t, OpenOptions{Metrics: metrics})
+
+	for i := 1; i <= 3; i++ {
+		if _, err := db.Upsert("books", fmt.Sprintf("id%d", i), Document{"pages": i * 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := db.FindPage("books", nil, Options{Limit: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.FindRange("books", "id2", "", Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Distinct("books", "pages", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Aggregate("books", "pages", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Explain("books", nil, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A FindIter query is observed once its cursor is closed
+	cursor, err := db.FindIter("books", nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor.Next()
+	if _, ok := metrics.queries["FindIter"]; ok {
+		t.Fatal("FindIter observed before the cursor is closed")
+	}
+	cursor.Close()
+
+	want := map[string]int{
+		"FindPage":  2,
+		"FindRange": 2,
+		"Distinct":  3,
+		"Aggregate": 3,
+		"Explain":   3,
+		"FindIter":  1,
+	}
+	for op, matched := range want {
+		if got, ok := metrics.queries[op]; !ok || got != matched {
+			t.Errorf("%s observed with %d documents (%v), want %d", op, got, ok, matched)
+		}
+	}
+
+	var backup, export strings.Builder
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Export("books", &export); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetSoftDelete("books", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteOneById("books", "id1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Purge("books"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Import("copies", strings.NewReader(export.String())); err != nil {
+		t.Fatal(err)
+	}
+	if err := openTestDB(t, OpenOptions{Metrics: metrics}).Restore(strings.NewReader(backup.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{"Purge", "Import", "Restore"} {
+		if err, ok := metrics.writes[op]; !ok || err != nil {
+			t.Errorf("%s observed: %v (%v), want observed without error", op, ok, err)
+		}
+	}
+}
+
+// Storage
+
+func TestStatsCountKeysPerNamespace(t *testing.T) {
+	db := openTestDB(t)
+	tenant := db.Namespace("tenant")
+
+	for _, tag := range []string{"a", "b"} {
+		if _, err := db.InsertOne("notes", note{Tag: tag, Text: "root words"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tenant.InsertOne("notes", note{Tag: "c", Text: "tenant words"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rootStats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantStats, err := tenant.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The root DB counts the keys of all the namespaces
+	if rootStats.Store.Keys != 3 || tenantStats.Store.Keys != 1 {
+		t.Fatalf("counted %d and %d document keys, want 3 and 1", rootStats.Store.Keys, tenantStats.Store.Keys)
+	}
+	for name, keys := range map[string][2]int{
+		"index":      {rootStats.Index.Keys, tenantStats.Index.Keys},
+		"text index": {rootStats.TextIndex.Keys, tenantStats.TextIndex.Keys},
+	} {
+		if keys[1] == 0 || keys[0] <= keys[1] {
+			t.Fatalf("counted %d and %d %s keys, want more in the root DB than in the namespace", keys[0], keys[1], name)
+		}
+	}
+
+	// Deleting the document of the namespace removes its keys
+	if err := tenant.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if tenantStats, err = tenant.Stats(); err != nil || tenantStats.Store.Keys != 0 {
+		t.Fatalf("counted %d document keys (%v) after clearing the namespace, want 0", tenantStats.Store.Keys, err)
+	}
+}
+
+func TestCompactKeepsCollectionData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for i := 0; i < 20; i++ {
+		id, err := db.InsertOne("notes", note{Tag: fmt.Sprintf("tag%d", i%2), Text: "compacted words"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids[:10] {
+		if err := db.DeleteOneById("notes", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Compact("notes"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range ids[10:] {
+		if _, err := db.FindOneById("notes", id); err != nil {
+			t.Fatalf("document %s after compaction: %v", id, err)
+		}
+	}
+	query := Query{{AND, []Condition{{Path: "tag", Operator: EQ, Value: "tag1"}}}}
+	if count, err := db.Count("notes", query); err != nil || count != 5 {
+		t.Fatalf("counted %d documents by index (%v) after compaction, want 5", count, err)
+	}
+	if results, err := db.Search("notes", "compacted"); err != nil || len(results) != 10 {
+		t.Fatalf("found %d documents by search (%v) after compaction, want 10", len(results), err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	readOnly, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+
+	if err := readOnly.Compact("notes"); err != ErrReadOnly {
+		t.Fatalf("got %v when compacting read-only, want ErrReadOnly", err)
+	}
+}
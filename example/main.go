@@ -141,13 +141,13 @@ func main() {
 
 	// Find 2 chinese restaurants in the postcode of 10000
 	resQuery := objectdb.Query{
-		{"AND", []objectdb.Condition{
+		{objectdb.AND, []objectdb.Condition{
 			{Path: "cuisine", Operator: "=", Value: "Chinese"},
 			{Path: "address.postcode", Operator: "=", Value: "10000"},
 		}},
 	}
 
-	chineseRestaurants, err := db.FindMany("restaurants", resQuery, objectdb.Options{Limit: 2})
+	chineseRestaurants, err := objectdb.FindManyAs[Restaurant](db, "restaurants", resQuery, objectdb.Options{Limit: 2})
 
 	if err != nil {
 		log.Fatalf("error finding chinese restaurants: %v", err)
@@ -156,20 +156,13 @@ func main() {
 
 	// Print the chinese restaurants
 	fmt.Println("\n2 Chinese restaurants in 10000:")
-	for index, doc := range chineseRestaurants {
-		restaurant := Restaurant{}
-		err := objectdb.Unmarshal(doc, &restaurant)
-		if err != nil {
-			log.Fatalf("error unmarshalling restaurant: %v", err)
-			return
-		}
-
+	for index, restaurant := range chineseRestaurants {
 		fmt.Printf("%d: %+v\n", index, restaurant)
 	}
 
 	// Find one employee with the age of 30
 	employee, err := db.FindOne("employees", objectdb.Query{
-		{"AND", []objectdb.Condition{
+		{objectdb.AND, []objectdb.Condition{
 			{Path: "age", Operator: "=", Value: 30},
 		}},
 	})
@@ -196,11 +189,11 @@ func main() {
 
 	// Find employees named John or Jane, whose age is between 20 and 30
 	myQuery := objectdb.Query{
-		{"OR", []objectdb.Condition{
+		{objectdb.OR, []objectdb.Condition{
 			{Path: "name", Operator: "=", Value: "Jane"},
 			{Path: "name", Operator: "=", Value: "John"},
 		}},
-		{"AND", []objectdb.Condition{
+		{objectdb.AND, []objectdb.Condition{
 			{Path: "age", Operator: ">", Value: 20},
 			{Path: "age", Operator: "<", Value: 40},
 		}},
@@ -1,24 +1,116 @@
 package fts
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"math"
 	"reflect"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 
 	"github.com/cockroachdb/pebble"
-	snowballeng "github.com/kljensen/snowball/english"
+	"github.com/kljensen/snowball"
 )
 
 type FTS struct {
-	textIndex *pebble.DB // Inverted index store
+	textIndex    *pebble.DB           // Inverted index store
+	stopwords    map[string]struct{}  // Tokens left out of the index
+	language     string               // Language of the stemmer
+	tokenizer    Tokenizer            // Splits the texts into tokens
+	writeOptions *pebble.WriteOptions // Options of the writes to the text index
+	logger       Logger               // Receives the debug logs, if not nil
+	configHash   string               // Hash of the text analysis configuration
+	warned       sync.Map             // Collections already warned about a stale text schema
 }
 
-func NewFTS(path string) (*FTS, error) {
-	textIndex, err := pebble.Open(path, &pebble.Options{})
+// Logger receives logs as a message followed by alternating keys and values,
+// like *slog.Logger.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+}
+
+// Config configures the text analysis of the full-text search. Changing it
+// for an existing index requires rebuilding the index, as the stored tokens
+// were produced with the previous configuration.
+type Config struct {
+	// Stopwords are the lowercase tokens left out of the index and the
+	// queries. Nil uses a small set of English stopwords, while an empty map
+	// disables stopword removal.
+	Stopwords map[string]struct{}
+	// Language is the language of the Snowball stemmer, e.g. "english",
+	// "french" or "spanish". Defaults to "english".
+	Language string
+	// Tokenizer splits the texts into tokens. Nil splits them on the
+	// characters that are neither letters nor numbers.
+	Tokenizer Tokenizer
+}
+
+// Tokenizer splits a text into tokens, e.g. into n-grams for languages
+// written without spaces like Chinese or Japanese. The tokens are then
+// lowercased, filtered and stemmed like the default ones.
+type Tokenizer func(text string) []string
+
+var defaultStopwords = map[string]struct{}{
+	"a": {}, "and": {}, "be": {}, "have": {}, "i": {},
+	"in": {}, "of": {}, "that": {}, "the": {}, "to": {},
+}
+
+func NewFTS(path string, config ...Config) (*FTS, error) {
+	return NewFTSWithOptions(path, &pebble.Options{}, config...)
+}
+
+// NewFTSWithOptions is like NewFTS, but opens the text index with the given
+// Pebble options, e.g. to size its cache or to open it read-only.
+func NewFTSWithOptions(path string, options *pebble.Options, config ...Config) (*FTS, error) {
+	fts := FTS{stopwords: defaultStopwords, language: "english", tokenizer: tokenize, writeOptions: pebble.Sync}
+	if len(config) > 0 {
+		if config[0].Stopwords != nil {
+			fts.stopwords = config[0].Stopwords
+		}
+		if config[0].Language != "" {
+			fts.language = config[0].Language
+		}
+		if config[0].Tokenizer != nil {
+			fts.tokenizer = config[0].Tokenizer
+		}
+	}
+
+	// Check that the stemmer supports the language
+	if _, err := snowball.Stem("", fts.language, false); err != nil {
+		return nil, err
+	}
+
+	fts.configHash = hashConfig(fts.stopwords, fts.language, len(config) > 0 && config[0].Tokenizer != nil)
+
+	textIndex, err := pebble.Open(path, options)
 	if err != nil {
 		return nil, err
 	}
-	return &FTS{textIndex: textIndex}, nil
+	fts.textIndex = textIndex
+
+	return &fts, nil
+}
+
+// SetWriteOptions sets the options of the writes to the text index, e.g.
+// pebble.NoSync to not wait for the writes to be synced to disk.
+func (fts *FTS) SetWriteOptions(writeOptions *pebble.WriteOptions) {
+	fts.writeOptions = writeOptions
+}
+
+// SetLogger sets the logger receiving the debug logs, e.g. the tokens of the
+// analyzed search texts. Nil disables the logs.
+func (fts *FTS) SetLogger(logger Logger) {
+	fts.logger = logger
 }
 
 func (fts *FTS) Close() error {
@@ -46,11 +138,7 @@ func lowercaseFilter(tokens []string) []string {
 }
 
 // -- -- Stop Words
-func stopwordFilter(tokens []string) []string {
-	var stopwords = map[string]struct{}{
-		"a": {}, "and": {}, "be": {}, "have": {}, "i": {},
-		"in": {}, "of": {}, "that": {}, "the": {}, "to": {},
-	}
+func stopwordFilter(tokens []string, stopwords map[string]struct{}) []string {
 	r := make([]string, 0, len(tokens))
 	for _, token := range tokens {
 		if _, ok := stopwords[token]; !ok {
@@ -61,223 +149,1544 @@ func stopwordFilter(tokens []string) []string {
 }
 
 // -- -- Stemming
-func stemmerFilter(tokens []string) []string {
+func stemmerFilter(tokens []string, language string) []string {
+	r := make([]string, len(tokens))
+	for i, token := range tokens {
+		// The language is checked by NewFTS, so stemming can't fail
+		r[i], _ = snowball.Stem(token, language, false)
+	}
+	return r
+}
+
+// -- -- Accent Folding
+// Folding comes before stemming for the languages of foldBeforeStemming, and
+// after it for the others, whose stemmers rely on the accents.
+
+// foldBeforeStemming are the languages whose stemmers don't rely on accents.
+// Their tokens are folded before stemming, as the stemmer would otherwise take
+// an accented letter for a consonant, e.g. stem "résumés" unlike "resumes".
+var foldBeforeStemming = map[string]bool{"english": true}
+
+// accentFolder replaces the accented Latin letters, already lowercase, with
+// their plain forms, e.g. "café" with "cafe", so that searching without the
+// accents matches them.
+var accentFolder = newAccentFolder(map[string]string{
+	"a":  "àáâãäåāăą",
+	"ae": "æ",
+	"c":  "çćĉċč",
+	"d":  "ďđð",
+	"e":  "èéêëēĕėęě",
+	"g":  "ĝğġģ",
+	"h":  "ĥħ",
+	"i":  "ìíîïĩīĭįı",
+	"ij": "ĳ",
+	"j":  "ĵ",
+	"k":  "ķ",
+	"l":  "ĺļľŀł",
+	"n":  "ñńņň",
+	"o":  "òóôõöøōŏő",
+	"oe": "œ",
+	"r":  "ŕŗř",
+	"s":  "śŝşš",
+	"ss": "ß",
+	"t":  "ţťŧ",
+	"th": "þ",
+	"u":  "ùúûüũūŭůűų",
+	"w":  "ŵ",
+	"y":  "ýÿŷ",
+	"z":  "źżž",
+})
+
+// newAccentFolder builds a replacer of each accented letter with its plain form.
+func newAccentFolder(letters map[string]string) *strings.Replacer {
+	var oldnew []string
+	for plain, accented := range letters {
+		for _, letter := range accented {
+			oldnew = append(oldnew, string(letter), plain)
+		}
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+func accentFoldingFilter(tokens []string) []string {
 	r := make([]string, len(tokens))
 	for i, token := range tokens {
-		r[i] = snowballeng.Stem(token, false)
+		r[i] = accentFolder.Replace(token)
 	}
 	return r
 }
 
 // -- Analysis Pipeline
-func analyze(text string) []string {
-	tokens := tokenize(text)
+func (fts *FTS) analyze(text string) []string {
+	tokens := fts.tokenizer(text)
 	tokens = lowercaseFilter(tokens)
-	tokens = stopwordFilter(tokens)
-	tokens = stemmerFilter(tokens)
+	tokens = stopwordFilter(tokens, fts.stopwords)
+	if foldBeforeStemming[fts.language] {
+		tokens = accentFoldingFilter(tokens)
+		tokens = stemmerFilter(tokens, fts.language)
+	} else {
+		tokens = stemmerFilter(tokens, fts.language)
+		tokens = accentFoldingFilter(tokens)
+	}
 	return tokens
 }
 
+// NewBatch returns a batch of changes to the inverted index. The pending
+// changes are visible to reads through the batch until it is committed.
+func (fts *FTS) NewBatch() *pebble.Batch {
+	return fts.textIndex.NewIndexedBatch()
+}
+
+// NewSnapshot returns a point-in-time view of the inverted index, e.g. to back
+// it up consistently with concurrent writes.
+func (fts *FTS) NewSnapshot() *pebble.Snapshot {
+	return fts.textIndex.NewSnapshot()
+}
+
+// Metrics returns the metrics of the inverted index store, e.g. its disk
+// usage.
+func (fts *FTS) Metrics() *pebble.Metrics {
+	return fts.textIndex.Metrics()
+}
+
 // Building the Inverted Index
 func (fts *FTS) AddToIndex(collectionName string, id string, document interface{}) error {
-	// Get the text fields
-	t := reflect.TypeOf(document)
-	v := reflect.ValueOf(document)
-	typeOfDoc := v.Type()
+	batch := fts.NewBatch()
+	defer batch.Close()
+
+	if err := fts.AddToIndexBatch(batch, collectionName, id, document); err != nil {
+		return err
+	}
+
+	return batch.Commit(fts.writeOptions)
+}
+
+// AddToIndexBatch is like AddToIndex, but writes the changes to a batch
+// created by NewBatch instead of committing them.
+func (fts *FTS) AddToIndexBatch(batch *pebble.Batch, collectionName string, id string, document interface{}) error {
+	// Count the occurrences of each token in each text field of the document
+	termFrequencies := map[string]map[string]int{}
+
+	var textFields []textField
+	if reflect.Indirect(reflect.ValueOf(document)).Kind() == reflect.Map {
+		// Maps have no tags, so the text fields are the ones added to the
+		// collection with AddTextFields
+		var err error
+		textFields, err = getMapTextFields(batch, collectionName, document)
+		if err != nil {
+			return err
+		}
+	} else {
+		textFields = getTextFields(reflect.ValueOf(document), "", 0)
+	}
+
+	// Record the text schema of the collection, or warn if the collection was
+	// indexed with other text fields or another configuration
+	if err := fts.checkTextSchema(batch, collectionName, document); err != nil {
+		return err
+	}
+
+	var paths []string
+	weights := map[string]float64{}
+	for _, textField := range textFields {
+		paths = append(paths, textField.path)
+		if textField.weight != 0 {
+			weights[textField.path] = textField.weight
+		}
+
+		for _, text := range textField.texts {
+			for _, token := range fts.analyze(text) {
+				if termFrequencies[token] == nil {
+					termFrequencies[token] = map[string]int{}
+				}
+				termFrequencies[token][textField.path]++
+			}
+		}
+	}
+
+	// Record the paths of the text fields, so that they can be found in the
+	// stored document when it is deleted
+	if err := addTextFieldPaths(batch, collectionName, paths); err != nil {
+		return err
+	}
+
+	// Record the weights of the tagged fields, which are applied when scoring
+	if err := setTextFieldWeights(batch, collectionName, weights); err != nil {
+		return err
+	}
+
+	alreadyIndexed := false
+	for token, termFrequency := range termFrequencies {
+		// Add the document to the posting list of the token, with the term
+		// frequency of each field for scoring
+		postingKey := getPostingKey(collectionName, token, id)
+
+		found, err := hasKey(batch, postingKey)
+		if err != nil {
+			return err
+		}
+		if found {
+			alreadyIndexed = true
+		}
+
+		value, err := json.Marshal(termFrequency)
+		if err != nil {
+			return err
+		}
+
+		if err := batch.Set(postingKey, value, nil); err != nil {
+			return err
+		}
+	}
+
+	// Count the document once it has been indexed
+	if len(termFrequencies) > 0 && !alreadyIndexed {
+		return fts.addToDocumentCount(batch, collectionName, 1)
+	}
+
+	return nil
+}
+
+// textField is the text of a field tagged with textIndex, along with the path
+// of the field in the JSON representation of the document and the weight set
+// by the tag. Fields of map documents have no tag, and so a weight of 0.
+type textField struct {
+	path   string
+	texts  []string
+	weight float64
+}
+
+// getTextFields returns the fields tagged with textIndex in a struct,
+// including the tagged fields of nested structs. Values that are not structs
+// have no text fields. Fields that are left out of the JSON representation
+// are not indexed, as they are not stored with the document. If tagWeight is
+// not 0, all the fields are indexed as if they were tagged with that weight.
+func getTextFields(v reflect.Value, prefix string, tagWeight float64) []textField {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var textFields []textField
+	t := v.Type()
 
 	// Iterate through the fields
 	for i := 0; i < v.NumField(); i++ {
-		fieldName := typeOfDoc.Field(i).Name
-		field, found := t.FieldByName(fieldName)
-		if !found {
+		field := t.Field(i)
+		if !field.IsExported() && !field.Anonymous {
+			continue
+		}
+
+		name, named := getJSONFieldName(field)
+		if name == "-" {
 			continue
 		}
 
-		// Get the tag value
-		tagValue := field.Tag.Get("objectdb")
-
-		// Split the tag value by ;
-		tagValues := strings.Split(tagValue, ";")
-
-		// Check if the tag value contains "textIndex"
-		for _, tag := range tagValues {
-			if tag == "textIndex" {
-				// This field will be indexed for full-text search
-				fieldValue := v.Field(i).Interface()
-
-				tokens := analyze(fieldValue.(string))
-
-				for _, token := range tokens {
-					// Add the token to the inverted index
-					// -- Build the key
-					indexKey := getIndexKey(collectionName, token)
-					// -- Get the existing value
-					idsString, closer, err := fts.textIndex.Get(indexKey)
-					if err != nil && err != pebble.ErrNotFound {
-						return err
-					}
-
-					if len(idsString) == 0 {
-						idsString = []byte(id)
-					} else {
-						ids := strings.Split(string(idsString), ",")
-
-						found := false
-						for _, existingId := range ids {
-							if id == existingId {
-								found = true
-							}
-						}
-
-						if !found {
-							idsString = append(idsString, []byte(","+id)...)
-						}
-					}
-
-					if closer != nil {
-						err = closer.Close()
-						if err != nil {
-							return err
-						}
-					}
-
-					err = fts.textIndex.Set([]byte(indexKey), idsString, pebble.Sync)
-					if err != nil {
-						return err
-					}
+		// The fields of an embedded struct without a JSON name are promoted
+		path := prefix
+		if !field.Anonymous || named {
+			path = prefix + name
+		}
+
+		tagged, weight := parseTextIndexTag(field)
+		if tagWeight != 0 {
+			tagged, weight = true, tagWeight
+		}
+
+		if tagged && path == prefix {
+			// The fields of a tagged embedded struct are stored, and so indexed, one by one
+			textFields = append(textFields, getTextFields(v.Field(i), prefix, weight)...)
+		} else if tagged {
+			// This field will be indexed for full-text search
+			textFields = append(textFields, textField{path: path, texts: appendText(nil, v.Field(i)), weight: weight})
+		} else if path == prefix {
+			textFields = append(textFields, getTextFields(v.Field(i), prefix, 0)...)
+		} else {
+			// Look for tagged fields in a nested struct
+			textFields = append(textFields, getTextFields(v.Field(i), path+".", 0)...)
+		}
+	}
+
+	return textFields
+}
+
+// getJSONFieldName returns the name of the field in the JSON representation,
+// and whether the name is set by the json tag.
+func getJSONFieldName(field reflect.StructField) (string, bool) {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name, false
+	}
+
+	return name, true
+}
+
+// parseTextIndexTag reports whether the field is tagged with textIndex, and
+// returns the weight set with weight=, e.g. "textIndex;weight=3", which is 1
+// if not set. Weights that are not positive numbers are ignored.
+func parseTextIndexTag(field reflect.StructField) (bool, float64) {
+	tagged := false
+	weight := 1.0
+
+	// Split the tag value by ;
+	for _, tag := range strings.Split(field.Tag.Get("objectdb"), ";") {
+		if tag == "textIndex" {
+			tagged = true
+		} else if value, ok := strings.CutPrefix(tag, "weight="); ok {
+			if w, err := strconv.ParseFloat(value, 64); err == nil && w > 0 {
+				weight = w
+			}
+		}
+	}
+
+	return tagged, weight
+}
+
+// appendText appends the text of a tagged field. Numbers and booleans are
+// formatted as text, the elements of slices and arrays are appended one by
+// one, and all the exported fields of a struct are appended, unless the struct
+// marshals itself as text like time.Time.
+func appendText(texts []string, v reflect.Value) []string {
+	switch v.Kind() {
+	case reflect.String:
+		return append(texts, v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return append(texts, strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return append(texts, strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		return append(texts, strconv.FormatFloat(v.Float(), 'f', -1, 64))
+	case reflect.Bool:
+		return append(texts, strconv.FormatBool(v.Bool()))
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return texts
+		}
+		return appendText(texts, v.Elem())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// Bytes are binary data rather than text
+			return texts
+		}
+		for i := 0; i < v.Len(); i++ {
+			texts = appendText(texts, v.Index(i))
+		}
+		return texts
+	case reflect.Struct:
+		if v.CanInterface() {
+			if marshaler, ok := v.Interface().(encoding.TextMarshaler); ok {
+				text, err := marshaler.MarshalText()
+				if err != nil {
+					return texts
 				}
+				return append(texts, string(text))
+			}
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				texts = appendText(texts, v.Field(i))
 			}
 		}
+		return texts
 	}
 
-	return nil
+	// Maps, channels and functions have no text
+	return texts
+}
+
+// appendValueText appends the text of a value decoded from JSON, formatted
+// the same way as appendText formats the text of a tagged field.
+func appendValueText(texts []string, value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return append(texts, value)
+	case float64:
+		return append(texts, strconv.FormatFloat(value, 'f', -1, 64))
+	case bool:
+		return append(texts, strconv.FormatBool(value))
+	case []interface{}:
+		for _, element := range value {
+			texts = appendValueText(texts, element)
+		}
+	case map[string]interface{}:
+		for _, fieldValue := range value {
+			texts = appendValueText(texts, fieldValue)
+		}
+	}
+
+	return texts
 }
 
 // Deleting from the Inverted Index
 func (fts *FTS) DeleteFromIndex(collectionName string, id string, document map[string]interface{}) error {
-	// Iterate through the fields
-	for _, fieldValue := range document {
-		// Check if the field is string type
-		if reflect.TypeOf(fieldValue).Kind() != reflect.String {
-			continue
+	batch := fts.NewBatch()
+	defer batch.Close()
+
+	if err := fts.DeleteFromIndexBatch(batch, collectionName, id, document); err != nil {
+		return err
+	}
+
+	return batch.Commit(fts.writeOptions)
+}
+
+// DeleteFromIndexBatch is like DeleteFromIndex, but writes the changes to a
+// batch created by NewBatch instead of committing them.
+func (fts *FTS) DeleteFromIndexBatch(batch *pebble.Batch, collectionName string, id string, document map[string]interface{}) error {
+	removed := false
+
+	paths, err := getTextFieldPaths(batch, collectionName)
+	if err != nil {
+		return err
+	}
+
+	// Only remove the text of the fields that were indexed. Without recorded
+	// paths, e.g. for an index built before they were recorded, the text of
+	// all the fields, including nested ones, is removed.
+	var texts []string
+	if paths == nil {
+		texts = appendValueText(texts, map[string]interface{}(document))
+	}
+	for _, path := range paths {
+		if value, ok := getValueFromPath(document, path); ok {
+			texts = appendValueText(texts, value)
 		}
+	}
 
-		tokens := analyze(fieldValue.(string))
+	for _, text := range texts {
+		tokens := fts.analyze(text)
 
 		for _, token := range tokens {
-			// -- Build the key
-			indexKey := getIndexKey(collectionName, token)
-			// -- Get the existing value
-			idsString, closer, err := fts.textIndex.Get(indexKey)
-			if err != nil && err != pebble.ErrNotFound {
+			// Remove the document from the posting list of the token, if it
+			// is still in it, as the token may be repeated in the texts
+			postingKey := getPostingKey(collectionName, token, id)
+
+			found, err := hasKey(batch, postingKey)
+			if err != nil {
 				return err
 			}
-
-			if len(idsString) == 0 {
-				// No match
+			if !found {
 				continue
-			} else {
-				ids := strings.Split(string(idsString), ",")
-
-				// Remove the id from the list
-				var newIds []string
-				for _, existingId := range ids {
-					if id != existingId {
-						newIds = append(newIds, existingId)
-					}
-				}
-
-				// Update the inverted index
-				if len(newIds) == 0 {
-					err = fts.textIndex.Delete(indexKey, pebble.Sync)
-					if err != nil {
-						return err
-					}
-				} else {
-					idsString = []byte(strings.Join(newIds, ","))
-					err = fts.textIndex.Set([]byte(indexKey), idsString, pebble.Sync)
-					if err != nil {
-						return err
-					}
-				}
 			}
 
-			if closer != nil {
-				err = closer.Close()
-				if err != nil {
-					return err
-				}
+			if err := batch.Delete(postingKey, nil); err != nil {
+				return err
 			}
+			removed = true
 		}
 	}
 
+	if removed {
+		return fts.addToDocumentCount(batch, collectionName, -1)
+	}
+
 	return nil
 }
 
-// Querying
-func (fts *FTS) Search(collectionName, text string) ([]string, error) {
-	var matchedIds []string
+// getTextFieldPaths returns the paths of the text fields indexed in the
+// collection, which is nil if none were recorded.
+func getTextFieldPaths(reader pebble.Reader, collectionName string) ([]string, error) {
+	value, closer, err := reader.Get(getTextFieldsKey(collectionName))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
 
-	tokens := analyze(text)
-	for _, token := range tokens {
-		// Get the existing value
-		indexKey := getIndexKey(collectionName, token)
-		idsString, closer, err := fts.textIndex.Get(indexKey)
-		if err != nil && err != pebble.ErrNotFound {
-			return nil, err
-		}
+	var paths []string
+	if err := json.Unmarshal(value, &paths); err != nil {
+		return nil, err
+	}
 
-		if len(idsString) == 0 {
-			// No match
-			continue
-		} else {
-			ids := strings.Split(string(idsString), ",")
+	return paths, nil
+}
+
+// AddTextFields adds dot-separated paths to the text fields of the
+// collection. Documents inserted as maps, which have no struct tags, are
+// indexed on the text fields of their collection.
+func (fts *FTS) AddTextFields(collectionName string, paths ...string) error {
+	batch := fts.NewBatch()
+	defer batch.Close()
+
+	if err := addTextFieldPaths(batch, collectionName, paths); err != nil {
+		return err
+	}
+
+	return batch.Commit(fts.writeOptions)
+}
+
+// SetTextFieldWeight sets the weight of the text field at a dot-separated
+// path of the collection, by which the occurrences of the search terms in the
+// field are multiplied when scoring. Fields weigh 1 by default. It overrides
+// the weight of a tagged field until a document with that tag is indexed.
+func (fts *FTS) SetTextFieldWeight(collectionName, path string, weight float64) error {
+	batch := fts.NewBatch()
+	defer batch.Close()
+
+	if err := setTextFieldWeights(batch, collectionName, map[string]float64{path: weight}); err != nil {
+		return err
+	}
+
+	return batch.Commit(fts.writeOptions)
+}
+
+// getTextFieldWeights returns the weights of the text fields of the
+// collection that don't weigh 1.
+func getTextFieldWeights(reader pebble.Reader, collectionName string) (map[string]float64, error) {
+	value, closer, err := reader.Get(getTextFieldWeightsKey(collectionName))
+	if err == pebble.ErrNotFound {
+		return map[string]float64{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	weights := map[string]float64{}
+	if err := json.Unmarshal(value, &weights); err != nil {
+		return nil, err
+	}
+
+	return weights, nil
+}
+
+// setTextFieldWeights records the weights of text fields of the collection.
+// Only the weights other than 1 are stored.
+func setTextFieldWeights(batch *pebble.Batch, collectionName string, newWeights map[string]float64) error {
+	weights, err := getTextFieldWeights(batch, collectionName)
+	if err != nil {
+		return err
+	}
 
-			if len(matchedIds) == 0 {
-				matchedIds = ids
-			} else {
-				// Find the intersection
-				matchedIds = intersection(matchedIds, ids)
+	changed := false
+	for path, weight := range newWeights {
+		if weight == 1 {
+			if _, ok := weights[path]; ok {
+				delete(weights, path)
+				changed = true
 			}
+		} else if weights[path] != weight {
+			weights[path] = weight
+			changed = true
 		}
+	}
 
-		if closer != nil {
-			err = closer.Close()
-			if err != nil {
-				return nil, err
-			}
+	if !changed {
+		return nil
+	}
+
+	if len(weights) == 0 {
+		return batch.Delete(getTextFieldWeightsKey(collectionName), nil)
+	}
+
+	value, err := json.Marshal(weights)
+	if err != nil {
+		return err
+	}
+
+	return batch.Set(getTextFieldWeightsKey(collectionName), value, nil)
+}
+
+// getMapTextFields returns the text fields of a map document, at the paths
+// recorded for the collection.
+func getMapTextFields(reader pebble.Reader, collectionName string, document interface{}) ([]textField, error) {
+	paths, err := getTextFieldPaths(reader, collectionName)
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+
+	// Convert the map to its JSON representation, in which the paths are recorded
+	b, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	var documentMap map[string]interface{}
+	if err := json.Unmarshal(b, &documentMap); err != nil {
+		return nil, err
+	}
+
+	var textFields []textField
+	for _, path := range paths {
+		if value, ok := getValueFromPath(documentMap, path); ok {
+			textFields = append(textFields, textField{path: path, texts: appendValueText(nil, value)})
 		}
 	}
 
-	return matchedIds, nil
+	return textFields, nil
 }
 
-func intersection(a, b []string) []string {
-	m := make(map[string]bool)
-	var result []string
-	for _, item := range a {
-		m[item] = true
+// addTextFieldPaths records the paths of text fields that are not yet
+// recorded for the collection.
+func addTextFieldPaths(batch *pebble.Batch, collectionName string, newPaths []string) error {
+	paths, err := getTextFieldPaths(batch, collectionName)
+	if err != nil {
+		return err
 	}
-	for _, item := range b {
-		if _, ok := m[item]; ok {
-			result = append(result, item)
+
+	changed := false
+	for _, newPath := range newPaths {
+		found := false
+		for _, path := range paths {
+			if path == newPath {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			paths = append(paths, newPath)
+			changed = true
 		}
 	}
-	return result
+
+	if !changed {
+		return nil
+	}
+
+	value, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+
+	return batch.Set(getTextFieldsKey(collectionName), value, nil)
 }
 
-// Utils
-func getIndexKey(collectionName, token string) []byte {
-	return []byte(collectionName + ":" + token)
+// textSchema is what the entries of a collection in the inverted index depend
+// on: the hash of the text analysis configuration, and the weights of the text
+// fields tagged in the struct type of the documents, by path. Fields is nil
+// until a struct document is indexed, as the text fields of maps are recorded
+// with AddTextFields instead. Stale is set once a document with other text
+// fields is indexed.
+type textSchema struct {
+	Config string             `json:"config"`
+	Fields map[string]float64 `json:"fields"`
+	Stale  bool               `json:"stale,omitempty"`
 }
 
-func (fts *FTS) Clear() error {
-	iter := fts.textIndex.NewIter(nil)
-	defer iter.Close()
+// hashConfig returns the hash of a text analysis configuration. A custom
+// tokenizer can't be hashed, so only its presence is.
+func hashConfig(stopwords map[string]struct{}, language string, customTokenizer bool) string {
+	words := make([]string, 0, len(stopwords))
+	for word := range stopwords {
+		words = append(words, word)
+	}
+	sort.Strings(words)
 
-	for iter.First(); iter.Valid(); iter.Next() {
-		if err := fts.textIndex.Delete(iter.Key(), pebble.Sync); err != nil {
-			return err
+	h := sha256.New()
+	h.Write([]byte(language + "\x00" + strconv.FormatBool(customTokenizer) + "\x00" + strings.Join(words, "\x00")))
+
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// getTypeTextFields returns the weights of the text fields tagged in the type
+// of a struct document, by path. The fields are those of the zero value of
+// the type, so that all the documents of a type have the same ones, leaving
+// out the fields of nested structs behind pointers. It returns nil for other
+// documents.
+func getTypeTextFields(document interface{}) map[string]float64 {
+	t := reflect.TypeOf(document)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields := map[string]float64{}
+	for _, textField := range getTextFields(reflect.New(t).Elem(), "", 0) {
+		fields[textField.path] = textField.weight
+	}
+
+	return fields
+}
+
+// getTextSchema returns the text schema recorded for the collection, or nil
+// if none is.
+func getTextSchema(reader pebble.Reader, collectionName string) (*textSchema, error) {
+	value, closer, err := reader.Get(getTextSchemaKey(collectionName))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var schema textSchema
+	if err := json.Unmarshal(value, &schema); err != nil {
+		return nil, err
+	}
+
+	return &schema, nil
+}
+
+// checkTextSchema records the text schema of the collection when its first
+// document is indexed, and the text fields of the struct type of the first
+// struct document. If the text fields of the document or the configuration
+// differ from the recorded ones, the entries of the collection were indexed
+// otherwise, so the collection is marked as stale and a warning is logged,
+// once per collection, until the index is rebuilt. So is a collection with
+// entries but no recorded schema, which were indexed by an earlier version
+// and can't be checked.
+func (fts *FTS) checkTextSchema(batch *pebble.Batch, collectionName string, document interface{}) error {
+	schema, err := getTextSchema(batch, collectionName)
+	if err != nil {
+		return err
+	}
+
+	fields := getTypeTextFields(document)
+
+	switch {
+	case schema == nil:
+		indexed, err := hasEntries(batch, collectionName)
+		if err != nil {
+			return err
+		}
+		if indexed {
+			fts.warnStale(collectionName)
+		}
+		schema = &textSchema{Config: fts.configHash, Fields: fields, Stale: indexed}
+	case schema.Config != fts.configHash || (fields != nil && schema.Fields != nil && !maps.Equal(fields, schema.Fields)):
+		fts.warnStale(collectionName)
+		if schema.Stale {
+			return nil
+		}
+		schema.Stale = true
+	case fields != nil && schema.Fields == nil:
+		schema.Fields = fields
+	default:
+		return nil
+	}
+
+	value, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+
+	return batch.Set(getTextSchemaKey(collectionName), value, nil)
+}
+
+// warnStale logs a warning that the entries of a collection are stale, once
+// per collection until it is rebuilt, if a logger is set.
+func (fts *FTS) warnStale(collectionName string) {
+	if _, warned := fts.warned.LoadOrStore(collectionName, true); !warned && fts.logger != nil {
+		fts.logger.Warn("full-text search index was built with other text fields or configuration, rebuild it with RebuildIndexes", logAttrs(collectionName)...)
+	}
+}
+
+// hasEntries checks if a collection has entries in the inverted index, in the
+// current or a legacy layout, rather than only its settings, which are under
+// keys starting with a zero byte.
+func hasEntries(reader pebble.Reader, collectionName string) (bool, error) {
+	prefix := getIndexKey(collectionName, "")
+	iter := reader.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if rest := iter.Key()[len(prefix):]; len(rest) > 0 && rest[0] != 0 {
+			return true, nil
+		}
+	}
+
+	return false, iter.Error()
+}
+
+// MarkUnrecordedStale marks a collection as stale if it has entries in the
+// inverted index but no recorded text schema, i.e. it was indexed by an
+// earlier version, which didn't fold the accents of the tokens. Its folded
+// searches would otherwise miss the documents with accented words until it is
+// rebuilt.
+func (fts *FTS) MarkUnrecordedStale(collectionName string) error {
+	schema, err := getTextSchema(fts.textIndex, collectionName)
+	if err != nil || schema != nil {
+		return err
+	}
+
+	indexed, err := hasEntries(fts.textIndex, collectionName)
+	if err != nil || !indexed {
+		return err
+	}
+
+	value, err := json.Marshal(textSchema{Config: fts.configHash, Stale: true})
+	if err != nil {
+		return err
+	}
+
+	return fts.textIndex.Set(getTextSchemaKey(collectionName), value, fts.writeOptions)
+}
+
+// IsStale reports whether the entries of a collection in the inverted index
+// were built with another text analysis configuration, e.g. other stopwords
+// or another language, or whether documents with other text fields were
+// indexed since, in which case the collection needs to be reindexed. Entries
+// without a recorded schema were indexed by an earlier version, so they are
+// stale too.
+func (fts *FTS) IsStale(collectionName string) (bool, error) {
+	schema, err := getTextSchema(fts.textIndex, collectionName)
+	if err != nil {
+		return false, err
+	}
+	if schema == nil {
+		return hasEntries(fts.textIndex, collectionName)
+	}
+
+	return schema.Stale || schema.Config != fts.configHash, nil
+}
+
+// getValueFromPath returns the value at a dot-separated path of a document.
+func getValueFromPath(document map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = document
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		value, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// addToDocumentCount adds delta to the number of indexed documents in the collection.
+func (fts *FTS) addToDocumentCount(batch *pebble.Batch, collectionName string, delta int) error {
+	key := getDocumentCountKey(collectionName)
+	count, err := getInt(batch, key)
+	if err != nil {
+		return err
+	}
+
+	count += delta
+	if count <= 0 {
+		return batch.Delete(key, nil)
+	}
+
+	return batch.Set(key, []byte(strconv.Itoa(count)), nil)
+}
+
+// weightedTermFrequency returns the number of occurrences of a token in a
+// document, decoded from the value of its posting key, where the occurrences
+// in each text field are multiplied by the weight of the field.
+func weightedTermFrequency(value []byte, weights map[string]float64) (float64, error) {
+	// Documents indexed before the fields were stored have a single count
+	if count, err := strconv.Atoi(string(value)); err == nil {
+		return float64(count), nil
+	}
+
+	var fieldFrequencies map[string]int
+	if err := json.Unmarshal(value, &fieldFrequencies); err != nil {
+		return 0, err
+	}
+
+	termFrequency := 0.0
+	for path, count := range fieldFrequencies {
+		weight, ok := weights[path]
+		if !ok {
+			weight = 1
+		}
+		termFrequency += float64(count) * weight
+	}
+
+	return termFrequency, nil
+}
+
+// hasKey checks if a key exists.
+func hasKey(reader pebble.Reader, key []byte) (bool, error) {
+	_, closer, err := reader.Get(key)
+	if err == pebble.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, closer.Close()
+}
+
+// getInt reads an integer value, which is 0 if the key doesn't exist.
+func getInt(reader pebble.Reader, key []byte) (int, error) {
+	value, closer, err := reader.Get(key)
+	if err == pebble.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+
+	return strconv.Atoi(string(value))
+}
+
+// Querying
+
+// Result is a document ID matched by a search, with its relevance score.
+type Result struct {
+	Id    string
+	Score float64
+}
+
+// SearchOptions configures a search.
+type SearchOptions struct {
+	// Fuzzy matches the search terms without any exact match to the indexed
+	// terms within MaxDistance edits (insertions, deletions or
+	// substitutions of a character), e.g. to tolerate typos.
+	Fuzzy bool
+	// MaxDistance is the maximum edit distance of fuzzy matches. Defaults to 2.
+	MaxDistance int
+}
+
+// defaultMaxDistance is the maximum edit distance of fuzzy matches when
+// SearchOptions.MaxDistance is not set.
+const defaultMaxDistance = 2
+
+// Search returns the IDs of the documents matching the text, ordered by
+// descending relevance.
+func (fts *FTS) Search(collectionName, text string, options ...SearchOptions) ([]string, error) {
+	results, err := fts.SearchWithScores(collectionName, text, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(results))
+	for i, result := range results {
+		ids[i] = result.Id
+	}
+
+	return ids, nil
+}
+
+// term is an indexed token matched by a search term, with the weighted term
+// frequencies of the documents containing it, by ID.
+type term struct {
+	token       string
+	frequencies map[string]float64
+	idf         float64
+}
+
+// SearchWithScores returns the documents matching the text, ordered by
+// descending TF-IDF score. A document matches if it contains every search
+// term, so a term without any match yields no results, whatever its position
+// in the text. The score of a document is the sum over the
+// search terms of the term frequency in the document multiplied by the
+// inverse document frequency of the term. The occurrences of a term in a
+// text field count as many times as the weight of the field.
+func (fts *FTS) SearchWithScores(collectionName, text string, options ...SearchOptions) ([]Result, error) {
+	searchOptions := SearchOptions{}
+	if len(options) > 0 {
+		searchOptions = options[0]
+	}
+	if searchOptions.MaxDistance <= 0 {
+		searchOptions.MaxDistance = defaultMaxDistance
+	}
+
+	var matchedIds []string
+	var terms []term
+
+	documentCount, err := getInt(fts.textIndex, getDocumentCountKey(collectionName))
+	if err != nil {
+		return nil, err
+	}
+
+	weights, err := getTextFieldWeights(fts.textIndex, collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	// The indexed tokens of the collection, loaded for the first fuzzy match
+	var vocabulary []string
+
+	tokens := fts.analyze(text)
+	if fts.logger != nil {
+		fts.logger.Debug("search text analyzed", logAttrs(collectionName, "text", text, "tokens", tokens)...)
+	}
+
+	for i, token := range tokens {
+		tokenTerms, err := fts.getTerm(collectionName, token, documentCount, weights)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(tokenTerms) == 0 && searchOptions.Fuzzy {
+			if vocabulary == nil {
+				if vocabulary, err = fts.getVocabulary(collectionName); err != nil {
+					return nil, err
+				}
+			}
+
+			for _, indexedToken := range vocabulary {
+				if !withinDistance(token, indexedToken, searchOptions.MaxDistance) {
+					continue
+				}
+
+				fuzzyTerms, err := fts.getTerm(collectionName, indexedToken, documentCount, weights)
+				if err != nil {
+					return nil, err
+				}
+				tokenTerms = append(tokenTerms, fuzzyTerms...)
+			}
+		}
+
+		if len(tokenTerms) == 0 {
+			// All the tokens must match, so no document matches
+			return []Result{}, nil
+		}
+
+		// A document matches the token if it contains any of its terms
+		var ids []string
+		seen := map[string]bool{}
+		for _, t := range tokenTerms {
+			for id := range t.frequencies {
+				if !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+		sort.Strings(ids)
+
+		if i == 0 {
+			matchedIds = ids
+		} else {
+			// Find the intersection
+			matchedIds = intersection(matchedIds, ids)
+		}
+
+		// Score each term once, even if it is matched by several tokens
+		for _, t := range tokenTerms {
+			if !slices.ContainsFunc(terms, func(other term) bool { return other.token == t.token }) {
+				terms = append(terms, t)
+			}
+		}
+	}
+
+	results := make([]Result, len(matchedIds))
+	for i, id := range matchedIds {
+		results[i].Id = id
+		for _, t := range terms {
+			termFrequency, ok := t.frequencies[id]
+			if !ok {
+				continue
+			}
+
+			// Documents indexed before term frequencies were stored count once
+			if termFrequency == 0 {
+				termFrequency = 1
+			}
+			results[i].Score += termFrequency * t.idf
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Id < results[j].Id
+	})
+
+	return results, nil
+}
+
+// getTerm returns the term of an indexed token with its posting list, read
+// from the keys under the prefix of the token, or no term if no document
+// contains the token.
+func (fts *FTS) getTerm(collectionName, token string, documentCount int, weights map[string]float64) ([]term, error) {
+	prefix := getPostingPrefix(collectionName, token)
+	iter := fts.textIndex.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	t := term{token: token, frequencies: map[string]float64{}}
+	for iter.First(); iter.Valid(); iter.Next() {
+		termFrequency, err := weightedTermFrequency(iter.Value(), weights)
+		if err != nil {
+			return nil, err
+		}
+
+		t.frequencies[string(iter.Key()[len(prefix):])] = termFrequency
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	if len(t.frequencies) == 0 {
+		return nil, nil
+	}
+
+	// Documents indexed before the count was kept are not counted
+	t.idf = 1 + math.Log(float64(max(documentCount, len(t.frequencies)))/float64(len(t.frequencies)))
+
+	return []term{t}, nil
+}
+
+// getVocabulary returns the indexed tokens of a collection, i.e. the tokens
+// of its posting lists.
+func (fts *FTS) getVocabulary(collectionName string) ([]string, error) {
+	prefix := getPostingsPrefix(collectionName)
+	iter := fts.textIndex.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	vocabulary := []string{}
+	for valid := iter.First(); valid; {
+		token, _, ok := parsePostingKey(iter.Key()[len(prefix):])
+		if !ok {
+			valid = iter.Next()
+			continue
+		}
+
+		vocabulary = append(vocabulary, token)
+
+		// Skip the rest of the posting list of the token
+		upperBound := prefixUpperBound(getPostingPrefix(collectionName, token))
+		if upperBound == nil {
+			break
+		}
+		valid = iter.SeekGE(upperBound)
+	}
+
+	return vocabulary, iter.Error()
+}
+
+// withinDistance checks if the Levenshtein distance between two tokens is at
+// most maxDistance.
+func withinDistance(a, b string, maxDistance int) bool {
+	s, t := []rune(a), []rune(b)
+	if len(s)-len(t) > maxDistance || len(t)-len(s) > maxDistance {
+		return false
+	}
+
+	// Distances between the prefixes of s and t, row by row
+	previous := make([]int, len(t)+1)
+	current := make([]int, len(t)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(s); i++ {
+		current[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(t)] <= maxDistance
+}
+
+// Highlight returns the texts of the text fields of a stored document, keyed
+// by path, with the words matching the search text wrapped in the pre and
+// post markers, e.g. "<mark>" and "</mark>". The words are analyzed like the
+// indexed text to find the matches. The texts of an array are joined with
+// spaces. Fields without any match are left out.
+func (fts *FTS) Highlight(collectionName string, document map[string]interface{}, text, pre, post string, options ...SearchOptions) (map[string]string, error) {
+	searchOptions := SearchOptions{}
+	if len(options) > 0 {
+		searchOptions = options[0]
+	}
+	if searchOptions.MaxDistance <= 0 {
+		searchOptions.MaxDistance = defaultMaxDistance
+	}
+
+	textFields, err := getMapTextFields(fts.textIndex, collectionName, document)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := fts.analyze(text)
+
+	// A word matches if it is analyzed into a token matching a search token.
+	// A custom tokenizer may split a word into several tokens, e.g. n-grams,
+	// any of which can match.
+	isMatch := func(word string) bool {
+		for _, wordToken := range fts.analyze(word) {
+			for _, token := range tokens {
+				if wordToken == token || searchOptions.Fuzzy && withinDistance(wordToken, token, searchOptions.MaxDistance) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	highlights := map[string]string{}
+	for _, field := range textFields {
+		texts := make([]string, len(field.texts))
+		matched := false
+
+		for i, fieldText := range field.texts {
+			var textMatched bool
+			texts[i], textMatched = highlightText(fieldText, isMatch, pre, post)
+			matched = matched || textMatched
+		}
+
+		if matched {
+			highlights[field.path] = strings.Join(texts, " ")
+		}
+	}
+
+	return highlights, nil
+}
+
+// highlightText wraps the matching words of a text in the markers. The words
+// are split like in tokenize. It also reports whether any word matched.
+func highlightText(text string, isMatch func(word string) bool, pre, post string) (string, bool) {
+	var b strings.Builder
+	matched := false
+
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+
+		if start >= 0 {
+			matched = writeWord(&b, text[start:i], isMatch, pre, post) || matched
+			start = -1
+		}
+		b.WriteRune(r)
+	}
+
+	if start >= 0 {
+		matched = writeWord(&b, text[start:], isMatch, pre, post) || matched
+	}
+
+	return b.String(), matched
+}
+
+// writeWord writes a word, wrapped in the markers if it matches, and reports
+// whether it matched.
+func writeWord(b *strings.Builder, word string, isMatch func(word string) bool, pre, post string) bool {
+	if !isMatch(word) {
+		b.WriteString(word)
+		return false
+	}
+
+	b.WriteString(pre)
+	b.WriteString(word)
+	b.WriteString(post)
+	return true
+}
+
+// intersection returns the items of b that are also in a, each at most once.
+func intersection(a, b []string) []string {
+	m := make(map[string]bool)
+	var result []string
+	for _, item := range a {
+		m[item] = true
+	}
+	for _, item := range b {
+		if _, ok := m[item]; ok {
+			result = append(result, item)
+			// Skip the duplicates of the item in b
+			delete(m, item)
+		}
+	}
+	return result
+}
+
+// Utils
+var collectionNameEscaper = strings.NewReplacer(`\`, `\\`, ":", `\:`)
+
+// idSeparator separates the IDs of the posting lists of earlier versions,
+// stored under the index key of each token. The database rejects the IDs
+// containing it.
+const idSeparator = ","
+
+// getIndexKey joins the collection name and the token with a colon. The
+// collection name is escaped the same way as the keys of the document store,
+// so that a colon in the collection name can't be mistaken for the separator.
+// The key prefix of the namespace of the collection, if any, is prepended.
+func getIndexKey(collectionName, token string) []byte {
+	namespace, name := splitCollectionName(collectionName)
+	return []byte(namespace + collectionNameEscaper.Replace(name) + ":" + token)
+}
+
+// The collection names of a namespaced DB are qualified with the key prefix
+// of the namespace between zero bytes. The key prefix of a namespace starts
+// with a backslash followed by "ns:", which never starts an escaped
+// collection name.
+const namespacePrefix = `\ns:`
+
+// splitCollectionName splits a qualified collection name into the key prefix
+// of its namespace and the name of the collection.
+func splitCollectionName(collectionName string) (namespace, name string) {
+	if !strings.HasPrefix(collectionName, "\x00") {
+		return "", collectionName
+	}
+
+	namespace, name, _ = strings.Cut(collectionName[1:], "\x00")
+	return namespace, name
+}
+
+// logAttrs returns the attributes of a log about a collection: its name and
+// the key prefix of its namespace, followed by the other attributes.
+func logAttrs(collectionName string, keysAndValues ...interface{}) []interface{} {
+	namespace, name := splitCollectionName(collectionName)
+	return append([]interface{}{"collection", name, "namespace", namespace}, keysAndValues...)
+}
+
+// Posting keys are made of the index key of the collection with a 0x03 byte
+// as the token, the length of the token as a uvarint, the token and the
+// document ID, and hold the number of occurrences of the token in each text
+// field of the document. Like the keys of the index of the database, each
+// document has its own key under the prefix of the token, so that indexing a
+// document doesn't rewrite the IDs of the other documents containing the
+// token, and the posting list of a token is found by iterating over the
+// prefix. The length keeps the IDs apart from the tokens.
+
+// getPostingsPrefix returns the prefix of the posting keys of a collection.
+func getPostingsPrefix(collectionName string) []byte {
+	return getIndexKey(collectionName, "\x03")
+}
+
+func getPostingPrefix(collectionName, token string) []byte {
+	prefix := binary.AppendUvarint(getPostingsPrefix(collectionName), uint64(len(token)))
+	return append(prefix, token...)
+}
+
+func getPostingKey(collectionName, token, id string) []byte {
+	return append(getPostingPrefix(collectionName, token), id...)
+}
+
+// parsePostingKey splits the rest of a posting key after the postings prefix
+// of the collection into the token and the document ID.
+func parsePostingKey(rest []byte) (token, id string, ok bool) {
+	length, n := binary.Uvarint(rest)
+	if n <= 0 || length > uint64(len(rest)-n) {
+		return "", "", false
+	}
+
+	end := n + int(length)
+
+	return string(rest[n:end]), string(rest[end:]), true
+}
+
+// getTextFieldsKey returns the key of the paths of the text fields indexed in the collection.
+func getTextFieldsKey(collectionName string) []byte {
+	return getIndexKey(collectionName, "\x00textFields")
+}
+
+// getTextFieldWeightsKey returns the key of the weights of the text fields of the collection.
+func getTextFieldWeightsKey(collectionName string) []byte {
+	return getIndexKey(collectionName, "\x00textFieldWeights")
+}
+
+// getTextSchemaKey returns the key of the text schema of the collection.
+func getTextSchemaKey(collectionName string) []byte {
+	return getIndexKey(collectionName, "\x00textSchema")
+}
+
+// getDocumentCountKey returns the key of the number of indexed documents in the collection.
+func getDocumentCountKey(collectionName string) []byte {
+	return getIndexKey(collectionName, "\x00")
+}
+
+// UpgradePostingLists converts the posting lists of a collection written by
+// earlier versions, a key per token holding the comma-separated IDs of its
+// documents, along with a key per document holding the term frequencies, into
+// a posting key per document holding the term frequencies.
+func (fts *FTS) UpgradePostingLists(collectionName string) error {
+	batch := fts.textIndex.NewBatch()
+	defer batch.Close()
+
+	prefix := getIndexKey(collectionName, "")
+	iter := fts.textIndex.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		rest := iter.Key()[len(prefix):]
+
+		// Skip the other entries of the collection and the posting keys
+		if len(rest) == 0 || rest[0] == 0 || rest[0] == 3 {
+			continue
+		}
+
+		// The term frequencies, under the token followed by a zero byte and
+		// the ID, are moved along with the posting list of the token
+		if bytes.IndexByte(rest, 0) >= 0 {
+			if err := batch.Delete(iter.Key(), nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		token := string(rest)
+		for _, id := range strings.Split(string(iter.Value()), idSeparator) {
+			if id == "" {
+				continue
+			}
+
+			value, closer, err := fts.textIndex.Get(append(getIndexKey(collectionName, token+"\x00"), id...))
+			if err != nil && err != pebble.ErrNotFound {
+				return err
+			}
+
+			// Documents indexed before term frequencies were stored count once
+			termFrequency := []byte("1")
+			if err == nil {
+				termFrequency = append([]byte(nil), value...)
+				if err := closer.Close(); err != nil {
+					return err
+				}
+			}
+
+			if err := batch.Set(getPostingKey(collectionName, token, id), termFrequency, nil); err != nil {
+				return err
+			}
+		}
+
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			return err
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return batch.Commit(fts.writeOptions)
+}
+
+func (fts *FTS) Clear() error {
+	iter := fts.textIndex.NewIter(nil)
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := fts.textIndex.Delete(iter.Key(), fts.writeOptions); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ClearNamespace deletes the entries of all the collections of a namespace,
+// given by its key prefix, except those of its nested namespaces, in a single
+// batch. The empty prefix clears the collections outside of any namespace.
+func (fts *FTS) ClearNamespace(namespace string) error {
+	nestedPrefix := []byte(namespace + namespacePrefix)
+
+	iter := fts.textIndex.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(namespace),
+		UpperBound: prefixUpperBound([]byte(namespace)),
+	})
+	defer iter.Close()
+
+	batch := fts.textIndex.NewBatch()
+	defer batch.Close()
+
+	for valid := iter.First(); valid; {
+		if bytes.HasPrefix(iter.Key(), nestedPrefix) {
+			// Skip the nested namespaces
+			upperBound := prefixUpperBound(nestedPrefix)
+			if upperBound == nil {
+				break
+			}
+			valid = iter.SeekGE(upperBound)
+			continue
+		}
+
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			return err
+		}
+		valid = iter.Next()
+	}
+
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return batch.Commit(fts.writeOptions)
+}
+
+// ClearCollectionBatch deletes all the entries of a collection from the
+// inverted index, but keeps the text fields of the collection and their
+// weights, as they may have been added with AddTextFields and
+// SetTextFieldWeight. The text schema of the collection is deleted, so that
+// it is recorded again as the documents are reindexed. The changes are
+// written to a batch created by NewBatch.
+func (fts *FTS) ClearCollectionBatch(batch *pebble.Batch, collectionName string) error {
+	fts.warned.Delete(collectionName)
+
+	textFieldsKey := getTextFieldsKey(collectionName)
+	textFieldWeightsKey := getTextFieldWeightsKey(collectionName)
+	prefix := getIndexKey(collectionName, "")
+	iter := fts.textIndex.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if bytes.Equal(iter.Key(), textFieldsKey) || bytes.Equal(iter.Key(), textFieldWeightsKey) {
+			continue
+		}
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DropCollectionBatch is like ClearCollectionBatch, but also deletes the text
+// fields of the collection and their weights.
+func (fts *FTS) DropCollectionBatch(batch *pebble.Batch, collectionName string) error {
+	if err := fts.ClearCollectionBatch(batch, collectionName); err != nil {
+		return err
+	}
+
+	if err := batch.Delete(getTextFieldWeightsKey(collectionName), nil); err != nil {
+		return err
+	}
+
+	return batch.Delete(getTextFieldsKey(collectionName), nil)
+}
+
+// CompactCollection compacts the keys of a collection in the inverted index,
+// e.g. to reclaim the space of the deleted posting lists.
+func (fts *FTS) CompactCollection(collectionName string) error {
+	prefix := getIndexKey(collectionName, "")
+	return fts.textIndex.Compact(prefix, prefixUpperBound(prefix), true)
+}
+
+// prefixUpperBound returns the smallest key greater than all the keys with the prefix.
+func prefixUpperBound(prefix []byte) []byte {
+	upper := append([]byte(nil), prefix...)
+	for i := len(upper) - 1; i >= 0; i-- {
+		upper[i]++
+		if upper[i] != 0 {
+			return upper[:i+1]
 		}
 	}
 
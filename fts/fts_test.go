@@ -0,0 +1,308 @@
+package fts
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// openTestFTS opens an FTS in a temporary directory, closed when the test ends.
+func openTestFTS(t *testing.T) *FTS {
+	t.Helper()
+
+	fts, err := NewFTS(filepath.Join(t.TempDir(), "text_index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fts.Close() })
+
+	return fts
+}
+
+type article struct {
+	Title string `json:"title" objectdb:"textIndex"`
+}
+
+// Run with -race: the posting lists are written and read while other
+// goroutines index and search.
+func TestAddToIndexConcurrently(t *testing.T) {
+	fts := openTestFTS(t)
+
+	const collections = 8
+	const documents = 50
+
+	var wg sync.WaitGroup
+	for c := 0; c < collections; c++ {
+		wg.Add(2)
+
+		collectionName := fmt.Sprintf("articles%d", c)
+
+		// The writes of a collection are serialized by the database, so each
+		// collection is indexed by a single goroutine
+		go func() {
+			defer wg.Done()
+			for i := 0; i < documents; i++ {
+				id := fmt.Sprintf("id%d", i)
+				if err := fts.AddToIndex(collectionName, id, article{Title: "golang concurrency " + id}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < documents; i++ {
+				if _, err := fts.Search(collectionName, "golang"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for c := 0; c < collections; c++ {
+		collectionName := fmt.Sprintf("articles%d", c)
+
+		ids := postingList(t, fts, collectionName, "golang")
+
+		sort.Strings(ids)
+		want := make([]string, documents)
+		for i := range want {
+			want[i] = fmt.Sprintf("id%d", i)
+		}
+		sort.Strings(want)
+
+		if strings.Join(ids, idSeparator) != strings.Join(want, idSeparator) {
+			t.Fatalf("%s: posting list of golang is %v, want %v", collectionName, ids, want)
+		}
+
+		found, err := fts.Search(collectionName, "golang")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != documents {
+			t.Fatalf("%s: found %d documents, want %d", collectionName, len(found), documents)
+		}
+	}
+}
+
+// postingList returns the IDs of the posting list of a token.
+func postingList(t *testing.T, fts *FTS, collectionName, token string) []string {
+	t.Helper()
+
+	prefix := getPostingPrefix(collectionName, token)
+	iter := fts.textIndex.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+
+	var ids []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		ids = append(ids, string(iter.Key()[len(prefix):]))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ids
+}
+
+func TestUpgradePostingLists(t *testing.T) {
+	fts := openTestFTS(t)
+
+	for id, title := range map[string]string{"1": "golang golang concurrency", "2": "golang generics"} {
+		if err := fts.AddToIndex("articles", id, article{Title: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rewrite the posting lists in the layout of earlier versions, with the
+	// IDs of each token under a single key, and the term frequencies under
+	// the token followed by a zero byte and the ID
+	prefix := getPostingsPrefix("articles")
+	lists := map[string][]string{}
+
+	batch := fts.textIndex.NewBatch()
+	iter := fts.textIndex.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	for iter.First(); iter.Valid(); iter.Next() {
+		token, id, _ := parsePostingKey(iter.Key()[len(prefix):])
+		lists[token] = append(lists[token], id)
+
+		// The document 2 was indexed before term frequencies were stored
+		if id != "2" {
+			batch.Set(append(getIndexKey("articles", token+"\x00"), id...), iter.Value(), nil)
+		}
+		batch.Delete(iter.Key(), nil)
+	}
+	iter.Close()
+
+	for token, ids := range lists {
+		batch.Set(getIndexKey("articles", token), []byte(strings.Join(ids, idSeparator)), nil)
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fts.UpgradePostingLists("articles"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := postingList(t, fts, "articles", "golang"); strings.Join(ids, idSeparator) != "1,2" {
+		t.Fatalf("posting list of golang is %v, want 1 and 2", ids)
+	}
+
+	// The term frequencies are kept, so the document with golang twice ranks
+	// first
+	results, err := fts.SearchWithScores("articles", "golang")
+	if err != nil || len(results) != 2 || results[0].Id != "1" || results[0].Score <= results[1].Score {
+		t.Fatalf("found %v (%v), want 1 ranked before 2", results, err)
+	}
+
+	// Only the posting keys are left
+	iter = fts.textIndex.NewIter(&pebble.IterOptions{LowerBound: getIndexKey("articles", ""), UpperBound: prefixUpperBound(getIndexKey("articles", ""))})
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if rest := iter.Key()[len(getIndexKey("articles", "")):]; rest[0] != 0 && rest[0] != 3 {
+			t.Fatalf("key %q of the earlier layout left", iter.Key())
+		}
+	}
+}
+
+func TestSearchWithMissingTerm(t *testing.T) {
+	fts := openTestFTS(t)
+
+	if err := fts.AddToIndex("articles", "1", article{Title: "golang concurrency patterns"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fts.AddToIndex("articles", "2", article{Title: "golang generics"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, err := fts.Search("articles", "golang concurrency"); err != nil || len(ids) != 1 {
+		t.Fatalf("found %v (%v), want document 1", ids, err)
+	}
+
+	// A term without any match yields no results, wherever it is
+	for _, text := range []string{
+		"unknownterm golang concurrency",
+		"golang unknownterm concurrency",
+		"golang concurrency unknownterm",
+	} {
+		ids, err := fts.Search("articles", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 0 {
+			t.Errorf("%q: found %v, want no results", text, ids)
+		}
+	}
+}
+
+func TestSearchAccentedStemmedWords(t *testing.T) {
+	fts := openTestFTS(t)
+
+	if err := fts.AddToIndex("articles", "1", article{Title: "Résumés of the chefs"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fts.AddToIndex("articles", "2", article{Title: "Crème brûlée recipes"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fts.AddToIndex("articles", "3", article{Title: "resumes and brulee"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The accented and plain forms are stemmed alike, whichever is indexed
+	for text, want := range map[string]string{
+		"resume":  "1,3",
+		"resumes": "1,3",
+		"résumé":  "1,3",
+		"brulee":  "2,3",
+		"brûlée":  "2,3",
+		"creme":   "2",
+	} {
+		ids, err := fts.Search("articles", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(ids)
+		if got := strings.Join(ids, ","); got != want {
+			t.Errorf("%q: found %s, want %s", text, got, want)
+		}
+	}
+}
+
+func TestMarkUnrecordedStale(t *testing.T) {
+	fts := openTestFTS(t)
+
+	if err := fts.AddToIndex("articles", "1", article{Title: "Crème brûlée"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fts.AddTextFields("notes", "text"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A collection with a recorded text schema was indexed with folding
+	if err := fts.MarkUnrecordedStale("articles"); err != nil {
+		t.Fatal(err)
+	}
+	if stale, err := fts.IsStale("articles"); err != nil || stale {
+		t.Fatalf("articles stale: %v (%v), want false", stale, err)
+	}
+
+	// Drop the text schema, like a collection indexed by an earlier version
+	if err := fts.textIndex.Delete(getTextSchemaKey("articles"), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, collectionName := range []string{"articles", "notes"} {
+		if err := fts.MarkUnrecordedStale(collectionName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A collection with only its settings has nothing to rebuild
+	for collectionName, want := range map[string]bool{"articles": true, "notes": false} {
+		if stale, err := fts.IsStale(collectionName); err != nil || stale != want {
+			t.Fatalf("%s stale: %v (%v), want %v", collectionName, stale, err, want)
+		}
+	}
+}
+
+func TestUnrecordedSchemaIsStale(t *testing.T) {
+	fts := openTestFTS(t)
+
+	if err := fts.AddToIndex("articles", "1", article{Title: "golang generics"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the text schema, like a collection indexed by an earlier version
+	if err := fts.textIndex.Delete(getTextSchemaKey("articles"), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	if stale, err := fts.IsStale("articles"); err != nil || !stale {
+		t.Fatalf("stale: %v (%v), want true", stale, err)
+	}
+
+	// The next document doesn't adopt the current configuration
+	if err := fts.AddToIndex("articles", "2", article{Title: "golang concurrency"}); err != nil {
+		t.Fatal(err)
+	}
+	if schema, err := getTextSchema(fts.textIndex, "articles"); err != nil || schema == nil || !schema.Stale {
+		t.Fatalf("recorded schema %+v (%v), want a stale one", schema, err)
+	}
+
+	// A collection indexed from scratch isn't stale
+	if err := fts.AddToIndex("notes", "1", article{Title: "golang generics"}); err != nil {
+		t.Fatal(err)
+	}
+	if stale, err := fts.IsStale("notes"); err != nil || stale {
+		t.Fatalf("notes stale: %v (%v), want false", stale, err)
+	}
+}